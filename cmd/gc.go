@@ -0,0 +1,91 @@
+/*
+Copyright © 2023 ZheNing Hu <adlternative@gmail.com>
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/adlternative/tinygitfs/pkg/data"
+	"github.com/adlternative/tinygitfs/pkg/datasource"
+	"github.com/adlternative/tinygitfs/pkg/gc"
+	"github.com/adlternative/tinygitfs/pkg/metadata"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	gcMetadataUrl string
+	gcDataOption  data.Option
+	gcOption      gc.Option
+	gcInterval    time.Duration
+)
+
+// gcCmd represents the gc command
+var gcCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "delete the objects no file refer to from the object storage",
+	Long: `tinygitfs gc --metadata=<url> [--data=<url>] [--grace=<duration>] [--dry-run] [--interval=<duration>]
+
+List the objects of the chunks and the loose objects in the object storage,
+and delete the ones which are not referred by any chunk of the files and are
+written before the grace period, then print what is found. With --dry-run
+the orphaned objects are only reported. With --interval the gc is run in the
+background every interval until it is interrupted. A bolt database can only
+be collected while it is not mounted.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+		defer cancel()
+
+		meta, err := metadata.NewMeta(gcMetadataUrl)
+		if err != nil {
+			log.WithError(err).Fatal("open metadata failed")
+		}
+		objectStorage, err := data.NewObjectStorage(&gcDataOption)
+		if err != nil {
+			log.WithError(err).Fatal("open object storage failed")
+		}
+		source := &datasource.DataSource{
+			Meta: meta,
+			Data: objectStorage,
+		}
+
+		if gcInterval > 0 {
+			gc.Background(ctx, source, &gcOption, gcInterval)
+			return
+		}
+
+		report, err := gc.Collect(ctx, source, &gcOption)
+		if err != nil {
+			log.WithError(err).Fatal("gc failed")
+		}
+		fmt.Printf("objects:       %d (%d bytes)\n", report.Objects, report.Bytes)
+		fmt.Printf("live:          %d\n", report.Live)
+		fmt.Printf("young:         %d\n", report.Young)
+		fmt.Printf("orphans:       %d (%d bytes)\n", report.Orphans, report.OrphanBytes)
+		fmt.Printf("deleted:       %d (%d bytes)\n", report.Deleted, report.DeletedBytes)
+		if gcOption.DryRun && report.Orphans > 0 {
+			fmt.Fprintln(os.Stderr, "dry run, run without --dry-run to delete the orphans")
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(gcCmd)
+
+	gcCmd.Flags().StringVar(&gcMetadataUrl, "metadata", "", "metadata url of the volume (e.g. redis://127.0.0.1:6379/1)")
+	gcCmd.Flags().StringVar(&gcDataOption.URL, "data", "", "data url of the volume: s3://<bucket>, file:///<dir> or mem:// (default s3 with --bucket)")
+	gcCmd.Flags().StringVar(&gcDataOption.EndPoint, "endpoint", "", "A endpoint URL to store data")
+	gcCmd.Flags().StringVar(&gcDataOption.Bucket, "bucket", "", "A bucket to store data")
+	gcCmd.Flags().StringVar(&gcDataOption.Accesskey, "access_key", "", "Access key for object storage (env ACCESS_KEY)")
+	gcCmd.Flags().StringVar(&gcDataOption.SecretKey, "secret_key", "", "Secret key for object storage  (env SECRET_KEY)")
+	gcCmd.Flags().DurationVar(&gcOption.Grace, "grace", time.Hour, "keep the objects written in the grace period even if no file refer to them")
+	gcCmd.Flags().BoolVar(&gcOption.DryRun, "dry-run", false, "only report the orphaned objects without deleting them")
+	gcCmd.Flags().DurationVar(&gcInterval, "interval", 0, "run gc in the background every interval until interrupted, 0 to run once")
+}
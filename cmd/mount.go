@@ -19,6 +19,7 @@ var (
 	debug       bool
 	metadataUrl string
 	dataOption  data.Option
+	gitfsOption gitfs.Option
 )
 
 // mountCmd represents the mount command
@@ -33,7 +34,7 @@ var mountCmd = &cobra.Command{
 		termCh := make(chan os.Signal, len(signals))
 		signal.Notify(termCh, signals...)
 
-		server, err := gitfs.Mount(ctx, args[0], debug, metadataUrl, &dataOption)
+		server, err := gitfs.Mount(ctx, args[0], debug, metadataUrl, &dataOption, &gitfsOption)
 		if err != nil {
 			log.WithError(err).Errorf("gitfs mount failed")
 			cancel()
@@ -66,9 +67,14 @@ func init() {
 	rootCmd.AddCommand(mountCmd)
 
 	mountCmd.Flags().BoolVar(&debug, "debug", false, "show fuse debug messages")
-	mountCmd.Flags().StringVar(&metadataUrl, "metadata", "", "metadata url")
+	mountCmd.Flags().StringVar(&metadataUrl, "metadata", "", "metadata url, the scheme selects the metadata engine (e.g. redis://127.0.0.1:6379/1)")
+	mountCmd.Flags().StringVar(&dataOption.URL, "data", "", "data url, the scheme selects the object storage: s3://<bucket>, file:///<dir> or mem:// (default s3 with --bucket)")
 	mountCmd.Flags().StringVarP(&dataOption.EndPoint, "endpoint", "", "", "A endpoint URL to store data")
 	mountCmd.Flags().StringVarP(&dataOption.Bucket, "bucket", "", "", "A bucket to store data")
 	mountCmd.Flags().StringVarP(&dataOption.Accesskey, "access_key", "", "", "Access key for object storage (env ACCESS_KEY)")
 	mountCmd.Flags().StringVarP(&dataOption.SecretKey, "secret_key", "", "", "Secret key for object storage  (env SECRET_KEY)")
+	mountCmd.Flags().StringArrayVar(&gitfsOption.Routes, "route", nil, "store files in .git matching a glob in a storage class: kv, symref, packed-refs, reflog, loose, object or local (e.g. --route 'logs/**=local'), can be repeated, the routes are fixed by the first mount of the volume, and files routed to local are private to the mount")
+	mountCmd.Flags().StringVar(&gitfsOption.LocalDir, "local-dir", "", "local directory to store files routed to local")
+	mountCmd.Flags().StringVar(&gitfsOption.Compress, "compress", "none", "compress the chunks of the files with none, zstd or lz4")
+	mountCmd.Flags().DurationVar(&gitfsOption.CacheTimeout, "cache-timeout", 0, "how long the kernel cache the entries and the attributes of the files outside .git, the changes of other mounts may not be seen meanwhile")
 }
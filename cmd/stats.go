@@ -0,0 +1,50 @@
+/*
+Copyright © 2023 ZheNing Hu <adlternative@gmail.com>
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/adlternative/tinygitfs/pkg/metadata"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var statsMetadataUrl string
+
+// statsCmd represents the stats command
+var statsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "print how much the data of the volume is deduplicated",
+	Long: `tinygitfs stats --metadata=<url>
+
+Print the number of objects in the object storage and the chunks of the files
+referring to them, the total length of the chunks and the size of the objects,
+and the dedupe ratio, which is how many times the chunks are larger than the objects.
+A bolt database can only be read while it is not mounted.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		meta, err := metadata.NewMeta(statsMetadataUrl)
+		if err != nil {
+			log.WithError(err).Fatal("open metadata failed")
+		}
+		stats, err := meta.DedupeStats(context.Background())
+		if err != nil {
+			log.WithError(err).Fatal("get dedupe stats failed")
+		}
+
+		fmt.Printf("objects:       %d\n", stats.Objects)
+		fmt.Printf("chunks:        %d\n", stats.Chunks)
+		fmt.Printf("logical bytes: %d\n", stats.LogicalBytes)
+		fmt.Printf("stored bytes:  %d\n", stats.StoredBytes)
+		fmt.Printf("dedupe ratio:  %.2f\n", stats.Ratio())
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(statsCmd)
+
+	statsCmd.Flags().StringVar(&statsMetadataUrl, "metadata", "", "metadata url of the volume (e.g. redis://127.0.0.1:6379/1)")
+}
@@ -0,0 +1,156 @@
+/*
+Copyright © 2023 ZheNing Hu <adlternative@gmail.com>
+*/
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/adlternative/tinygitfs/pkg/gitfs"
+	"github.com/adlternative/tinygitfs/pkg/metadata"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var updateRefsMetadataUrl string
+
+// zeroOid is the placeholder of the object id git use for a missing ref,
+// which is replaced by the one of the object format by setZeroOid, it has a
+// space so that no field of the commands is taken for it
+const zeroOid = "<zero oid>"
+
+// setZeroOid replace the placeholders of the zero oid of the updates by the
+// zero oid in the object format of the repository, which is the one of the
+// oids given with the updates, as git give in the object format of the
+// repository, or sha1 if none is given, since any zero oid tell UpdateRefs
+// that a ref is missing
+func setZeroOid(updates []*metadata.RefUpdate) error {
+	length := 0
+	for _, update := range updates {
+		for _, oid := range []string{update.Old, update.New} {
+			if oid == "" || oid == zeroOid {
+				continue
+			}
+			if length != 0 && len(oid) != length {
+				return fmt.Errorf("object ids of ref %s and the other refs are in different object formats", update.Ref)
+			}
+			length = len(oid)
+		}
+	}
+	if length == 0 {
+		length = sha1.Size * 2
+	}
+	for _, update := range updates {
+		if update.Old == zeroOid {
+			update.Old = strings.Repeat("0", length)
+		}
+		if update.New == zeroOid {
+			update.New = strings.Repeat("0", length)
+		}
+	}
+	return nil
+}
+
+// updateRefsCmd represents the update-refs command
+var updateRefsCmd = &cobra.Command{
+	Use:   "update-refs <repo>",
+	Short: "update refs of a repository atomically",
+	Long: `tinygitfs update-refs --metadata=<url> <repo>
+
+Read commands like git update-ref --stdin from stdin, one per line:
+
+	update <ref> <new-oid> [<old-oid>]
+	create <ref> <new-oid>
+	delete <ref> [<old-oid>]
+	verify <ref> [<old-oid>]
+
+and apply them to the repository at <repo>, a path relative to the mount point,
+in one transaction of the metadata, so either all the refs are updated or none
+of them is if any ref does not have its old value, e.g. in a pre-receive hook.
+The routes of the volume must store the refs and packed-refs in the metadata.
+A bolt database can only be updated while it is not mounted.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		updates, err := parseRefUpdates(bufio.NewScanner(os.Stdin))
+		if err == nil {
+			err = setZeroOid(updates)
+		}
+		if err != nil {
+			log.WithError(err).Fatal("parse ref updates failed")
+		}
+
+		meta, err := metadata.NewMeta(updateRefsMetadataUrl)
+		if err != nil {
+			log.WithError(err).Fatal("open metadata failed")
+		}
+		err = gitfs.UpdateRefs(context.Background(), meta, args[0], updates)
+		if err != nil {
+			log.WithError(err).Fatal("update refs failed")
+		}
+	},
+}
+
+// parseRefUpdates parse the commands of git update-ref --stdin into ref updates
+func parseRefUpdates(scanner *bufio.Scanner) ([]*metadata.RefUpdate, error) {
+	var updates []*metadata.RefUpdate
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("missing ref of %q", scanner.Text())
+		}
+
+		update := &metadata.RefUpdate{Ref: fields[1]}
+		args := fields[2:]
+		switch fields[0] {
+		case "update":
+			if len(args) != 1 && len(args) != 2 {
+				return nil, fmt.Errorf("update expect <new-oid> [<old-oid>]: %q", scanner.Text())
+			}
+			update.New = args[0]
+			if len(args) == 2 {
+				update.Old = args[1]
+			}
+		case "create":
+			if len(args) != 1 {
+				return nil, fmt.Errorf("create expect <new-oid>: %q", scanner.Text())
+			}
+			update.New = args[0]
+			update.Old = zeroOid
+		case "delete":
+			if len(args) > 1 {
+				return nil, fmt.Errorf("delete expect [<old-oid>]: %q", scanner.Text())
+			}
+			update.New = zeroOid
+			if len(args) == 1 {
+				update.Old = args[0]
+			}
+		case "verify":
+			if len(args) > 1 {
+				return nil, fmt.Errorf("verify expect [<old-oid>]: %q", scanner.Text())
+			}
+			// a missing old oid verify that the ref does not exist
+			update.Old = zeroOid
+			if len(args) == 1 {
+				update.Old = args[0]
+			}
+		default:
+			return nil, fmt.Errorf("unknown command %q", fields[0])
+		}
+		updates = append(updates, update)
+	}
+	return updates, scanner.Err()
+}
+
+func init() {
+	rootCmd.AddCommand(updateRefsCmd)
+
+	updateRefsCmd.Flags().StringVar(&updateRefsMetadataUrl, "metadata", "", "metadata url of the mount (e.g. redis://127.0.0.1:6379/1)")
+}
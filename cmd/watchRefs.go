@@ -0,0 +1,62 @@
+/*
+Copyright © 2023 ZheNing Hu <adlternative@gmail.com>
+*/
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/adlternative/tinygitfs/pkg/metadata"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var watchMetadataUrl string
+
+// watchRefsCmd represents the watch-refs command
+var watchRefsCmd = &cobra.Command{
+	Use:   "watch-refs",
+	Short: "print ref changes as JSON lines",
+	Long: `tinygitfs watch-refs --metadata=<url>
+
+Print a JSON line like {"repo":"path/to/repo","ref":"refs/heads/master","old":"<oid>","new":"<oid>"}
+for every ref changed in the mounts of the metadata from now on, until interrupted.
+A bolt database is not supported, since it can only be opened by one process
+and its ref events are only delivered in the process of the mount.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+		defer cancel()
+
+		if strings.HasPrefix(watchMetadataUrl, "bolt://") {
+			log.Fatal("watch-refs does not support bolt, whose ref events are only delivered in the process of the mount")
+		}
+
+		meta, err := metadata.NewMeta(watchMetadataUrl)
+		if err != nil {
+			log.WithError(err).Fatal("open metadata failed")
+		}
+		events, err := meta.WatchRefEvents(ctx)
+		if err != nil {
+			log.WithError(err).Fatal("watch ref events failed")
+		}
+
+		encoder := json.NewEncoder(os.Stdout)
+		for event := range events {
+			if err := encoder.Encode(event); err != nil {
+				log.WithError(err).Fatal("write ref event failed")
+			}
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(watchRefsCmd)
+
+	watchRefsCmd.Flags().StringVar(&watchMetadataUrl, "metadata", "", "metadata url of the mounts to watch (e.g. redis://127.0.0.1:6379/1)")
+}
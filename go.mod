@@ -7,10 +7,15 @@ require (
 	github.com/go-redis/redis/v8 v8.11.5
 	github.com/hanwen/go-fuse/v2 v2.2.1-0.20230205184629-615a0a7e1178
 	github.com/hashicorp/golang-lru/v2 v2.0.1
+	github.com/klauspost/compress v1.15.11
+	github.com/mattn/go-sqlite3 v1.14.16
+	github.com/pierrec/lz4/v4 v4.1.17
 	github.com/romnn/testcontainers v0.2.2
 	github.com/sirupsen/logrus v1.9.0
 	github.com/spf13/cobra v1.6.1
 	github.com/stretchr/testify v1.8.2
+	go.etcd.io/bbolt v1.3.7
+	golang.org/x/sys v0.6.0
 )
 
 require (
@@ -32,7 +37,6 @@ require (
 	github.com/imdario/mergo v0.3.13 // indirect
 	github.com/inconshreveable/mousetrap v1.0.1 // indirect
 	github.com/jmespath/go-jmespath v0.4.0 // indirect
-	github.com/klauspost/compress v1.15.11 // indirect
 	github.com/magiconair/properties v1.8.7 // indirect
 	github.com/moby/patternmatcher v0.5.0 // indirect
 	github.com/moby/sys/sequential v0.5.0 // indirect
@@ -47,7 +51,6 @@ require (
 	github.com/testcontainers/testcontainers-go v0.19.0 // indirect
 	golang.org/x/mod v0.6.0 // indirect
 	golang.org/x/net v0.7.0 // indirect
-	golang.org/x/sys v0.6.0 // indirect
 	golang.org/x/tools v0.1.12 // indirect
 	google.golang.org/genproto v0.0.0-20221018160656-63c7b68cfc55 // indirect
 	google.golang.org/grpc v1.50.1 // indirect
@@ -0,0 +1,116 @@
+package compress
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// Compressor compress the chunks of the files before they are stored
+type Compressor interface {
+	// Name is the algorithm recorded in the chunks, "" for no compression
+	Name() string
+	Compress(src []byte) ([]byte, error)
+	// Decompress write the content of the chunk to dst, which must be large
+	// enough, and return its length
+	Decompress(dst, src []byte) (int, error)
+}
+
+var (
+	zstdOnce sync.Once
+	zstdC    *zstdCompressor
+	zstdErr  error
+)
+
+// NewCompressor return the compressor of the algorithm, which is none, zstd
+// or lz4, the compressors are shared since they are safe for concurrent use
+func NewCompressor(algorithm string) (Compressor, error) {
+	switch algorithm {
+	case "", "none":
+		return noneCompressor{}, nil
+	case "zstd":
+		zstdOnce.Do(func() {
+			zstdC, zstdErr = newZstdCompressor()
+		})
+		return zstdC, zstdErr
+	case "lz4":
+		return lz4Compressor{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported compression %s", algorithm)
+	}
+}
+
+type noneCompressor struct{}
+
+func (noneCompressor) Name() string { return "" }
+
+func (noneCompressor) Compress(src []byte) ([]byte, error) { return src, nil }
+
+func (noneCompressor) Decompress(dst, src []byte) (int, error) {
+	if len(src) > len(dst) {
+		return 0, fmt.Errorf("decompressed %d bytes, more than %d", len(src), len(dst))
+	}
+	return copy(dst, src), nil
+}
+
+// zstdCompressor share the encoder and decoder, which are safe for concurrent use
+type zstdCompressor struct {
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+}
+
+func newZstdCompressor() (*zstdCompressor, error) {
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, err
+	}
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		return nil, err
+	}
+	return &zstdCompressor{
+		encoder: encoder,
+		decoder: decoder,
+	}, nil
+}
+
+func (c *zstdCompressor) Name() string { return "zstd" }
+
+func (c *zstdCompressor) Compress(src []byte) ([]byte, error) {
+	return c.encoder.EncodeAll(src, nil), nil
+}
+
+func (c *zstdCompressor) Decompress(dst, src []byte) (int, error) {
+	content, err := c.decoder.DecodeAll(src, dst[:0])
+	if err != nil {
+		return 0, err
+	}
+	if len(content) > len(dst) {
+		return 0, fmt.Errorf("zstd: decompressed %d bytes, more than %d", len(content), len(dst))
+	}
+	return copy(dst, content), nil
+}
+
+// lz4Compressor store the chunks as lz4 blocks
+type lz4Compressor struct{}
+
+func (lz4Compressor) Name() string { return "lz4" }
+
+func (lz4Compressor) Compress(src []byte) ([]byte, error) {
+	dst := make([]byte, lz4.CompressBlockBound(len(src)))
+	n, err := lz4.CompressBlock(src, dst, nil)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		// incompressible, which is told by the length of the result
+		return src, nil
+	}
+	return dst[:n], nil
+}
+
+func (lz4Compressor) Decompress(dst, src []byte) (int, error) {
+	return lz4.UncompressBlock(src, dst)
+}
@@ -1,8 +1,78 @@
 package data
 
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"time"
+)
+
 type Option struct {
+	// URL select the object storage by its scheme, e.g. s3://gitfs,
+	// file:///var/lib/tinygitfs/data or mem://, s3://<Bucket> if empty
+	URL       string
 	EndPoint  string
 	Bucket    string
 	Accesskey string
 	SecretKey string
 }
+
+type Object interface {
+	Key() string
+	Size() int64
+	Mtime() time.Time
+	IsDir() bool
+}
+
+type obj struct {
+	key   string
+	size  int64
+	mtime time.Time
+	isDir bool
+}
+
+func (o *obj) Key() string      { return o.key }
+func (o *obj) Size() int64      { return o.size }
+func (o *obj) Mtime() time.Time { return o.mtime }
+func (o *obj) IsDir() bool      { return o.isDir }
+
+// ObjectStorage store the data of the files as objects by key
+type ObjectStorage interface {
+	String() string
+	// Init create the storage, e.g. the bucket, if it does not exist
+	Init() error
+	// Get read limit bytes of the object from off, or to the end if limit is -1
+	Get(key string, off, limit int64) (io.ReadCloser, error)
+	Put(key string, in io.Reader) error
+	// Head return the object of key, nil if it does not exist
+	Head(key string) (Object, error)
+	Delete(key string) error
+	// List return at most limit objects whose keys have prefix and are after marker in order
+	List(prefix, marker string, limit int64) ([]Object, error)
+}
+
+type Creator func(uri *url.URL, option *Option) (ObjectStorage, error)
+
+var storages = make(map[string]Creator)
+
+// Register make an object storage available by the scheme of the data url
+func Register(scheme string, creator Creator) {
+	storages[scheme] = creator
+}
+
+// NewObjectStorage create the object storage selected by the scheme of option.URL
+func NewObjectStorage(option *Option) (ObjectStorage, error) {
+	rawURL := option.URL
+	if rawURL == "" {
+		rawURL = "s3://" + option.Bucket
+	}
+	uri, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid data url %s: %w", rawURL, err)
+	}
+	creator, ok := storages[uri.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("invalid data url %s: unsupported storage %s", rawURL, uri.Scheme)
+	}
+	return creator(uri, option)
+}
@@ -0,0 +1,263 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+func init() {
+	// file:///<dir>
+	Register("file", func(uri *url.URL, option *Option) (ObjectStorage, error) {
+		if uri.Path == "" {
+			return nil, fmt.Errorf("invalid data url %s: missing directory", uri)
+		}
+		return NewFileData(uri.Path), nil
+	})
+}
+
+// FileData is an object storage in a local directory, every object is
+// a file whose path under the directory is its key. An object is written
+// to a temporary file which is renamed to its key after synced, so it is
+// never seen partially, and its crc32c is kept in an extended attribute.
+type FileData struct {
+	root string
+}
+
+func NewFileData(root string) *FileData {
+	return &FileData{root: root}
+}
+
+func (s *FileData) String() string {
+	return fmt.Sprintf("file://%s/", s.root)
+}
+
+func (s *FileData) path(key string) string {
+	return filepath.Join(s.root, filepath.FromSlash(key))
+}
+
+func (s *FileData) Init() error {
+	return os.MkdirAll(s.root, 0755)
+}
+
+type limitedFile struct {
+	io.Reader
+	io.Closer
+}
+
+// checksumXattr is the extended attribute of the crc32c of the object file
+const checksumXattr = "user.tinygitfs." + checksumAlgr
+
+// tempSuffix is in the names of the temporary files of the objects being put
+const tempSuffix = ".tmp"
+
+func isTempFile(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.Contains(name, tempSuffix)
+}
+
+func (s *FileData) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	log.WithFields(log.Fields{
+		"key":   key,
+		"off":   off,
+		"limit": limit,
+	}).Debug("File Get")
+
+	f, err := os.Open(s.path(key))
+	if err != nil {
+		return nil, err
+	}
+	// the checksum is verified whenever the whole object is read
+	if off == 0 {
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if limit < 0 || limit >= info.Size() {
+			return verifyChecksum(f, fileChecksum(f)), nil
+		}
+	}
+	if _, err := f.Seek(off, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if limit < 0 {
+		return f, nil
+	}
+	return &limitedFile{io.LimitReader(f, limit), f}, nil
+}
+
+// fileChecksum return the crc32c of the object file, "" if it is unknown
+func fileChecksum(f *os.File) string {
+	buf := make([]byte, 16)
+	n, err := unix.Fgetxattr(int(f.Fd()), checksumXattr, buf)
+	if err != nil {
+		return ""
+	}
+	return string(buf[:n])
+}
+
+func (s *FileData) Put(key string, in io.Reader) error {
+	log.WithField("key", key).Debug("File Put")
+
+	p := s.path(key)
+	dir := filepath.Dir(p)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, "."+filepath.Base(p)+tempSuffix)
+	if err != nil {
+		return err
+	}
+	tempPath := f.Name()
+	if err := s.writeTemp(f, in); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	if err := os.Rename(tempPath, p); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	return syncDir(dir)
+}
+
+// writeTemp write in to the temporary file with its checksum and close it
+func (s *FileData) writeTemp(f *os.File, in io.Reader) error {
+	hash := crc32.New(crc32c)
+	if _, err := io.Copy(io.MultiWriter(f, hash), in); err != nil {
+		f.Close()
+		return err
+	}
+	checksum := strconv.Itoa(int(hash.Sum32()))
+	err := unix.Fsetxattr(int(f.Fd()), checksumXattr, []byte(checksum), 0)
+	if errors.Is(err, unix.ENOTSUP) {
+		log.WithField("file", f.Name()).Warn("extended attributes are not supported, store the object without checksum")
+	} else if err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// syncDir sync the directory, so the files renamed into it are durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (s *FileData) Head(key string) (Object, error) {
+	info, err := os.Stat(s.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &obj{key, info.Size(), info.ModTime(), info.IsDir()}, nil
+}
+
+func (s *FileData) Delete(key string) error {
+	log.WithField("key", key).Debug("File Delete")
+
+	err := os.Remove(s.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (s *FileData) List(prefix, marker string, limit int64) ([]Object, error) {
+	// only walk the directory which the keys with prefix are in
+	dir := ""
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		dir = prefix[:i+1]
+	}
+
+	var objs []Object
+	_, err := s.walk(dir, prefix, marker, limit, &objs)
+	if err != nil {
+		return nil, err
+	}
+	return objs, nil
+}
+
+// dirEntry is an entry of a directory with the key it is ordered by, which is
+// the key of the object, or the prefix of the keys in it for a directory
+type dirEntry struct {
+	fs.DirEntry
+	key string
+}
+
+// walk append the objects with prefix after marker in the directory of the
+// keys beginning with dir, which is empty or end with a slash, to objs in the
+// order of their keys, the directories whose keys are all before marker are
+// skipped, so a page is listed without walking the keys before it. It return
+// false once there are limit objects.
+func (s *FileData) walk(dir, prefix, marker string, limit int64, objs *[]Object) (bool, error) {
+	entries, err := os.ReadDir(s.path(dir))
+	if errors.Is(err, fs.ErrNotExist) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	sorted := make([]dirEntry, len(entries))
+	for i, entry := range entries {
+		sorted[i] = dirEntry{entry, dir + entry.Name()}
+		if entry.IsDir() {
+			sorted[i].key += "/"
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].key < sorted[j].key })
+
+	for _, entry := range sorted {
+		if limit >= 0 && int64(len(*objs)) >= limit {
+			return false, nil
+		}
+		if entry.IsDir() {
+			if !strings.HasPrefix(entry.key, prefix) && !strings.HasPrefix(prefix, entry.key) {
+				continue
+			}
+			if entry.key <= marker && !strings.HasPrefix(marker, entry.key) {
+				continue
+			}
+			more, err := s.walk(entry.key, prefix, marker, limit, objs)
+			if err != nil || !more {
+				return more, err
+			}
+			continue
+		}
+		if isTempFile(entry.Name()) || !strings.HasPrefix(entry.key, prefix) || entry.key <= marker {
+			continue
+		}
+		info, err := entry.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			// deleted since the directory is read
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		*objs = append(*objs, &obj{entry.key, info.Size(), info.ModTime(), false})
+	}
+	return true, nil
+}
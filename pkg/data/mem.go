@@ -0,0 +1,135 @@
+package data
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	// mem://<name>, the storages of the same name are shared in the process
+	Register("mem", func(uri *url.URL, option *Option) (ObjectStorage, error) {
+		return NewMemData(uri.Host), nil
+	})
+}
+
+var (
+	memStorages   = make(map[string]*MemData)
+	memStoragesMu sync.Mutex
+)
+
+type memObject struct {
+	data  []byte
+	mtime time.Time
+}
+
+// MemData is an object storage in memory, which is lost when the process exits
+type MemData struct {
+	name    string
+	mu      sync.RWMutex
+	objects map[string]*memObject
+}
+
+// NewMemData return the memory storage of name, a new one every time if name is empty
+func NewMemData(name string) *MemData {
+	if name == "" {
+		return &MemData{objects: make(map[string]*memObject)}
+	}
+
+	memStoragesMu.Lock()
+	defer memStoragesMu.Unlock()
+
+	s, ok := memStorages[name]
+	if !ok {
+		s = &MemData{name: name, objects: make(map[string]*memObject)}
+		memStorages[name] = s
+	}
+	return s
+}
+
+func (s *MemData) String() string {
+	return fmt.Sprintf("mem://%s/", s.name)
+}
+
+func (s *MemData) Init() error {
+	return nil
+}
+
+func (s *MemData) Get(key string, off, limit int64) (io.ReadCloser, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	o, ok := s.objects[key]
+	if !ok {
+		return nil, fmt.Errorf("object %s not found", key)
+	}
+	data := o.data
+	if off > int64(len(data)) {
+		off = int64(len(data))
+	}
+	data = data[off:]
+	if limit >= 0 && limit < int64(len(data)) {
+		data = data[:limit]
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s *MemData) Put(key string, in io.Reader) error {
+	data, err := io.ReadAll(in)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.objects[key] = &memObject{data: data, mtime: time.Now()}
+	return nil
+}
+
+func (s *MemData) Head(key string) (Object, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	o, ok := s.objects[key]
+	if !ok {
+		return nil, nil
+	}
+	return &obj{key, int64(len(o.data)), o.mtime, strings.HasSuffix(key, "/")}, nil
+}
+
+func (s *MemData) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.objects, key)
+	return nil
+}
+
+func (s *MemData) List(prefix, marker string, limit int64) ([]Object, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var keys []string
+	for key := range s.objects {
+		if strings.HasPrefix(key, prefix) && key > marker {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	if limit >= 0 && int64(len(keys)) > limit {
+		keys = keys[:limit]
+	}
+
+	objs := make([]Object, len(keys))
+	for i, key := range keys {
+		o := s.objects[key]
+		objs[i] = &obj{key, int64(len(o.data)), o.mtime, strings.HasSuffix(key, "/")}
+	}
+	return objs, nil
+}
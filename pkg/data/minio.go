@@ -7,11 +7,12 @@ import (
 	log "github.com/sirupsen/logrus"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"net/url"
 	"strings"
-	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
@@ -21,25 +22,6 @@ import (
 var UserAgent = "GitFS"
 var errNotSupported = errors.New("not supported")
 
-type Object interface {
-	Key() string
-	Size() int64
-	Mtime() time.Time
-	IsDir() bool
-}
-
-type obj struct {
-	key   string
-	size  int64
-	mtime time.Time
-	isDir bool
-}
-
-func (o *obj) Key() string      { return o.key }
-func (o *obj) Size() int64      { return o.size }
-func (o *obj) Mtime() time.Time { return o.mtime }
-func (o *obj) IsDir() bool      { return o.isDir }
-
 var disableSha256Func = func(r *request.Request) {
 
 	if op := r.Operation.Name; r.ClientInfo.ServiceID != "S3" || !(op == "PutObject" || op == "UploadPart") {
@@ -59,6 +41,17 @@ type MinioData struct {
 
 const awsDefaultRegion = "us-east-1"
 
+func init() {
+	// s3://<bucket> on the endpoint of the option
+	Register("s3", func(uri *url.URL, option *Option) (ObjectStorage, error) {
+		s3Option := *option
+		if uri.Host != "" {
+			s3Option.Bucket = uri.Host
+		}
+		return NewMinioData(&s3Option)
+	})
+}
+
 func NewMinioData(dataOption *Option) (*MinioData, error) {
 	uri, err := url.ParseRequestURI(dataOption.EndPoint)
 	if err != nil {
@@ -160,6 +153,23 @@ func (s *MinioData) Put(key string, in io.Reader) error {
 	return err
 }
 
+// Head return the object of key, nil if it does not exist
+func (s *MinioData) Head(key string) (Object, error) {
+	resp, err := s.s3.HeadObject(&s3.HeadObjectInput{Bucket: &s.bucket, Key: &key})
+	if err != nil {
+		if e, ok := err.(awserr.RequestFailure); ok && e.StatusCode() == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &obj{
+		key,
+		*resp.ContentLength,
+		*resp.LastModified,
+		strings.HasSuffix(key, "/"),
+	}, nil
+}
+
 func (s *MinioData) Delete(key string) error {
 	param := s3.DeleteObjectInput{
 		Bucket: &s.bucket,
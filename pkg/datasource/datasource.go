@@ -1,11 +1,14 @@
 package datasource
 
 import (
+	"github.com/adlternative/tinygitfs/pkg/compress"
 	"github.com/adlternative/tinygitfs/pkg/data"
 	"github.com/adlternative/tinygitfs/pkg/metadata"
 )
 
 type DataSource struct {
-	Meta *metadata.RedisMeta
-	Data *data.MinioData
+	Meta metadata.Meta
+	Data data.ObjectStorage
+	// Compressor compress the pages before they are stored, nil for no compression
+	Compressor compress.Compressor
 }
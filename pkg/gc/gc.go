@@ -0,0 +1,191 @@
+package gc
+
+import (
+	"context"
+	"time"
+
+	"github.com/adlternative/tinygitfs/pkg/datasource"
+	log "github.com/sirupsen/logrus"
+)
+
+// Prefixes are the prefixes of the keys of the objects stored for the chunks
+// of the files, "chunks/" for the pages and "objects/" for the loose objects
+var Prefixes = []string{"chunks/", "objects/"}
+
+// listBatch is how many objects are listed in a request
+const listBatch = 1000
+
+type Option struct {
+	// Grace is how long an object is kept after it is written even if no
+	// chunk refer to it, since the chunk is set after the object is stored
+	Grace time.Duration
+	// DryRun only report the orphaned objects without deleting them
+	DryRun bool
+}
+
+// Report is what a garbage collection found in the object storage
+type Report struct {
+	// Objects and Bytes are the number and the size of the objects scanned
+	Objects int64
+	Bytes   int64
+	// Live is the number of objects referred by the chunks of the files
+	Live int64
+	// Young is the number of objects written in the grace period, which are kept
+	Young int64
+	// Orphans and OrphanBytes are the number and the size of the objects
+	// no chunk refer to after the grace period
+	Orphans     int64
+	OrphanBytes int64
+	// Deleted and DeletedBytes are the number and the size of the orphans
+	// which are deleted, none in a dry run
+	Deleted      int64
+	DeletedBytes int64
+}
+
+// Collect delete the objects with Prefixes which are not referred by any
+// chunk and are older than option.Grace.
+//
+// The objects are listed before the live chunks are read, so an object
+// stored meanwhile is either not listed or referred. An orphan is fenced by
+// a tombstone in the metadata before it is deleted, which make the writers
+// storing the same object wait and store it again after it is deleted. A
+// writer reserve the object before uploading it, so an orphan overwritten in
+// place is not fenced, and a writer which found the object referred before it
+// was fenced and skipped the upload cannot refer it once the ref is gone.
+func Collect(ctx context.Context, source *datasource.DataSource, option *Option) (*Report, error) {
+	report := &Report{}
+	deadline := time.Now().Add(-option.Grace)
+
+	var candidates []string
+	for _, prefix := range Prefixes {
+		marker := ""
+		for {
+			objs, err := source.Data.List(prefix, marker, listBatch)
+			if err != nil {
+				return nil, err
+			}
+			for _, obj := range objs {
+				if obj.IsDir() {
+					continue
+				}
+				report.Objects++
+				report.Bytes += obj.Size()
+				if obj.Mtime().After(deadline) {
+					report.Young++
+					continue
+				}
+				candidates = append(candidates, obj.Key())
+			}
+			if int64(len(objs)) < listBatch {
+				break
+			}
+			marker = objs[len(objs)-1].Key()
+		}
+	}
+
+	live, err := source.Meta.LiveStoragePaths(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range candidates {
+		if _, ok := live[key]; ok {
+			report.Live++
+			continue
+		}
+		if err := collectObject(ctx, source, option, deadline, key, report); err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+// collectObject delete the object at key if no chunk refer to it and it is
+// not written again after deadline, between the tombstone of it is set and cleared
+func collectObject(ctx context.Context, source *datasource.DataSource, option *Option, deadline time.Time, key string, report *Report) (err error) {
+	if option.DryRun {
+		_, ok, err := source.Meta.GetChunkRef(ctx, key)
+		if err != nil {
+			return err
+		}
+		if ok {
+			report.Live++
+			return nil
+		}
+	} else {
+		var fenced bool
+		fenced, err = source.Meta.FenceChunkRef(ctx, key)
+		if err != nil {
+			return err
+		}
+		if !fenced {
+			// referred by a new chunk, or fenced by another gc
+			report.Live++
+			return nil
+		}
+		// the writers wait for the tombstone, which is cleared even if gc is interrupted
+		defer func() {
+			if unfenceErr := source.Meta.UnfenceChunkRef(context.Background(), key); err == nil {
+				err = unfenceErr
+			}
+		}()
+	}
+
+	obj, err := source.Data.Head(key)
+	if err != nil {
+		return err
+	}
+	if obj == nil {
+		return nil
+	}
+	if obj.Mtime().After(deadline) {
+		report.Young++
+		return nil
+	}
+
+	report.Orphans++
+	report.OrphanBytes += obj.Size()
+	log.WithFields(log.Fields{
+		"key":    key,
+		"size":   obj.Size(),
+		"mtime":  obj.Mtime(),
+		"dryRun": option.DryRun,
+	}).Debug("orphaned object")
+	if option.DryRun {
+		return nil
+	}
+	if err := source.Data.Delete(key); err != nil {
+		return err
+	}
+	report.Deleted++
+	report.DeletedBytes += obj.Size()
+	return nil
+}
+
+// Background run Collect every interval until ctx is done
+func Background(ctx context.Context, source *datasource.DataSource, option *Option, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		report, err := Collect(ctx, source, option)
+		if err != nil {
+			log.WithError(err).Error("gc failed")
+			continue
+		}
+		log.WithFields(log.Fields{
+			"objects":      report.Objects,
+			"live":         report.Live,
+			"young":        report.Young,
+			"orphans":      report.Orphans,
+			"deleted":      report.Deleted,
+			"deletedBytes": report.DeletedBytes,
+		}).Info("gc done")
+	}
+}
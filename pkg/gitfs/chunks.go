@@ -0,0 +1,101 @@
+package gitfs
+
+import (
+	"context"
+	"github.com/adlternative/tinygitfs/pkg/datasource"
+	"github.com/adlternative/tinygitfs/pkg/metadata"
+	"github.com/adlternative/tinygitfs/pkg/page"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"syscall"
+)
+
+// readChunks read the content of the file inode of length at off into dest
+// by its chunks, and return how many bytes are read. The chunks may be pages
+// or parts of a larger object, which is how the files stored in the metadata
+// by their backends now were stored by the page pool before.
+func readChunks(ctx context.Context, source *datasource.DataSource, inode metadata.Ino, dest []byte, off int64, length int64) (int, syscall.Errno) {
+	if off >= length {
+		return 0, syscall.F_OK
+	}
+	if int64(len(dest)) > length-off {
+		dest = dest[:length-off]
+	}
+
+	for n := 0; n < len(dest); {
+		pos := off + int64(n)
+		pageNum := pos / page.PageSize
+		part := dest[n:]
+		if pageEnd := (pageNum + 1) * page.PageSize; int64(len(part)) > pageEnd-pos {
+			part = part[:pageEnd-pos]
+		}
+		n += len(part)
+
+		chunkAttr, ok, err := source.Meta.GetChunkMeta(ctx, inode, pageNum)
+		if err != nil {
+			return 0, syscall.EIO
+		}
+		var stored []byte
+		if ok && pos < chunkAttr.Offset+int64(chunkAttr.Length) {
+			stored = part
+			if end := chunkAttr.Offset + int64(chunkAttr.Length); int64(len(stored)) > end-pos {
+				stored = stored[:end-pos]
+			}
+		}
+		// hole
+		for i := len(stored); i < len(part); i++ {
+			part[i] = 0
+		}
+		if len(stored) == 0 {
+			continue
+		}
+
+		if chunkAttr.Compression != "" {
+			// the file was written to pages before it is renamed here
+			content := make([]byte, page.PageSize)
+			decompressed, err := page.DecompressChunk(source.Data, chunkAttr, content)
+			start := pos - chunkAttr.Offset
+			if err != nil || int64(decompressed) < start+int64(len(stored)) {
+				log.WithFields(log.Fields{
+					"inode":       inode,
+					"storagePath": chunkAttr.StoragePath,
+				}).WithError(err).Error("decompress chunk failed")
+				return 0, syscall.EIO
+			}
+			copy(stored, content[start:])
+			continue
+		}
+		reader, err := source.Data.Get(chunkAttr.StoragePath, chunkAttr.ObjectOffset+pos-chunkAttr.Offset, int64(len(stored)))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"inode":       inode,
+				"storagePath": chunkAttr.StoragePath,
+			}).WithError(err).Error("get chunk failed")
+			return 0, syscall.EIO
+		}
+		_, err = io.ReadFull(reader, stored)
+		reader.Close()
+		if err != nil {
+			return 0, syscall.EIO
+		}
+	}
+	return len(dest), syscall.F_OK
+}
+
+// readLegacyContent return the content of the file inode of length in its
+// chunks, which were written by the page pool before the file is routed to a
+// backend storing it in the metadata, e.g. packed-refs and the reflogs
+func readLegacyContent(ctx context.Context, source *datasource.DataSource, inode metadata.Ino, length uint64) ([]byte, syscall.Errno) {
+	content := make([]byte, length)
+	n, eno := readChunks(ctx, source, inode, content, 0, int64(length))
+	if eno != syscall.F_OK {
+		return nil, eno
+	}
+	return content[:n], syscall.F_OK
+}
+
+// dropLegacyContent remove the chunks of the file inode once its content is
+// stored in the metadata, see readLegacyContent
+func dropLegacyContent(ctx context.Context, source *datasource.DataSource, inode metadata.Ino) error {
+	return source.Meta.TruncateChunkMeta(ctx, inode, 0, 0)
+}
@@ -0,0 +1,85 @@
+package gitfs
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/adlternative/tinygitfs/pkg/metadata"
+)
+
+// FileBackend is where the content of a file is stored,
+// which is named by its storage class in the routes
+type FileBackend uint8
+
+const (
+	// PageBackend store the file in chunks by the page pool
+	PageBackend FileBackend = iota
+	// RefBackend store the file as a ref in the metadata
+	RefBackend
+	// SymRefBackend store the file as a symbolic ref in the metadata
+	SymRefBackend
+	// LocalBackend store the file in the local directory of the mount,
+	// which is not shared with other mounts
+	LocalBackend
+	// PackedRefsBackend store the file as the ref records of packed-refs in the metadata
+	PackedRefsBackend
+	// ReflogBackend store the file as a list of reflog entries in the metadata
+	ReflogBackend
+	// LooseObjectBackend store the file in the object storage by its oid,
+	// which is shared by all the repositories of the volume
+	LooseObjectBackend
+)
+
+func (backend FileBackend) String() string {
+	switch backend {
+	case PageBackend:
+		return "object"
+	case RefBackend:
+		return "kv"
+	case SymRefBackend:
+		return "symref"
+	case LocalBackend:
+		return "local"
+	case PackedRefsBackend:
+		return "packed-refs"
+	case ReflogBackend:
+		return "reflog"
+	case LooseObjectBackend:
+		return "loose"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseFileBackend return the backend of the storage class
+func ParseFileBackend(class string) (FileBackend, error) {
+	for _, backend := range []FileBackend{PageBackend, RefBackend, SymRefBackend, LocalBackend, PackedRefsBackend, ReflogBackend, LooseObjectBackend} {
+		if backend.String() == class {
+			return backend, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown storage class %q", class)
+}
+
+// PathClassifier choose the backend of the files in .git directories,
+// files out of .git directories are always stored by the page pool.
+type PathClassifier interface {
+	// Classify return the backend of the file with gitPath,
+	// which is the slash-separated path relative to the .git directory
+	Classify(gitPath string) FileBackend
+}
+
+// gitDirName is the name of the directories which hold the git repositories
+const gitDirName = ".git"
+
+// childGitPath return the path of name in the directory relative to the
+// .git directory, "." for a .git directory and "" if it is not in any.
+func childGitPath(dirGitPath string, name string, _type uint8) string {
+	if dirGitPath != "" {
+		return path.Join(dirGitPath, name)
+	}
+	if name == gitDirName && _type == metadata.TypeDirectory {
+		return "."
+	}
+	return ""
+}
@@ -10,7 +10,9 @@ type FileHandler interface {
 }
 
 type File interface {
-	NewFileHandler() FileHandler
+	// NewFileHandler take a reference of the file for a handler opened from
+	// node with the flags of open(2)
+	NewFileHandler(node *Node, flags uint32) FileHandler
 	UnRef(release func()) error
 	Ref() int
 	Release(ctx context.Context) error
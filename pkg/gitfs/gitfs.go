@@ -3,14 +3,17 @@ package gitfs
 import (
 	"context"
 	"fmt"
+	"github.com/adlternative/tinygitfs/pkg/compress"
 	"github.com/adlternative/tinygitfs/pkg/data"
 	"github.com/adlternative/tinygitfs/pkg/datasource"
 	"github.com/adlternative/tinygitfs/pkg/metadata"
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
+	log "github.com/sirupsen/logrus"
 	"os"
 	"runtime"
 	"sync"
+	"time"
 )
 
 type GitFs struct {
@@ -18,60 +21,72 @@ type GitFs struct {
 	files   map[metadata.Ino]File
 	filesMu *sync.Mutex
 
-	DefaultDataSource *datasource.DataSource
-}
+	// sid is the session which owns the locks of this mount
+	sid       uint64
+	closed    chan struct{}
+	closeOnce sync.Once
 
-func (gitFs *GitFs) OpenSymRefFile(ctx context.Context, inode metadata.Ino) (FileHandler, error) {
-	var err error
+	// Classifier choose the backend of the files in .git directories
+	Classifier PathClassifier
+	// localDir is where the files of LocalBackend are stored
+	localDir string
+	// objectFormats cache the object format of the repositories by the inode of their .git directory
+	objectFormats sync.Map
+	// cacheTimeout is how long the kernel cache the entries and the attributes
+	// of the files outside .git directories, see Option.CacheTimeout
+	cacheTimeout time.Duration
 
-	gitFs.filesMu.Lock()
-	defer gitFs.filesMu.Unlock()
+	DefaultDataSource *datasource.DataSource
+}
 
-	file, ok := gitFs.files[inode]
-	if !ok {
-		file, err = NewSymRefFile(ctx, inode, gitFs.DefaultDataSource, gitFs)
-		if err != nil {
-			return nil, err
-		}
-		gitFs.files[inode] = file
+// backend return the backend of a file of _type at gitPath, see childGitPath,
+// the files in .git directories are classified by Classifier
+func (gitFs *GitFs) backend(gitPath string, _type uint8) FileBackend {
+	if gitPath == "" || _type != metadata.TypeFile {
+		return PageBackend
 	}
-	return file.NewFileHandler(), nil
+	return gitFs.Classifier.Classify(gitPath)
 }
 
-func (gitFs *GitFs) OpenRefFile(ctx context.Context, inode metadata.Ino) (FileHandler, error) {
-	var err error
+// newFiles create the file of an inode by the backend of its node
+var newFiles = map[FileBackend]func(ctx context.Context, inode metadata.Ino, dataSource *datasource.DataSource, gitFs *GitFs) (File, error){
+	PageBackend:        NewRegularFile,
+	RefBackend:         NewRefFile,
+	SymRefBackend:      NewSymRefFile,
+	LocalBackend:       NewLocalFile,
+	PackedRefsBackend:  NewPackedRefsFile,
+	ReflogBackend:      NewReflogFile,
+	LooseObjectBackend: NewLooseObjectFile,
+}
 
+// openFile open the file of the node by its backend with the flags of open(2),
+// the file is shared by the handlers of the inode until the last one is released
+func (gitFs *GitFs) openFile(ctx context.Context, node *Node, flags uint32) (FileHandler, error) {
 	gitFs.filesMu.Lock()
 	defer gitFs.filesMu.Unlock()
 
-	file, ok := gitFs.files[inode]
+	file, ok := gitFs.files[node.inode]
 	if !ok {
-		file, err = NewRefFile(ctx, inode, gitFs.DefaultDataSource, gitFs)
-		if err != nil {
+		newFile, ok := newFiles[node.backend]
+		if !ok {
+			return nil, fmt.Errorf("no file for backend %s", node.backend)
+		}
+		if err := gitFs.DefaultDataSource.Meta.OpenFile(ctx, gitFs.sid, node.inode); err != nil {
 			return nil, err
 		}
-		gitFs.files[inode] = file
-	}
-	return file.NewFileHandler(), nil
-}
-
-func (gitFs *GitFs) OpenFile(ctx context.Context, inode metadata.Ino) (FileHandler, error) {
-	var err error
-
-	gitFs.filesMu.Lock()
-	defer gitFs.filesMu.Unlock()
-
-	file, ok := gitFs.files[inode]
-	if !ok {
-		file, err = NewRegularFile(ctx, inode, gitFs.DefaultDataSource, gitFs)
+		var err error
+		file, err = newFile(ctx, node.inode, gitFs.DefaultDataSource, gitFs)
 		if err != nil {
+			_ = gitFs.DefaultDataSource.Meta.CloseFile(ctx, gitFs.sid, node.inode)
 			return nil, err
 		}
-		gitFs.files[inode] = file
+		gitFs.files[node.inode] = file
 	}
-	return file.NewFileHandler(), nil
+	return file.NewFileHandler(node, flags), nil
 }
 
+// ReleaseFile drop a reference of the file, which is closed when the last
+// reference is dropped, and removed then if it was unlinked while it was open
 func (gitFs *GitFs) ReleaseFile(ctx context.Context, inode metadata.Ino) error {
 	gitFs.filesMu.Lock()
 	defer gitFs.filesMu.Unlock()
@@ -80,34 +95,92 @@ func (gitFs *GitFs) ReleaseFile(ctx context.Context, inode metadata.Ino) error {
 	if !ok {
 		return fmt.Errorf("cannot find the file want to release: %d", inode)
 	}
-	return file.UnRef(func() {
+	closed := false
+	err := file.UnRef(func() {
 		delete(gitFs.files, inode)
+		closed = true
 	})
+	if err != nil || !closed {
+		return err
+	}
+	return gitFs.DefaultDataSource.Meta.CloseFile(ctx, gitFs.sid, inode)
+}
+
+// Option is the options of where gitfs store the files in .git directories
+type Option struct {
+	// Routes are the routes in the form "pattern=class", see ParseRoute,
+	// which are tried before DefaultRoutes. They are stored in the metadata
+	// by the first mount of the volume, which the later mounts use, and they
+	// must be the same if they are given again, see LoadRouteTable. The files
+	// routed to local are private to the mount.
+	Routes []string
+	// LocalDir is the directory to store the files routed to local
+	LocalDir string
+	// Compress is the algorithm to compress the pages of the files with,
+	// none, zstd or lz4, the chunks record their own algorithm, so it can be
+	// changed between mounts of the volume
+	Compress string
+	// CacheTimeout is how long the kernel cache the entries and the attributes
+	// of the files outside .git directories, so that the entries listed by
+	// READDIRPLUS are not looked up again by stat. The changes of the other
+	// mounts may not be seen in the meantime, so it is 0 by default.
+	CacheTimeout time.Duration
 }
 
-func NewGitFs(ctx context.Context, metaDataUrl string, dataOption *data.Option) (*GitFs, error) {
-	Meta, err := metadata.NewRedisMeta(metaDataUrl)
+func NewGitFs(ctx context.Context, metaDataUrl string, dataOption *data.Option, option *Option) (*GitFs, error) {
+	if option == nil {
+		option = &Option{}
+	}
+	if _, err := NewRouteTable(option.Routes); err != nil {
+		return nil, err
+	}
+	compressor, err := compress.NewCompressor(option.Compress)
 	if err != nil {
-		return nil, fmt.Errorf("NewRedisMeta failed with %w", err)
+		return nil, err
+	}
+
+	Meta, err := metadata.NewMeta(metaDataUrl)
+	if err != nil {
+		return nil, fmt.Errorf("NewMeta failed with %w", err)
 	}
 	err = Meta.Init(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("meta init failed with %w", err)
 	}
+	routes, err := LoadRouteTable(ctx, Meta, option.Routes)
+	if err != nil {
+		return nil, err
+	}
+	if routes.uses(LocalBackend) {
+		if option.LocalDir == "" {
+			return nil, fmt.Errorf("routes to local need a local directory")
+		}
+		if err := os.MkdirAll(option.LocalDir, 0700); err != nil {
+			return nil, fmt.Errorf("create local directory failed with %w", err)
+		}
+	}
 
-	minioData, err := data.NewMinioData(dataOption)
+	sid, err := Meta.NewSession(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("NewMinioData failed with %w", err)
+		return nil, fmt.Errorf("NewSession failed with %w", err)
 	}
-	err = minioData.Init()
+	err = Meta.CleanStaleSessions(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("minioData init failed with %w", err)
+		return nil, fmt.Errorf("CleanStaleSessions failed with %w", err)
+	}
+
+	objectStorage, err := data.NewObjectStorage(dataOption)
+	if err != nil {
+		return nil, fmt.Errorf("NewObjectStorage failed with %w", err)
+	}
+	err = objectStorage.Init()
+	if err != nil {
+		return nil, fmt.Errorf("object storage init failed with %w", err)
 	}
 
 	root := &Node{
-		nodeType: "Node",
-		inode:    1,
-		name:     "",
+		inode: 1,
+		name:  "",
 	}
 
 	gitfs := &GitFs{
@@ -115,19 +188,26 @@ func NewGitFs(ctx context.Context, metaDataUrl string, dataOption *data.Option)
 		filesMu: &sync.Mutex{},
 		Node:    root,
 		DefaultDataSource: &datasource.DataSource{
-			Meta: Meta,
-			Data: minioData,
+			Meta:       Meta,
+			Data:       objectStorage,
+			Compressor: compressor,
 		},
+		Classifier:   routes,
+		localDir:     option.LocalDir,
+		cacheTimeout: option.CacheTimeout,
+		sid:          sid,
+		closed:       make(chan struct{}),
 	}
 	root.gitfs = gitfs
+	go gitfs.heartbeat(ctx)
 
 	return gitfs, nil
 }
 
-func Mount(ctx context.Context, mntDir string, debug bool, metaDataUrl string, dataOption *data.Option) (*fuse.Server, error) {
+func Mount(ctx context.Context, mntDir string, debug bool, metaDataUrl string, dataOption *data.Option, option *Option) (*fuse.Server, error) {
 	var err error
 
-	gitfs, err := NewGitFs(ctx, metaDataUrl, dataOption)
+	gitfs, err := NewGitFs(ctx, metaDataUrl, dataOption, option)
 	if err != nil {
 		return nil, fmt.Errorf("NewGitFs failed with %w", err)
 	}
@@ -138,8 +218,8 @@ func Mount(ctx context.Context, mntDir string, debug bool, metaDataUrl string, d
 		SingleThreaded:       false,
 		MaxBackground:        50,
 		EnableLocks:          true,
-		DisableXAttrs:        true,
-		IgnoreSecurityLabels: true,
+		DisableXAttrs:        false,
+		IgnoreSecurityLabels: false,
 		MaxWrite:             1 << 20,
 		MaxReadAhead:         1 << 20,
 		DirectMount:          true,
@@ -157,16 +237,27 @@ func Mount(ctx context.Context, mntDir string, debug bool, metaDataUrl string, d
 		opts.Options = append(opts.Options, "daemon_timeout=60", "iosize=65536", "novncache")
 	}
 
-	server, err := fs.Mount(mntDir, gitfs, &fs.Options{
+	rawFS := fs.NewNodeFS(gitfs, &fs.Options{
 		MountOptions: opts,
 		RootStableAttr: &fs.StableAttr{
 			Ino: uint64(gitfs.inode),
 			Gen: 1,
 		},
 	})
+	server, err := fuse.NewServer(newLockReleaser(rawFS), mntDir, &opts)
 	if err != nil {
 		return nil, err
 	}
 
+	go func() {
+		server.Serve()
+		if err := gitfs.Close(context.Background()); err != nil {
+			log.WithError(err).Error("close gitfs failed")
+		}
+	}()
+	if err := server.WaitMount(); err != nil {
+		return nil, err
+	}
+
 	return server, nil
 }
@@ -0,0 +1,276 @@
+package gitfs
+
+import (
+	"context"
+	"fmt"
+	"github.com/adlternative/tinygitfs/pkg/datasource"
+	"github.com/adlternative/tinygitfs/pkg/metadata"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// LocalFile is a file whose content is stored in the local directory of the
+// mount by its inode number, only the attributes are kept in the metadata.
+type LocalFile struct {
+	inode metadata.Ino
+	*datasource.DataSource
+	gitfs       *GitFs
+	mu          *sync.Mutex
+	ref         int
+	releaseOnce *sync.Once
+
+	file  *os.File
+	clean bool
+}
+
+type LocalFileHandler struct {
+	file *LocalFile
+}
+
+func NewLocalFile(ctx context.Context, inode metadata.Ino, dataSource *datasource.DataSource, gitFs *GitFs) (File, error) {
+	if gitFs.localDir == "" {
+		return nil, fmt.Errorf("no local directory to store inode %d", inode)
+	}
+	file, err := os.OpenFile(filepath.Join(gitFs.localDir, strconv.FormatUint(uint64(inode), 10)), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LocalFile{
+		inode:       inode,
+		DataSource:  dataSource,
+		gitfs:       gitFs,
+		mu:          &sync.Mutex{},
+		releaseOnce: &sync.Once{},
+		file:        file,
+		clean:       true,
+	}, nil
+}
+
+func (file *LocalFile) NewFileHandler(node *Node, flags uint32) FileHandler {
+	file.mu.Lock()
+	defer file.mu.Unlock()
+
+	file.ref++
+
+	return &LocalFileHandler{
+		file: file,
+	}
+}
+
+func (file *LocalFile) UnRef(release func()) error {
+	file.mu.Lock()
+	defer file.mu.Unlock()
+
+	file.ref--
+	if file.ref < 0 {
+		log.Errorf("file ref down to negative value: %d", file.ref)
+		return fmt.Errorf("file ref down to negative value: %d", file.ref)
+	} else if file.ref == 0 {
+		file.releaseOnce.Do(func() {
+			release()
+			if err := file.file.Close(); err != nil {
+				log.WithField("inode", file.inode).WithError(err).Error("close local file failed")
+			}
+		})
+	}
+	return nil
+}
+
+func (file *LocalFile) Ref() int {
+	file.mu.Lock()
+	defer file.mu.Unlock()
+
+	return file.ref
+}
+
+func (file *LocalFile) Release(ctx context.Context) error {
+	return file.gitfs.ReleaseFile(ctx, file.inode)
+}
+
+// sync write the size and modify time of the local file to the metadata
+func (file *LocalFile) sync(ctx context.Context) syscall.Errno {
+	if file.clean {
+		return syscall.F_OK
+	}
+	if err := file.file.Sync(); err != nil {
+		return syscall.EIO
+	}
+	info, err := file.file.Stat()
+	if err != nil {
+		return syscall.EIO
+	}
+
+	attr, eno := file.Meta.Getattr(ctx, file.inode)
+	if eno != syscall.F_OK {
+		return eno
+	}
+	attr.Length = uint64(info.Size())
+	metadata.SetTime(&attr.Mtime, &attr.Mtimensec, info.ModTime())
+	if err := file.Meta.SetattrDirectly(ctx, file.inode, attr); err != nil {
+		return syscall.EIO
+	}
+	file.clean = true
+	return syscall.F_OK
+}
+
+var _ = (fs.FileHandle)((*LocalFileHandler)(nil))
+var _ = (fs.FileWriter)((*LocalFileHandler)(nil))
+var _ = (fs.FileReader)((*LocalFileHandler)(nil))
+var _ = (fs.FileFlusher)((*LocalFileHandler)(nil))
+var _ = (fs.FileFsyncer)((*LocalFileHandler)(nil))
+var _ = (fs.FileReleaser)((*LocalFileHandler)(nil))
+var _ = (fs.FileGetattrer)((*LocalFileHandler)(nil))
+var _ = (fs.FileSetattrer)((*LocalFileHandler)(nil))
+
+// Write will write the dest data to file begin at offset
+func (fh *LocalFileHandler) Write(ctx context.Context, data []byte, off int64) (written uint32, errno syscall.Errno) {
+	log.WithFields(
+		log.Fields{
+			"length": len(data),
+			"offset": off,
+			"inode":  fh.file.inode,
+		}).Debug("Write")
+
+	fh.file.mu.Lock()
+	defer fh.file.mu.Unlock()
+
+	n, err := fh.file.file.WriteAt(data, off)
+	fh.file.clean = false
+	if err != nil {
+		log.WithError(err).Errorf("local file write failed")
+		return uint32(n), syscall.EIO
+	}
+	return uint32(n), syscall.F_OK
+}
+
+// Read will read the file data begin at offset to dest, read size no large then dest length
+func (fh *LocalFileHandler) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	log.WithFields(
+		log.Fields{
+			"dest length": len(dest),
+			"offset":      off,
+			"inode":       fh.file.inode,
+		}).Debug("Read")
+
+	fh.file.mu.Lock()
+	defer fh.file.mu.Unlock()
+
+	n, err := fh.file.file.ReadAt(dest, off)
+	if err != nil && err != io.EOF {
+		log.WithError(err).Errorf("local file read failed")
+		return nil, syscall.EIO
+	}
+	return fuse.ReadResultData(dest[:n]), syscall.F_OK
+}
+
+// Fsync sync the local file and its size to the metadata.
+func (fh *LocalFileHandler) Fsync(ctx context.Context, flags uint32) syscall.Errno {
+	log.WithFields(
+		log.Fields{
+			"flags": flags,
+			"inode": fh.file.inode,
+		}).Debug("Fsync")
+
+	fh.file.mu.Lock()
+	defer fh.file.mu.Unlock()
+
+	return fh.file.sync(ctx)
+}
+
+// Flush will be called when file closed. (maybe called many times)
+// We just do fsync here...
+func (fh *LocalFileHandler) Flush(ctx context.Context) syscall.Errno {
+	log.WithFields(
+		log.Fields{
+			"inode": fh.file.inode,
+		}).Debug("Flush")
+
+	fh.file.mu.Lock()
+	defer fh.file.mu.Unlock()
+
+	return fh.file.sync(ctx)
+}
+
+// Release file handler release
+func (fh *LocalFileHandler) Release(ctx context.Context) syscall.Errno {
+	log.WithFields(
+		log.Fields{
+			"inode": fh.file.inode,
+		}).Debug("Release")
+
+	err := fh.file.Release(ctx)
+	if err != nil {
+		return syscall.ENOENT
+	}
+
+	return syscall.F_OK
+}
+
+// Setattr set the attr to the metadata, and truncate the local file if the size is set
+func (fh *LocalFileHandler) Setattr(ctx context.Context, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	fh.file.mu.Lock()
+	defer fh.file.mu.Unlock()
+
+	if eno := fh.file.sync(ctx); eno != syscall.F_OK {
+		return eno
+	}
+	attr, eno := fh.file.Meta.Getattr(ctx, fh.file.inode)
+	if eno != syscall.F_OK {
+		return eno
+	}
+	if atime, ok := in.GetATime(); ok {
+		metadata.SetTime(&attr.Atime, &attr.Atimensec, atime)
+	}
+	if ctime, ok := in.GetCTime(); ok {
+		metadata.SetTime(&attr.Ctime, &attr.Ctimensec, ctime)
+	}
+	if uid, ok := in.GetUID(); ok {
+		attr.Uid = uid
+	}
+	if gid, ok := in.GetGID(); ok {
+		attr.Gid = gid
+	}
+	if mode, ok := in.GetMode(); ok {
+		attr.Mode = uint16(mode)
+	}
+	if size, ok := in.GetSize(); ok {
+		if err := fh.file.file.Truncate(int64(size)); err != nil {
+			return syscall.EIO
+		}
+		attr.Length = size
+		metadata.SetTime(&attr.Mtime, &attr.Mtimensec, time.Now())
+	}
+	err := fh.file.Meta.SetattrDirectly(ctx, fh.file.inode, attr)
+	if err != nil {
+		return syscall.EIO
+	}
+	metadata.ToAttrOut(fh.file.inode, attr, &out.Attr)
+	return syscall.F_OK
+}
+
+// Getattr get the attr from the metadata with the size of the local file
+func (fh *LocalFileHandler) Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno {
+	fh.file.mu.Lock()
+	defer fh.file.mu.Unlock()
+
+	attr, eno := fh.file.Meta.Getattr(ctx, fh.file.inode)
+	if eno != 0 {
+		return eno
+	}
+	info, err := fh.file.file.Stat()
+	if err != nil {
+		return syscall.EIO
+	}
+	attr.Length = uint64(info.Size())
+	metadata.ToAttrOut(fh.file.inode, attr, &out.Attr)
+	return syscall.F_OK
+}
@@ -0,0 +1,203 @@
+package gitfs
+
+import (
+	"context"
+	"math"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/adlternative/tinygitfs/pkg/metadata"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	log "github.com/sirupsen/logrus"
+)
+
+var _ = (fs.NodeGetlker)((*Node)(nil))
+var _ = (fs.NodeSetlker)((*Node)(nil))
+var _ = (fs.NodeSetlkwer)((*Node)(nil))
+
+const (
+	lockRetryMin = 10 * time.Millisecond
+	lockRetryMax = time.Second
+)
+
+func (node *Node) Getlk(ctx context.Context, f fs.FileHandle, owner uint64, lk *fuse.FileLock, flags uint32, out *fuse.FileLock) syscall.Errno {
+	log.WithFields(
+		log.Fields{
+			"inode": node.inode,
+			"owner": owner,
+			"type":  lk.Typ,
+			"start": lk.Start,
+			"end":   lk.End,
+		}).Trace("Getlk")
+
+	return node.gitfs.DefaultDataSource.Meta.Getlk(ctx, node.inode, node.gitfs.sid, owner, lk, out)
+}
+
+// Setlk acquire or release a posix lock or a flock, EAGAIN if it conflict with the locks of other owners
+func (node *Node) Setlk(ctx context.Context, f fs.FileHandle, owner uint64, lk *fuse.FileLock, flags uint32) syscall.Errno {
+	log.WithFields(
+		log.Fields{
+			"inode": node.inode,
+			"owner": owner,
+			"type":  lk.Typ,
+			"start": lk.Start,
+			"end":   lk.End,
+			"flags": flags,
+		}).Debug("Setlk")
+
+	meta := node.gitfs.DefaultDataSource.Meta
+	if flags&fuse.FUSE_LK_FLOCK != 0 {
+		return meta.Flock(ctx, node.inode, node.gitfs.sid, owner, lk.Typ)
+	}
+	return meta.Setlk(ctx, node.inode, node.gitfs.sid, owner, lk)
+}
+
+// Setlkw is Setlk which wait until the lock is acquired or the request is interrupted
+func (node *Node) Setlkw(ctx context.Context, f fs.FileHandle, owner uint64, lk *fuse.FileLock, flags uint32) syscall.Errno {
+	retry := lockRetryMin
+	for {
+		eno := node.Setlk(ctx, f, owner, lk, flags)
+		if eno != syscall.EAGAIN {
+			return eno
+		}
+
+		select {
+		case <-ctx.Done():
+			return syscall.EINTR
+		case <-time.After(retry):
+		}
+		if retry *= 2; retry > lockRetryMax {
+			retry = lockRetryMax
+		}
+	}
+}
+
+// heartbeat keep the session of gitFs alive and reclaim the locks of the expired sessions
+func (gitFs *GitFs) heartbeat(ctx context.Context) {
+	ticker := time.NewTicker(metadata.SessionTTL / 3)
+	defer ticker.Stop()
+
+	meta := gitFs.DefaultDataSource.Meta
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-gitFs.closed:
+			return
+		case <-ticker.C:
+		}
+
+		if err := meta.RefreshSession(ctx, gitFs.sid); err != nil {
+			log.WithField("session", gitFs.sid).WithError(err).Error("refresh session failed")
+		}
+		if err := meta.CleanStaleSessions(ctx); err != nil {
+			log.WithError(err).Error("clean stale sessions failed")
+		}
+	}
+}
+
+// Close release all the locks of gitFs and stop its session
+func (gitFs *GitFs) Close(ctx context.Context) error {
+	gitFs.closeOnce.Do(func() {
+		close(gitFs.closed)
+	})
+	return gitFs.DefaultDataSource.Meta.CloseSession(ctx, gitFs.sid)
+}
+
+type lockKey struct {
+	nodeId uint64
+	owner  uint64
+}
+
+// lockReleaser release the locks when their files are closed. go-fuse does not
+// pass the lock owner of FLUSH and RELEASE to the nodes, so it is done here by
+// unlocking through SetLk before passing the requests to the file system.
+type lockReleaser struct {
+	fuse.RawFileSystem
+
+	mu     sync.Mutex
+	plocks map[lockKey]struct{}
+}
+
+func newLockReleaser(rawFS fuse.RawFileSystem) *lockReleaser {
+	return &lockReleaser{
+		RawFileSystem: rawFS,
+		plocks:        make(map[lockKey]struct{}),
+	}
+}
+
+func (r *lockReleaser) record(input *fuse.LkIn, status fuse.Status) {
+	if status != fuse.OK || input.LkFlags&fuse.FUSE_LK_FLOCK != 0 || input.Lk.Typ == syscall.F_UNLCK {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.plocks[lockKey{input.NodeId, input.Owner}] = struct{}{}
+}
+
+func (r *lockReleaser) SetLk(cancel <-chan struct{}, input *fuse.LkIn) fuse.Status {
+	status := r.RawFileSystem.SetLk(cancel, input)
+	r.record(input, status)
+	return status
+}
+
+func (r *lockReleaser) SetLkw(cancel <-chan struct{}, input *fuse.LkIn) fuse.Status {
+	status := r.RawFileSystem.SetLkw(cancel, input)
+	r.record(input, status)
+	return status
+}
+
+// Flush release the posix locks of the lock owner, which close any fd of the file
+func (r *lockReleaser) Flush(cancel <-chan struct{}, input *fuse.FlushIn) fuse.Status {
+	key := lockKey{input.NodeId, input.LockOwner}
+	r.mu.Lock()
+	_, ok := r.plocks[key]
+	delete(r.plocks, key)
+	r.mu.Unlock()
+
+	if ok {
+		status := r.RawFileSystem.SetLk(cancel, &fuse.LkIn{
+			InHeader: input.InHeader,
+			Fh:       input.Fh,
+			Owner:    input.LockOwner,
+			Lk: fuse.FileLock{
+				Start: 0,
+				End:   math.MaxUint64,
+				Typ:   syscall.F_UNLCK,
+			},
+		})
+		if status != fuse.OK {
+			log.WithFields(
+				log.Fields{
+					"node id": input.NodeId,
+					"owner":   input.LockOwner,
+				}).Errorf("release posix locks failed: %v", status)
+		}
+	}
+	return r.RawFileSystem.Flush(cancel, input)
+}
+
+// Release release the flock of the file which is released at last
+func (r *lockReleaser) Release(cancel <-chan struct{}, input *fuse.ReleaseIn) {
+	if input.ReleaseFlags&fuse.FUSE_RELEASE_FLOCK_UNLOCK != 0 {
+		status := r.RawFileSystem.SetLk(cancel, &fuse.LkIn{
+			InHeader: input.InHeader,
+			Fh:       input.Fh,
+			Owner:    input.LockOwner,
+			Lk: fuse.FileLock{
+				Typ: syscall.F_UNLCK,
+			},
+			LkFlags: fuse.FUSE_LK_FLOCK,
+		})
+		if status != fuse.OK {
+			log.WithFields(
+				log.Fields{
+					"node id": input.NodeId,
+					"owner":   input.LockOwner,
+				}).Errorf("release flock failed: %v", status)
+		}
+	}
+	r.RawFileSystem.Release(cancel, input)
+}
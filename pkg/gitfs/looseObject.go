@@ -0,0 +1,180 @@
+package gitfs
+
+import (
+	"bufio"
+	"compress/zlib"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	log "github.com/sirupsen/logrus"
+)
+
+// looseObjectKey is the key of the loose object oid in the object storage,
+// which is shared by all the repositories of the volume storing the same
+// bytes of it, sum is the sha256 of the bytes, which differ by the level
+// the object is compressed with
+func looseObjectKey(oid string, sum []byte) string {
+	return "objects/" + oid + "/" + hex.EncodeToString(sum)
+}
+
+// hashLooseObject read content to the end, and return its sha256 and the oid
+// of the zlib compressed loose object in it, ok is false if content is not a
+// complete loose object
+func hashLooseObject(content io.Reader, newHash func() hash.Hash) (oid string, sum []byte, ok bool, err error) {
+	digest := sha256.New()
+	content = io.TeeReader(content, digest)
+	oid, ok = looseObjectID(content, newHash)
+	// the rest of the content after the object or a broken part of it
+	if _, err := io.Copy(io.Discard, content); err != nil {
+		return "", nil, false, err
+	}
+	return oid, digest.Sum(nil), ok, nil
+}
+
+// looseObjectID return the oid of the zlib compressed loose object in content,
+// ok is false if content is not a complete loose object
+func looseObjectID(content io.Reader, newHash func() hash.Hash) (oid string, ok bool) {
+	reader, err := zlib.NewReader(content)
+	if err != nil {
+		return "", false
+	}
+	defer reader.Close()
+
+	h := newHash()
+	object := bufio.NewReader(io.TeeReader(reader, h))
+	header, err := object.ReadString(0)
+	if err != nil {
+		return "", false
+	}
+	objectType, size, found := strings.Cut(strings.TrimSuffix(header, "\x00"), " ")
+	if !found {
+		return "", false
+	}
+	switch objectType {
+	case "blob", "tree", "commit", "tag":
+	default:
+		return "", false
+	}
+	length, err := strconv.ParseInt(size, 10, 64)
+	if err != nil || length < 0 {
+		return "", false
+	}
+	// the checksum of zlib is verified at the end of the stream
+	n, err := io.Copy(io.Discard, object)
+	if err != nil || n != length {
+		return "", false
+	}
+	return hex.EncodeToString(h.Sum(nil)), true
+}
+
+// isLooseObjectName return true if name is a loose object file in a fan-out
+// directory of the hash with hexLength, e.g. the last 38 hex digits of sha1
+func isLooseObjectName(name string, hexLength int) bool {
+	if len(name) != hexLength-2 {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil && strings.ToLower(name) == name
+}
+
+// objectHash return the hash function of the object names of the repository
+// the loose object file of node belong to, which is told by the name of the
+// file, or the extensions.objectformat of the repository config otherwise,
+// since git write a loose object to a temporary file before naming it.
+func (gitFs *GitFs) objectHash(ctx context.Context, node *Node) func() hash.Hash {
+	switch {
+	case isLooseObjectName(node.name, sha1.Size*2):
+		return sha1.New
+	case isLooseObjectName(node.name, sha256.Size*2):
+		return sha256.New
+	}
+
+	gitDir := node.gitDir()
+	if gitDir == nil {
+		return sha1.New
+	}
+	if format, ok := gitFs.objectFormats.Load(gitDir.inode); ok {
+		if format.(string) == "sha256" {
+			return sha256.New
+		}
+		return sha1.New
+	}
+
+	format, eno := gitDir.objectFormat(ctx)
+	if eno != syscall.F_OK {
+		log.WithField("inode", gitDir.inode).WithError(eno).Warn("read object format failed, use sha1")
+		return sha1.New
+	}
+	gitFs.objectFormats.Store(gitDir.inode, format)
+	if format == "sha256" {
+		return sha256.New
+	}
+	return sha1.New
+}
+
+// gitDir return the node of the .git directory which node is in, nil if
+// node is not in the tree of the mount, e.g. it has been unlinked
+func (node *Node) gitDir() *Node {
+	inode := node.EmbeddedInode()
+	for inode != nil {
+		if dir, ok := inode.Operations().(*Node); ok && dir.gitPath == "." {
+			return dir
+		}
+		_, inode = inode.Parent()
+	}
+	return nil
+}
+
+// objectFormat read extensions.objectformat from the config in the .git directory, sha1 by default
+func (node *Node) objectFormat(ctx context.Context) (string, syscall.Errno) {
+	entry, eno := node.lookupEntry(ctx, "config")
+	if eno == syscall.ENOENT {
+		return "sha1", syscall.F_OK
+	}
+	if eno != syscall.F_OK {
+		return "", eno
+	}
+	config := node.NewNode(entry.Ino, "config", entry.Attr.Typ).(*Node)
+	fh, err := node.gitfs.openFile(ctx, config, syscall.O_RDONLY)
+	if err != nil {
+		return "", syscall.EIO
+	}
+	defer fh.(fs.FileReleaser).Release(ctx)
+
+	content := make([]byte, entry.Attr.Length)
+	result, eno := fh.(fs.FileReader).Read(ctx, content, 0)
+	if eno != syscall.F_OK {
+		return "", eno
+	}
+	content, status := result.Bytes(content)
+	if status != fuse.OK {
+		return "", syscall.Errno(status)
+	}
+	return parseObjectFormat(content), syscall.F_OK
+}
+
+// parseObjectFormat return extensions.objectformat of the git config, sha1 by default
+func parseObjectFormat(config []byte) string {
+	section := ""
+	for _, line := range strings.Split(string(config), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") {
+			section = strings.ToLower(strings.Trim(line, "[] \t"))
+			continue
+		}
+		key, value, found := strings.Cut(line, "=")
+		if section == "extensions" && found && strings.EqualFold(strings.TrimSpace(key), "objectformat") {
+			return strings.ToLower(strings.TrimSpace(value))
+		}
+	}
+	return "sha1"
+}
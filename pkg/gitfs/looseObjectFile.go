@@ -0,0 +1,446 @@
+package gitfs
+
+import (
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"github.com/adlternative/tinygitfs/pkg/datasource"
+	"github.com/adlternative/tinygitfs/pkg/metadata"
+	"github.com/adlternative/tinygitfs/pkg/page"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	log "github.com/sirupsen/logrus"
+	"hash"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// LooseObjectFile is a loose object of git, which is stored in the object
+// storage by its oid, so the same object of all the repositories of the
+// volume is stored once. It is written to a spool file until it is flushed,
+// since the oid is only known when the whole object is written.
+type LooseObjectFile struct {
+	inode metadata.Ino
+	*datasource.DataSource
+	gitfs       *GitFs
+	mu          *sync.Mutex
+	ref         int
+	releaseOnce *sync.Once
+
+	// spool is the content of the file from the first write until it is
+	// stored, nil if the content is the stored one, and size is its length
+	spool *os.File
+	size  int64
+}
+
+type LooseObjectFileHandler struct {
+	file *LooseObjectFile
+	node *Node
+}
+
+func NewLooseObjectFile(ctx context.Context, inode metadata.Ino, dataSource *datasource.DataSource, gitFs *GitFs) (File, error) {
+	return &LooseObjectFile{
+		inode:       inode,
+		DataSource:  dataSource,
+		gitfs:       gitFs,
+		mu:          &sync.Mutex{},
+		releaseOnce: &sync.Once{},
+	}, nil
+}
+
+func (file *LooseObjectFile) NewFileHandler(node *Node, flags uint32) FileHandler {
+	file.mu.Lock()
+	defer file.mu.Unlock()
+
+	file.ref++
+
+	return &LooseObjectFileHandler{
+		file: file,
+		node: node,
+	}
+}
+
+func (file *LooseObjectFile) UnRef(release func()) error {
+	file.mu.Lock()
+	defer file.mu.Unlock()
+
+	file.ref--
+	if file.ref < 0 {
+		log.Errorf("file ref down to negative value: %d", file.ref)
+		return fmt.Errorf("file ref down to negative value: %d", file.ref)
+	} else if file.ref == 0 {
+		file.releaseOnce.Do(release)
+		file.closeSpool()
+	}
+	return nil
+}
+
+func (file *LooseObjectFile) Ref() int {
+	file.mu.Lock()
+	defer file.mu.Unlock()
+
+	return file.ref
+}
+
+func (file *LooseObjectFile) Release(ctx context.Context) error {
+	return file.gitfs.ReleaseFile(ctx, file.inode)
+}
+
+// openSpool copy the stored content of the file to a new spool file to write
+// it, a page at a time
+func (file *LooseObjectFile) openSpool(ctx context.Context) syscall.Errno {
+	if file.spool != nil {
+		return syscall.F_OK
+	}
+	attr, eno := file.Meta.Getattr(ctx, file.inode)
+	if eno != syscall.F_OK {
+		return eno
+	}
+
+	spool, err := os.CreateTemp("", "tinygitfs-object-*")
+	if err != nil {
+		log.WithField("inode", file.inode).WithError(err).Error("create spool file failed")
+		return syscall.EIO
+	}
+	// the spool file is only reached by the descriptor, so it is gone with it
+	os.Remove(spool.Name())
+
+	length := int64(attr.Length)
+	buf := make([]byte, page.PageSize)
+	for off := int64(0); off < length; off += page.PageSize {
+		n, eno := readChunks(ctx, file.DataSource, file.inode, buf, off, length)
+		if eno == syscall.F_OK {
+			_, err = spool.Write(buf[:n])
+			if err != nil {
+				eno = syscall.EIO
+			}
+		}
+		if eno != syscall.F_OK {
+			spool.Close()
+			return eno
+		}
+	}
+	file.spool = spool
+	file.size = length
+	return syscall.F_OK
+}
+
+func (file *LooseObjectFile) closeSpool() {
+	if file.spool != nil {
+		file.spool.Close()
+		file.spool = nil
+	}
+}
+
+// sync store the content to the object storage, under the key of its oid if
+// it is a loose object, which is not uploaded again if the same bytes of it
+// are already stored by any repository of the volume; otherwise under the
+// sha256 of the content like the pages of the regular files. newHash is the
+// hash of the object names, see LooseObjectFileHandler.objectHash.
+func (file *LooseObjectFile) sync(ctx context.Context, newHash func() hash.Hash) syscall.Errno {
+	if file.spool == nil {
+		return syscall.F_OK
+	}
+
+	length := file.size
+	var key string
+	if length > 0 {
+		oid, sum, ok, err := hashLooseObject(io.NewSectionReader(file.spool, 0, length), newHash)
+		if err != nil {
+			log.WithField("inode", file.inode).WithError(err).Error("read spool file failed")
+			return syscall.EIO
+		}
+		if ok {
+			key = looseObjectKey(oid, sum)
+		} else {
+			key = page.StoragePathOfSum(sum)
+		}
+	}
+
+	reuse := true
+	for {
+		reused, eno := file.put(ctx, key, length, reuse)
+		if eno != syscall.F_OK {
+			return eno
+		}
+		err := file.setChunks(ctx, key, length, reused)
+		if errors.Is(err, metadata.ErrChunkFenced) {
+			// gc is deleting the object, or deleted it since it was found
+			// referred or reserved, which is uploaded again
+			reuse = false
+			continue
+		}
+		if err != nil {
+			return syscall.EIO
+		}
+		break
+	}
+
+	lastPageNum := length / page.PageSize
+	if err := file.Meta.TruncateChunkMeta(ctx, file.inode, lastPageNum, int(length%page.PageSize)); err != nil {
+		return syscall.EIO
+	}
+
+	attr, eno := file.Meta.Getattr(ctx, file.inode)
+	if eno != syscall.F_OK {
+		return eno
+	}
+	oldLength := attr.Length
+	attr.Length = uint64(length)
+	metadata.SetTime(&attr.Mtime, &attr.Mtimensec, time.Now())
+	if err := file.Meta.SetattrDirectly(ctx, file.inode, attr); err != nil {
+		return syscall.EIO
+	}
+	if err := file.Meta.UpdateUsedSpace(ctx, int64(attr.Length)-int64(oldLength)); err != nil {
+		return syscall.EIO
+	}
+	file.closeSpool()
+	return syscall.F_OK
+}
+
+// put upload the spool file of length to key, unless a chunk refer to the
+// object and reuse is set, since an object no chunk refer to may be deleted
+// by gc at any time, otherwise the object is reserved before it is uploaded.
+// It return true if the object is reused without uploading.
+func (file *LooseObjectFile) put(ctx context.Context, key string, length int64, reuse bool) (bool, syscall.Errno) {
+	if length == 0 {
+		return false, syscall.F_OK
+	}
+	if reuse {
+		_, stored, err := file.Meta.GetChunkRef(ctx, key)
+		if err != nil {
+			return false, syscall.EIO
+		}
+		if stored {
+			return true, syscall.F_OK
+		}
+	}
+	// keep gc from deleting the object until the chunks are set
+	if err := file.Meta.ReserveChunkRef(ctx, key); err != nil {
+		return false, syscall.EIO
+	}
+	if err := file.Data.Put(key, io.NewSectionReader(file.spool, 0, length)); err != nil {
+		log.WithField("key", key).WithError(err).Error("put loose object failed")
+		return false, syscall.EIO
+	}
+	return false, syscall.F_OK
+}
+
+// setChunks set the chunks of the file of length to the pages of the object
+// at key, which must still be referred if it is reused
+func (file *LooseObjectFile) setChunks(ctx context.Context, key string, length int64, reused bool) error {
+	for pageNum := int64(0); pageNum*page.PageSize < length; pageNum++ {
+		offset := pageNum * page.PageSize
+		chunkLength := length - offset
+		if chunkLength > page.PageSize {
+			chunkLength = page.PageSize
+		}
+		err := file.Meta.SetChunkAttr(ctx, file.inode, pageNum, &metadata.ChunkAttr{
+			Offset:       offset,
+			Length:       int(chunkLength),
+			StoragePath:  key,
+			ObjectOffset: offset,
+			Reused:       reused,
+			Reserved:     !reused,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// objectHash return the hash of the object names of the repository the file
+// belong to, which must be called before file.mu is taken, since the config
+// of the repository may be read through GitFs.openFile, which take
+// GitFs.filesMu, and GitFs.ReleaseFile take file.mu under GitFs.filesMu.
+func (fh *LooseObjectFileHandler) objectHash(ctx context.Context) func() hash.Hash {
+	if fh.node == nil {
+		return sha1.New
+	}
+	return fh.file.gitfs.objectHash(ctx, fh.node)
+}
+
+var _ = (fs.FileHandle)((*LooseObjectFileHandler)(nil))
+var _ = (fs.FileWriter)((*LooseObjectFileHandler)(nil))
+var _ = (fs.FileReader)((*LooseObjectFileHandler)(nil))
+var _ = (fs.FileFlusher)((*LooseObjectFileHandler)(nil))
+var _ = (fs.FileFsyncer)((*LooseObjectFileHandler)(nil))
+var _ = (fs.FileReleaser)((*LooseObjectFileHandler)(nil))
+var _ = (fs.FileGetattrer)((*LooseObjectFileHandler)(nil))
+var _ = (fs.FileSetattrer)((*LooseObjectFileHandler)(nil))
+
+// Write will write the dest data to the spool file begin at offset
+func (fh *LooseObjectFileHandler) Write(ctx context.Context, data []byte, off int64) (written uint32, errno syscall.Errno) {
+	log.WithFields(
+		log.Fields{
+			"length": len(data),
+			"offset": off,
+			"inode":  fh.file.inode,
+		}).Debug("Write")
+
+	fh.file.mu.Lock()
+	defer fh.file.mu.Unlock()
+
+	if eno := fh.file.openSpool(ctx); eno != syscall.F_OK {
+		return 0, eno
+	}
+	n, err := fh.file.spool.WriteAt(data, off)
+	if err != nil {
+		log.WithField("inode", fh.file.inode).WithError(err).Error("write spool file failed")
+		return uint32(n), syscall.EIO
+	}
+	if end := off + int64(n); end > fh.file.size {
+		fh.file.size = end
+	}
+	return uint32(n), syscall.F_OK
+}
+
+// Read will read the file data begin at offset to dest, read size no large then dest length
+func (fh *LooseObjectFileHandler) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	log.WithFields(
+		log.Fields{
+			"dest length": len(dest),
+			"offset":      off,
+			"inode":       fh.file.inode,
+		}).Debug("Read")
+
+	fh.file.mu.Lock()
+	defer fh.file.mu.Unlock()
+
+	if fh.file.spool != nil {
+		if off >= fh.file.size {
+			return fuse.ReadResultData(nil), syscall.F_OK
+		}
+		if int64(len(dest)) > fh.file.size-off {
+			dest = dest[:fh.file.size-off]
+		}
+		n, err := fh.file.spool.ReadAt(dest, off)
+		if err != nil && err != io.EOF {
+			log.WithField("inode", fh.file.inode).WithError(err).Error("read spool file failed")
+			return nil, syscall.EIO
+		}
+		return fuse.ReadResultData(dest[:n]), syscall.F_OK
+	}
+
+	attr, eno := fh.file.Meta.Getattr(ctx, fh.file.inode)
+	if eno != syscall.F_OK {
+		return nil, eno
+	}
+	n, eno := readChunks(ctx, fh.file.DataSource, fh.file.inode, dest, off, int64(attr.Length))
+	if eno != syscall.F_OK {
+		return nil, eno
+	}
+	return fuse.ReadResultData(dest[:n]), syscall.F_OK
+}
+
+// Fsync store the content to the object storage.
+func (fh *LooseObjectFileHandler) Fsync(ctx context.Context, flags uint32) syscall.Errno {
+	log.WithFields(
+		log.Fields{
+			"flags": flags,
+			"inode": fh.file.inode,
+		}).Debug("Fsync")
+
+	newHash := fh.objectHash(ctx)
+	fh.file.mu.Lock()
+	defer fh.file.mu.Unlock()
+
+	return fh.file.sync(ctx, newHash)
+}
+
+// Flush will be called when file closed. (maybe called many times)
+// We just do fsync here...
+func (fh *LooseObjectFileHandler) Flush(ctx context.Context) syscall.Errno {
+	log.WithFields(
+		log.Fields{
+			"inode": fh.file.inode,
+		}).Debug("Flush")
+
+	newHash := fh.objectHash(ctx)
+	fh.file.mu.Lock()
+	defer fh.file.mu.Unlock()
+
+	return fh.file.sync(ctx, newHash)
+}
+
+// Release file handler release
+func (fh *LooseObjectFileHandler) Release(ctx context.Context) syscall.Errno {
+	log.WithFields(
+		log.Fields{
+			"inode": fh.file.inode,
+		}).Debug("Release")
+
+	err := fh.file.Release(ctx)
+	if err != nil {
+		return syscall.ENOENT
+	}
+
+	return syscall.F_OK
+}
+
+// Setattr set the attr to the metadata, and truncate the content if the size is set
+func (fh *LooseObjectFileHandler) Setattr(ctx context.Context, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	newHash := fh.objectHash(ctx)
+	fh.file.mu.Lock()
+	defer fh.file.mu.Unlock()
+
+	if size, ok := in.GetSize(); ok {
+		if eno := fh.file.openSpool(ctx); eno != syscall.F_OK {
+			return eno
+		}
+		if err := fh.file.spool.Truncate(int64(size)); err != nil {
+			log.WithField("inode", fh.file.inode).WithError(err).Error("truncate spool file failed")
+			return syscall.EIO
+		}
+		fh.file.size = int64(size)
+	}
+	if eno := fh.file.sync(ctx, newHash); eno != syscall.F_OK {
+		return eno
+	}
+	attr, eno := fh.file.Meta.Getattr(ctx, fh.file.inode)
+	if eno != syscall.F_OK {
+		return eno
+	}
+	if atime, ok := in.GetATime(); ok {
+		metadata.SetTime(&attr.Atime, &attr.Atimensec, atime)
+	}
+	if ctime, ok := in.GetCTime(); ok {
+		metadata.SetTime(&attr.Ctime, &attr.Ctimensec, ctime)
+	}
+	if uid, ok := in.GetUID(); ok {
+		attr.Uid = uid
+	}
+	if gid, ok := in.GetGID(); ok {
+		attr.Gid = gid
+	}
+	if mode, ok := in.GetMode(); ok {
+		attr.Mode = uint16(mode)
+	}
+	err := fh.file.Meta.SetattrDirectly(ctx, fh.file.inode, attr)
+	if err != nil {
+		return syscall.EIO
+	}
+	metadata.ToAttrOut(fh.file.inode, attr, &out.Attr)
+	return syscall.F_OK
+}
+
+// Getattr get the attr from the metadata with the size of the spool file
+func (fh *LooseObjectFileHandler) Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno {
+	fh.file.mu.Lock()
+	defer fh.file.mu.Unlock()
+
+	attr, eno := fh.file.Meta.Getattr(ctx, fh.file.inode)
+	if eno != 0 {
+		return eno
+	}
+	if fh.file.spool != nil {
+		attr.Length = uint64(fh.file.size)
+	}
+	metadata.ToAttrOut(fh.file.inode, attr, &out.Attr)
+	return syscall.F_OK
+}
@@ -2,7 +2,9 @@ package gitfs
 
 import (
 	"context"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/adlternative/tinygitfs/pkg/metadata"
 	"github.com/adlternative/tinygitfs/pkg/page"
@@ -14,13 +16,23 @@ import (
 type Node struct {
 	fs.Inode
 
-	inode    metadata.Ino
-	name     string
-	nodeType string
+	inode metadata.Ino
+	name  string
+	// gitPath is the path relative to the .git directory the node is in, see childGitPath
+	gitPath string
+	backend FileBackend
 
 	gitfs *GitFs
+
+	// plusEntry is the entry a READDIRPLUS of the directory just read
+	plusEntry *metadata.DirEntry
+	plusTime  time.Time
+	plusMu    sync.Mutex
 }
 
+// plusEntryTTL is how long Lookup can use the entry read by READDIRPLUS
+const plusEntryTTL = time.Second
+
 var _ = (fs.NodeAccesser)((*Node)(nil))
 var _ = (fs.NodeGetattrer)((*Node)(nil))
 var _ = (fs.NodeMknoder)((*Node)(nil))
@@ -35,15 +47,21 @@ var _ = (fs.NodeRenamer)((*Node)(nil))
 var _ = (fs.NodeLinker)((*Node)(nil))
 var _ = (fs.NodeOpener)((*Node)(nil))
 var _ = (fs.NodeStatfser)((*Node)(nil))
+var _ = (fs.NodeSymlinker)((*Node)(nil))
+var _ = (fs.NodeReadlinker)((*Node)(nil))
+var _ = (fs.NodeGetxattrer)((*Node)(nil))
+var _ = (fs.NodeSetxattrer)((*Node)(nil))
+var _ = (fs.NodeListxattrer)((*Node)(nil))
+var _ = (fs.NodeRemovexattrer)((*Node)(nil))
 
 // Access check if node can access a file or directory
 // TODO should we use memattr?
 func (node *Node) Access(ctx context.Context, mask uint32) syscall.Errno {
 	log.WithFields(
 		log.Fields{
-			"mask":      mask,
-			"inode":     node.inode,
-			"node type": node.nodeType,
+			"mask":    mask,
+			"inode":   node.inode,
+			"backend": node.backend,
 		}).Trace("Access")
 
 	attr, eno := node.gitfs.DefaultDataSource.Meta.Getattr(ctx, node.inode)
@@ -106,7 +124,7 @@ func (node *Node) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno
 			"bavail":          out.Bavail,
 			"ffree":           out.Ffree,
 			"files":           out.Files,
-			"node type":       node.nodeType,
+			"backend":         node.backend,
 		}).Trace("Statfs")
 
 	return syscall.F_OK
@@ -116,12 +134,13 @@ func (node *Node) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno
 func (node *Node) Link(ctx context.Context, target fs.InodeEmbedder, name string, out *fuse.EntryOut) (newNode *fs.Inode, errno syscall.Errno) {
 	log.WithFields(
 		log.Fields{
-			"name":      name,
-			"target":    target.EmbeddedInode(),
-			"inode":     node.inode,
-			"node type": node.nodeType,
+			"name":    name,
+			"target":  target.EmbeddedInode(),
+			"inode":   node.inode,
+			"backend": node.backend,
 		}).Trace("Link")
 
+	node.dropPlusEntry()
 	targetInode := metadata.Ino(target.EmbeddedInode().StableAttr().Ino)
 	attr, eno := node.gitfs.DefaultDataSource.Meta.Link(ctx, node.inode, targetInode, name)
 	if eno != syscall.F_OK {
@@ -149,10 +168,95 @@ func (node *Node) Rename(ctx context.Context, name string, newParent fs.InodeEmb
 			"newName":   newName,
 			"flags":     flags,
 			"inode":     node.inode,
-			"node type": node.nodeType,
+			"backend":   node.backend,
 		}).Debug("Rename")
 
-	return node.gitfs.DefaultDataSource.Meta.Rename(ctx, node.inode, name, metadata.Ino(newParentInode), newName)
+	var newDir *Node
+	switch parent := newParent.(type) {
+	case *Node:
+		newDir = parent
+	case *GitFs:
+		newDir = parent.Node
+	default:
+		return syscall.EXDEV
+	}
+	if eno := node.checkMove(ctx, name, newDir, newName, flags); eno != syscall.F_OK {
+		return eno
+	}
+	node.dropPlusEntry()
+	newDir.dropPlusEntry()
+	child, target := node.GetChild(name), newDir.GetChild(newName)
+
+	var eno syscall.Errno
+	if flags&metadata.RenameExchange != 0 || !newDir.isRef(newName) {
+		eno = node.gitfs.DefaultDataSource.Meta.Rename(ctx, node.inode, name, metadata.Ino(newParentInode), newName, flags)
+	} else {
+		// a ref is usually updated by renaming its lock file into place
+		old, value := newDir.refValue(ctx, newName), node.refValue(ctx, name)
+		eno = node.gitfs.DefaultDataSource.Meta.Rename(ctx, node.inode, name, metadata.Ino(newParentInode), newName, flags)
+		if eno == syscall.F_OK && old != value {
+			node.gitfs.publishRefEvent(ctx, newDir.childPath(newName), old, value)
+		}
+	}
+	if eno != syscall.F_OK {
+		return eno
+	}
+
+	if child != nil {
+		child.Operations().(*Node).move(newDir, newName)
+	}
+	if target != nil && flags&metadata.RenameExchange != 0 {
+		target.Operations().(*Node).move(node, name)
+	}
+	return syscall.F_OK
+}
+
+// checkMove return EXDEV if the entry name can not be renamed to newName in
+// newDir without moving its content to another backend, which is left to the
+// caller, e.g. mv(1) copy the file then
+func (node *Node) checkMove(ctx context.Context, name string, newDir *Node, newName string, flags uint32) syscall.Errno {
+	if node.gitPath == "" && newDir.gitPath == "" && name != gitDirName && newName != gitDirName {
+		return syscall.F_OK
+	}
+
+	moves := []struct {
+		dir, newDir   *Node
+		name, newName string
+	}{{node, newDir, name, newName}}
+	if flags&metadata.RenameExchange != 0 {
+		moves = append(moves, struct {
+			dir, newDir   *Node
+			name, newName string
+		}{newDir, node, newName, name})
+	}
+	for _, move := range moves {
+		dentry, find, err := node.gitfs.DefaultDataSource.Meta.GetDentry(ctx, move.dir.inode, move.name)
+		if err != nil {
+			return syscall.EIO
+		}
+		if !find {
+			continue
+		}
+		gitPath := childGitPath(move.dir.gitPath, move.name, dentry.Typ)
+		newGitPath := childGitPath(move.newDir.gitPath, move.newName, dentry.Typ)
+		// the files under a directory are classified by their git paths
+		if dentry.Typ == metadata.TypeDirectory && gitPath != newGitPath {
+			return syscall.EXDEV
+		}
+		if node.gitfs.backend(gitPath, dentry.Typ) != node.gitfs.backend(newGitPath, dentry.Typ) {
+			return syscall.EXDEV
+		}
+	}
+	return syscall.F_OK
+}
+
+// move update the name and the git path of the node renamed to name in dir,
+// whose backend is not changed, nor the git path if it is a directory, see checkMove
+func (node *Node) move(dir *Node, name string) {
+	node.name = name
+	if !node.IsDir() {
+		node.gitPath = childGitPath(dir.gitPath, name, metadata.TypeFile)
+	}
 }
 
 // Opendir open a directory (here we only do a check for directory entry)
@@ -160,8 +264,8 @@ func (node *Node) Rename(ctx context.Context, name string, newParent fs.InodeEmb
 func (node *Node) Opendir(ctx context.Context) syscall.Errno {
 	log.WithFields(
 		log.Fields{
-			"inode":     node.inode,
-			"node type": node.nodeType,
+			"inode":   node.inode,
+			"backend": node.backend,
 		}).Trace("Opendir")
 
 	attr, eno := node.gitfs.DefaultDataSource.Meta.Getattr(ctx, node.inode)
@@ -180,13 +284,104 @@ func (node *Node) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
 	log.WithFields(
 		log.Fields{
 			"parent inode": node.inode,
-			"node type":    node.nodeType,
+			"backend":      node.backend,
 		}).Trace("Readdir")
 	ds, err := metadata.NewDirStream(ctx, node.inode, node.gitfs.DefaultDataSource.Meta)
 	if err != nil {
 		return nil, syscall.ENOENT
 	}
-	return ds, 0
+	return &dirStream{
+		DirStream: ds,
+		node:      node,
+	}, 0
+}
+
+// dirStream pass every entry it read to Lookup of the directory, since for
+// READDIRPLUS go-fuse look up each entry right after reading it, which can
+// use the attributes the stream fetched in batch instead of the metadata.
+// The entry is dropped when go-fuse ask for the next one, so it is only used
+// by the same READDIRPLUS call.
+type dirStream struct {
+	*metadata.DirStream
+	node *Node
+}
+
+func (ds *dirStream) Next() (fuse.DirEntry, syscall.Errno) {
+	entry, eno := ds.NextEntry()
+	if eno != syscall.F_OK {
+		return fuse.DirEntry{}, eno
+	}
+
+	ds.node.plusMu.Lock()
+	ds.node.plusEntry = entry
+	ds.node.plusTime = time.Now()
+	ds.node.plusMu.Unlock()
+
+	return fuse.DirEntry{
+		Name: entry.Name,
+		Ino:  uint64(entry.Ino),
+		Mode: entry.Attr.SMode(),
+	}, syscall.F_OK
+}
+
+// HasNext drop the entry read by the last Next, which has been looked up
+// by READDIRPLUS, or is not looked up at all by READDIR
+func (ds *dirStream) HasNext() bool {
+	ds.node.dropPlusEntry()
+	return ds.DirStream.HasNext()
+}
+
+// Close drop the entry read by the last Next, which may not fit in the
+// reply of READDIRPLUS and be looked up by the next call
+func (ds *dirStream) Close() {
+	ds.node.dropPlusEntry()
+	ds.DirStream.Close()
+}
+
+// dropParentPlusEntry forget the entry READDIRPLUS of the parent just read
+// of the node, since its attributes are changed
+func (node *Node) dropParentPlusEntry() {
+	if _, parent := node.Parent(); parent != nil {
+		if dir, ok := parent.Operations().(*Node); ok {
+			dir.dropPlusEntry()
+		}
+	}
+}
+
+// dropPlusEntry forget the entry READDIRPLUS just read, since the directory is changed
+func (node *Node) dropPlusEntry() {
+	node.plusMu.Lock()
+	node.plusEntry = nil
+	node.plusMu.Unlock()
+}
+
+// lookupEntry find name in the directory with its attributes, the entry
+// READDIRPLUS just read is used once without asking the metadata
+func (node *Node) lookupEntry(ctx context.Context, name string) (*metadata.DirEntry, syscall.Errno) {
+	node.plusMu.Lock()
+	entry := node.plusEntry
+	if entry != nil && entry.Name == name {
+		node.plusEntry = nil
+		if time.Since(node.plusTime) < plusEntryTTL {
+			node.plusMu.Unlock()
+			return entry, syscall.F_OK
+		}
+	}
+	node.plusMu.Unlock()
+
+	dentry, find, err := node.gitfs.DefaultDataSource.Meta.GetDentry(ctx, node.inode, name)
+	if err != nil || !find {
+		return nil, syscall.ENOENT
+	}
+	attr, eno := node.gitfs.DefaultDataSource.Meta.Getattr(ctx, dentry.Ino)
+	if eno != 0 {
+		return nil, eno
+	}
+	return &metadata.DirEntry{
+		Name: name,
+		Ino:  dentry.Ino,
+		Attr: attr,
+	}, syscall.F_OK
 }
 
 // Lookup check file info, and create a fuse node for it
@@ -195,22 +390,23 @@ func (node *Node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (
 		log.Fields{
 			"name":         name,
 			"parent inode": node.inode,
-			"node type":    node.nodeType,
+			"backend":      node.backend,
 		}).Trace("Lookup")
-	entry, find, err := node.gitfs.DefaultDataSource.Meta.GetDentry(ctx, node.inode, name)
-	if err != nil || !find {
-		return nil, syscall.ENOENT
-	}
-	attr, eno := node.gitfs.DefaultDataSource.Meta.Getattr(ctx, entry.Ino)
+	entry, eno := node.lookupEntry(ctx, name)
 	if eno != 0 {
 		return nil, eno
 	}
 
-	metadata.ToAttrOut(entry.Ino, attr, &out.Attr)
-
-	//log.Printf("%s %d %o\n", name, entry.Ino, out.Attr.Mode)
+	newNode := node.NewNode(entry.Ino, name, entry.Attr.Typ)
+	if newNode.(*Node).backend == ReflogBackend {
+		if eno := node.gitfs.setReflogLength(ctx, entry.Ino, entry.Attr); eno != 0 {
+			return nil, eno
+		}
+	}
+	metadata.ToAttrOut(entry.Ino, entry.Attr, &out.Attr)
+	out.SetEntryTimeout(newNode.(*Node).cacheTimeout())
+	out.SetAttrTimeout(newNode.(*Node).cacheTimeout())
 
-	newNode := node.NewNode(entry.Ino, name, attr.Typ)
 	return node.NewInode(ctx, newNode, fs.StableAttr{
 		Mode: uint32(out.Mode),
 		Ino:  uint64(entry.Ino),
@@ -219,27 +415,25 @@ func (node *Node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (
 
 }
 
+// cacheTimeout return how long the kernel can cache the entry and the
+// attributes of the node, the files in .git directories are not cached,
+// since git lock and update the refs by them across the mounts
+func (node *Node) cacheTimeout() time.Duration {
+	if node.gitPath != "" {
+		return 0
+	}
+	return node.gitfs.cacheTimeout
+}
+
+// NewNode create the fuse node of the child name, whose backend is chosen by the classifier
 func (node *Node) NewNode(ino metadata.Ino, name string, _type uint8) fs.InodeEmbedder {
-	switch name {
-	case ".git":
-		if _type == metadata.TypeDirectory {
-			return &GitRepoNode{
-				Node: Node{
-					nodeType: "GitRepoNode",
-					inode:    ino,
-					name:     name,
-					gitfs:    node.gitfs,
-				},
-			}
-		}
-		fallthrough
-	default:
-		return &Node{
-			nodeType: "Node",
-			inode:    ino,
-			name:     name,
-			gitfs:    node.gitfs,
-		}
+	gitPath := childGitPath(node.gitPath, name, _type)
+	return &Node{
+		inode:   ino,
+		name:    name,
+		gitPath: gitPath,
+		backend: node.gitfs.backend(gitPath, _type),
+		gitfs:   node.gitfs,
 	}
 }
 
@@ -250,8 +444,9 @@ func (node *Node) Mkdir(ctx context.Context, name string, mode uint32, out *fuse
 			"name":         name,
 			"mode":         mode,
 			"parent inode": node.inode,
-			"node type":    node.nodeType,
+			"backend":      node.backend,
 		}).Debug("Mkdir")
+	node.dropPlusEntry()
 	attr, ino, eno := node.gitfs.DefaultDataSource.Meta.MkNod(ctx, node.inode, metadata.TypeDirectory, name, mode, 0)
 	if eno != 0 {
 		return nil, eno
@@ -285,6 +480,7 @@ func (node *Node) Mknod(ctx context.Context, name string, mode uint32, dev uint3
 		return nil, syscall.EPERM
 	}
 
+	node.dropPlusEntry()
 	attr, ino, eno := node.gitfs.DefaultDataSource.Meta.MkNod(ctx, node.inode, _type, name, mode, dev)
 	if eno != 0 {
 		return nil, eno
@@ -304,6 +500,50 @@ func (node *Node) Mknod(ctx context.Context, name string, mode uint32, dev uint3
 	}), 0
 }
 
+// Symlink create a symbolic link, and create a fuse node for it
+func (node *Node) Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	log.WithFields(
+		log.Fields{
+			"name":         name,
+			"target":       target,
+			"parent inode": node.inode,
+			"backend":      node.backend,
+		}).Debug("Symlink")
+	node.dropPlusEntry()
+	attr, ino, eno := node.gitfs.DefaultDataSource.Meta.Symlink(ctx, node.inode, name, target)
+	if eno != 0 {
+		return nil, eno
+	}
+	metadata.ToAttrOut(ino, attr, &out.Attr)
+
+	log.WithFields(
+		log.Fields{
+			"inode": ino,
+		}).Debug("Symlink Result")
+
+	newNode := node.NewNode(ino, name, metadata.TypeSymlink)
+	return node.NewInode(ctx, newNode, fs.StableAttr{
+		Mode: out.Mode,
+		Ino:  uint64(ino),
+		Gen:  1,
+	}), 0
+}
+
+// Readlink return the target of a symbolic link
+func (node *Node) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	log.WithFields(
+		log.Fields{
+			"inode":   node.inode,
+			"backend": node.backend,
+		}).Trace("Readlink")
+
+	target, eno := node.gitfs.DefaultDataSource.Meta.Readlink(ctx, node.inode)
+	if eno != syscall.F_OK {
+		return nil, eno
+	}
+	return []byte(target), syscall.F_OK
+}
+
 // Create a file, and create a fuse node for it
 func (node *Node) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (inode *fs.Inode, fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
 	log.WithFields(
@@ -312,8 +552,9 @@ func (node *Node) Create(ctx context.Context, name string, flags uint32, mode ui
 			"flags":        flags,
 			"mode":         mode,
 			"parent inode": node.inode,
-			"node type":    node.nodeType,
+			"backend":      node.backend,
 		}).Debug("Create")
+	node.dropPlusEntry()
 	attr, ino, eno := node.gitfs.DefaultDataSource.Meta.MkNod(ctx, node.inode, metadata.TypeFile, name, mode, 0)
 	if eno != 0 {
 		return nil, 0, 0, eno
@@ -325,13 +566,12 @@ func (node *Node) Create(ctx context.Context, name string, flags uint32, mode ui
 			"inode": ino,
 		}).Debug("Create Result")
 
-	fileHandler, err := node.gitfs.OpenFile(ctx, ino)
+	newNode := node.NewNode(ino, name, metadata.TypeFile)
+	fileHandler, err := node.gitfs.openFile(ctx, newNode.(*Node), flags)
 	if err != nil {
 		return nil, 0, 0, syscall.ENOENT
 	}
 
-	newNode := node.NewNode(ino, name, metadata.TypeFile)
-
 	return node.NewInode(ctx, newNode, fs.StableAttr{
 		Mode: out.Mode,
 		Ino:  uint64(ino),
@@ -343,12 +583,15 @@ func (node *Node) Create(ctx context.Context, name string, flags uint32, mode ui
 func (node *Node) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
 	log.WithFields(
 		log.Fields{
-			"flags":     flags,
-			"inode":     node.inode,
-			"node type": node.nodeType,
+			"flags":   flags,
+			"inode":   node.inode,
+			"backend": node.backend,
 		}).Debug("Open")
 
-	fh, err := node.gitfs.OpenFile(ctx, node.inode)
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR|syscall.O_TRUNC) != 0 {
+		node.dropParentPlusEntry()
+	}
+	fh, err := node.gitfs.openFile(ctx, node, flags)
 	if err != nil {
 		return nil, 0, syscall.EIO
 	}
@@ -362,8 +605,9 @@ func (node *Node) Rmdir(ctx context.Context, name string) syscall.Errno {
 		log.Fields{
 			"name":         name,
 			"parent inode": node.inode,
-			"node type":    node.nodeType,
+			"backend":      node.backend,
 		}).Debug("Rmdir")
+	node.dropPlusEntry()
 	return node.gitfs.DefaultDataSource.Meta.Rmdir(ctx, node.inode, name)
 }
 
@@ -371,35 +615,46 @@ func (node *Node) Rmdir(ctx context.Context, name string) syscall.Errno {
 func (node *Node) Unlink(ctx context.Context, name string) syscall.Errno {
 	log.WithFields(
 		log.Fields{
-			"name":      name,
-			"inode":     node.inode,
-			"node type": node.nodeType,
+			"name":    name,
+			"inode":   node.inode,
+			"backend": node.backend,
 		}).Debug("Unlink")
-	return node.gitfs.DefaultDataSource.Meta.Unlink(ctx, node.inode, name)
+	node.dropPlusEntry()
+	if !node.isRef(name) {
+		return node.gitfs.DefaultDataSource.Meta.Unlink(ctx, node.inode, name)
+	}
+
+	old := node.refValue(ctx, name)
+	eno := node.gitfs.DefaultDataSource.Meta.Unlink(ctx, node.inode, name)
+	if eno == syscall.F_OK && old != "" {
+		node.gitfs.publishRefEvent(ctx, node.childPath(name), old, "")
+	}
+	return eno
 }
 
 // Getattr If a file handle is passed, the Getattr() function of the file handle is called,
 // otherwise the metadata is loaded directly from meta driver
 func (node *Node) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.SetTimeout(node.cacheTimeout())
 	if f != nil {
-		switch fh := f.(type) {
-		case RegularFileHandler:
-			return fh.Getattr(ctx, out)
-		case SymRefFileHandler:
-			return fh.Getattr(ctx, out)
-		}
+		return f.(fs.FileGetattrer).Getattr(ctx, out)
 	}
 
 	log.WithFields(
 		log.Fields{
-			"inode":     node.inode,
-			"node type": node.nodeType,
+			"inode":   node.inode,
+			"backend": node.backend,
 		}).Trace("Getattr")
 
 	attr, eno := node.gitfs.DefaultDataSource.Meta.Getattr(ctx, node.inode)
 	if eno != 0 {
 		return eno
 	}
+	if node.backend == ReflogBackend {
+		if eno := node.gitfs.setReflogLength(ctx, node.inode, attr); eno != 0 {
+			return eno
+		}
+	}
 	metadata.ToAttrOut(node.inode, attr, &out.Attr)
 	return 0
 }
@@ -409,7 +664,7 @@ func (node *Node) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOu
 func (node *Node) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
 	fields := log.Fields{}
 	fields = make(map[string]interface{})
-	fields["node type"] = node.nodeType
+	fields["backend"] = node.backend
 	fields["inode"] = node.inode
 
 	if atime, ok := in.GetATime(); ok {
@@ -430,15 +685,20 @@ func (node *Node) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttr
 	if size, ok := in.GetSize(); ok {
 		fields["size"] = size
 	}
+	node.dropParentPlusEntry()
 
-	if f != nil {
-		log.WithFields(fields).Debug("RegularFile Setattr")
-		switch fh := f.(type) {
-		case RegularFileHandler:
-			return fh.Setattr(ctx, in, out)
-		case SymRefFileHandler:
-			return fh.Setattr(ctx, in, out)
+	if f == nil && node.backend != PageBackend {
+		// the content is not stored in the pages, so it is truncated by the file
+		fh, err := node.gitfs.openFile(ctx, node, 0)
+		if err != nil {
+			return syscall.EIO
 		}
+		defer fh.(fs.FileReleaser).Release(ctx)
+		f = fh
+	}
+	if f != nil {
+		log.WithFields(fields).Debug("File Setattr")
+		return f.(fs.FileSetattrer).Setattr(ctx, in, out)
 	}
 	log.WithFields(fields).Debug("Node Setattr")
 
@@ -481,3 +741,74 @@ func (node *Node) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttr
 	metadata.ToAttrOut(node.inode, attr, &out.Attr)
 	return syscall.F_OK
 }
+
+// Getxattr copy the value of the extended attribute into dest,
+// returns ERANGE with the required size if dest is too small
+func (node *Node) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	log.WithFields(
+		log.Fields{
+			"inode": node.inode,
+			"attr":  attr,
+		}).Trace("Getxattr")
+
+	value, eno := node.gitfs.DefaultDataSource.Meta.GetXattr(ctx, node.inode, attr)
+	if eno != syscall.F_OK {
+		return 0, eno
+	}
+	if len(dest) < len(value) {
+		return uint32(len(value)), syscall.ERANGE
+	}
+	return uint32(copy(dest, value)), syscall.F_OK
+}
+
+func (node *Node) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+	log.WithFields(
+		log.Fields{
+			"inode": node.inode,
+			"attr":  attr,
+			"size":  len(data),
+			"flags": flags,
+		}).Debug("Setxattr")
+
+	return node.gitfs.DefaultDataSource.Meta.SetXattr(ctx, node.inode, attr, data, flags)
+}
+
+// Listxattr copy the null-terminated names of the extended attributes into dest,
+// returns ERANGE with the required size if dest is too small
+func (node *Node) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	log.WithFields(
+		log.Fields{
+			"inode": node.inode,
+		}).Trace("Listxattr")
+
+	names, eno := node.gitfs.DefaultDataSource.Meta.ListXattr(ctx, node.inode)
+	if eno != syscall.F_OK {
+		return 0, eno
+	}
+
+	size := 0
+	for _, name := range names {
+		size += len(name) + 1
+	}
+	if len(dest) < size {
+		return uint32(size), syscall.ERANGE
+	}
+
+	off := 0
+	for _, name := range names {
+		off += copy(dest[off:], name)
+		dest[off] = 0
+		off++
+	}
+	return uint32(size), syscall.F_OK
+}
+
+func (node *Node) Removexattr(ctx context.Context, attr string) syscall.Errno {
+	log.WithFields(
+		log.Fields{
+			"inode": node.inode,
+			"attr":  attr,
+		}).Debug("Removexattr")
+
+	return node.gitfs.DefaultDataSource.Meta.RemoveXattr(ctx, node.inode, attr)
+}
@@ -0,0 +1,300 @@
+package gitfs
+
+import (
+	"context"
+	"fmt"
+	"github.com/adlternative/tinygitfs/pkg/datasource"
+	"github.com/adlternative/tinygitfs/pkg/metadata"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"syscall"
+)
+
+// PackedRefsFile is a packed-refs file, which is parsed into ref records in
+// the metadata when it is flushed, and rendered from the records when opened.
+// A packed-refs written by the page pool before is read from its chunks until
+// it is written.
+type PackedRefsFile struct {
+	inode metadata.Ino
+	*datasource.DataSource
+	gitfs       *GitFs
+	mu          *sync.Mutex
+	ref         int
+	releaseOnce *sync.Once
+
+	buf   []byte
+	clean bool
+	// legacy is true if buf is read from the chunks of the file, which were
+	// written before packed-refs is stored as ref records, they are dropped
+	// when the records are stored
+	legacy bool
+}
+
+type PackedRefsFileHandler struct {
+	file *PackedRefsFile
+}
+
+func NewPackedRefsFile(ctx context.Context, inode metadata.Ino, dataSource *datasource.DataSource, gitFs *GitFs) (File, error) {
+	var buf []byte
+	packedRefs, find, err := dataSource.Meta.PackedRefsGet(ctx, inode)
+	if err != nil {
+		return nil, err
+	}
+	legacy := false
+	if find {
+		buf = packedRefs.Bytes()
+	} else {
+		attr, eno := dataSource.Meta.Getattr(ctx, inode)
+		if eno != syscall.F_OK {
+			return nil, eno
+		}
+		if attr.Length > 0 {
+			buf, eno = readLegacyContent(ctx, dataSource, inode, attr.Length)
+			if eno != syscall.F_OK {
+				return nil, eno
+			}
+			legacy = true
+		}
+	}
+
+	return &PackedRefsFile{
+		inode:       inode,
+		DataSource:  dataSource,
+		gitfs:       gitFs,
+		mu:          &sync.Mutex{},
+		releaseOnce: &sync.Once{},
+		buf:         buf,
+		clean:       true,
+		legacy:      legacy,
+	}, nil
+}
+
+func (file *PackedRefsFile) NewFileHandler(node *Node, flags uint32) FileHandler {
+	file.mu.Lock()
+	defer file.mu.Unlock()
+
+	file.ref++
+
+	return &PackedRefsFileHandler{
+		file: file,
+	}
+}
+
+func (file *PackedRefsFile) UnRef(release func()) error {
+	file.mu.Lock()
+	defer file.mu.Unlock()
+
+	file.ref--
+	if file.ref < 0 {
+		log.Errorf("file ref down to negative value: %d", file.ref)
+		return fmt.Errorf("file ref down to negative value: %d", file.ref)
+	} else if file.ref == 0 {
+		file.releaseOnce.Do(release)
+	}
+	return nil
+}
+
+func (file *PackedRefsFile) Ref() int {
+	file.mu.Lock()
+	defer file.mu.Unlock()
+
+	return file.ref
+}
+
+func (file *PackedRefsFile) Release(ctx context.Context) error {
+	return file.gitfs.ReleaseFile(ctx, file.inode)
+}
+
+// sync parse the buffer into ref records and store them with the file size,
+// a buffer which is not a valid packed-refs is stored as its header.
+func (file *PackedRefsFile) sync(ctx context.Context) syscall.Errno {
+	if !file.clean {
+		packedRefs, err := metadata.ParsePackedRefs(file.buf)
+		if err != nil {
+			log.WithField("inode", file.inode).WithError(err).Warn("store invalid packed-refs as is")
+			packedRefs = &metadata.PackedRefs{
+				Header: string(file.buf),
+			}
+		}
+		err = file.Meta.PackedRefsSet(ctx, file.inode, packedRefs)
+		if err != nil {
+			return syscall.EIO
+		}
+		if file.legacy {
+			if err := dropLegacyContent(ctx, file.DataSource, file.inode); err != nil {
+				return syscall.EIO
+			}
+			file.legacy = false
+		}
+		file.buf = packedRefs.Bytes()
+		file.clean = true
+	}
+
+	// update file size
+	attr, eno := file.Meta.Getattr(ctx, file.inode)
+	if eno != syscall.F_OK {
+		return eno
+	}
+	if attr.Length == uint64(len(file.buf)) {
+		return syscall.F_OK
+	}
+	attr.Length = uint64(len(file.buf))
+
+	err := file.Meta.SetattrDirectly(ctx, file.inode, attr)
+	if err != nil {
+		return syscall.EIO
+	}
+	return syscall.F_OK
+}
+
+var _ = (fs.FileHandle)((*PackedRefsFileHandler)(nil))
+var _ = (fs.FileWriter)((*PackedRefsFileHandler)(nil))
+var _ = (fs.FileReader)((*PackedRefsFileHandler)(nil))
+var _ = (fs.FileFlusher)((*PackedRefsFileHandler)(nil))
+var _ = (fs.FileFsyncer)((*PackedRefsFileHandler)(nil))
+var _ = (fs.FileReleaser)((*PackedRefsFileHandler)(nil))
+var _ = (fs.FileGetattrer)((*PackedRefsFileHandler)(nil))
+var _ = (fs.FileSetattrer)((*PackedRefsFileHandler)(nil))
+
+// Write will write the dest data to file begin at offset
+func (fh *PackedRefsFileHandler) Write(ctx context.Context, data []byte, off int64) (written uint32, errno syscall.Errno) {
+	log.WithFields(
+		log.Fields{
+			"length": len(data),
+			"offset": off,
+			"inode":  fh.file.inode,
+		}).Debug("Write")
+
+	fh.file.mu.Lock()
+	defer fh.file.mu.Unlock()
+
+	end := off + int64(len(data))
+	if int64(len(fh.file.buf)) < end {
+		newBuffer := make([]byte, end)
+		copy(newBuffer, fh.file.buf)
+		fh.file.buf = newBuffer
+	}
+	copy(fh.file.buf[off:end], data)
+	fh.file.clean = false
+
+	return uint32(len(data)), syscall.F_OK
+}
+
+// Read will read the file data begin at offset to dest, read size no large then dest length
+func (fh *PackedRefsFileHandler) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	log.WithFields(
+		log.Fields{
+			"dest length": len(dest),
+			"offset":      off,
+			"inode":       fh.file.inode,
+		}).Debug("Read")
+
+	fh.file.mu.Lock()
+	defer fh.file.mu.Unlock()
+
+	if off >= int64(len(fh.file.buf)) {
+		return fuse.ReadResultData(nil), syscall.F_OK
+	}
+	n := copy(dest, fh.file.buf[off:])
+	return fuse.ReadResultData(dest[:n]), syscall.F_OK
+}
+
+// Fsync store the ref records to the metadata.
+func (fh *PackedRefsFileHandler) Fsync(ctx context.Context, flags uint32) syscall.Errno {
+	log.WithFields(
+		log.Fields{
+			"flags": flags,
+			"inode": fh.file.inode,
+		}).Debug("Fsync")
+
+	fh.file.mu.Lock()
+	defer fh.file.mu.Unlock()
+
+	return fh.file.sync(ctx)
+}
+
+// Flush will be called when file closed. (maybe called many times)
+// We just do fsync here...
+func (fh *PackedRefsFileHandler) Flush(ctx context.Context) syscall.Errno {
+	log.WithFields(
+		log.Fields{
+			"inode": fh.file.inode,
+		}).Debug("Flush")
+
+	fh.file.mu.Lock()
+	defer fh.file.mu.Unlock()
+
+	return fh.file.sync(ctx)
+}
+
+// Release file handler release
+func (fh *PackedRefsFileHandler) Release(ctx context.Context) syscall.Errno {
+	log.WithFields(
+		log.Fields{
+			"inode": fh.file.inode,
+		}).Debug("Release")
+
+	err := fh.file.Release(ctx)
+	if err != nil {
+		return syscall.ENOENT
+	}
+
+	return syscall.F_OK
+}
+
+// Setattr set the attr to the metadata, and truncate the buffer if the size is set
+func (fh *PackedRefsFileHandler) Setattr(ctx context.Context, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	fh.file.mu.Lock()
+	defer fh.file.mu.Unlock()
+
+	attr, eno := fh.file.Meta.Getattr(ctx, fh.file.inode)
+	if eno != syscall.F_OK {
+		return eno
+	}
+	if atime, ok := in.GetATime(); ok {
+		metadata.SetTime(&attr.Atime, &attr.Atimensec, atime)
+	}
+	if ctime, ok := in.GetCTime(); ok {
+		metadata.SetTime(&attr.Ctime, &attr.Ctimensec, ctime)
+	}
+	if uid, ok := in.GetUID(); ok {
+		attr.Uid = uid
+	}
+	if gid, ok := in.GetGID(); ok {
+		attr.Gid = gid
+	}
+	if mode, ok := in.GetMode(); ok {
+		attr.Mode = uint16(mode)
+	}
+	if size, ok := in.GetSize(); ok {
+		if size < uint64(len(fh.file.buf)) {
+			fh.file.buf = fh.file.buf[:size]
+		} else {
+			fh.file.buf = append(fh.file.buf, make([]byte, size-uint64(len(fh.file.buf)))...)
+		}
+		fh.file.clean = false
+		attr.Length = size
+	}
+	err := fh.file.Meta.SetattrDirectly(ctx, fh.file.inode, attr)
+	if err != nil {
+		return syscall.EIO
+	}
+	metadata.ToAttrOut(fh.file.inode, attr, &out.Attr)
+	return syscall.F_OK
+}
+
+// Getattr get the attr from the metadata with the size of the buffer
+func (fh *PackedRefsFileHandler) Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno {
+	fh.file.mu.Lock()
+	defer fh.file.mu.Unlock()
+
+	attr, eno := fh.file.Meta.Getattr(ctx, fh.file.inode)
+	if eno != 0 {
+		return eno
+	}
+	attr.Length = uint64(len(fh.file.buf))
+	metadata.ToAttrOut(fh.file.inode, attr, &out.Attr)
+	return syscall.F_OK
+}
@@ -0,0 +1,79 @@
+package gitfs
+
+import (
+	"context"
+	"strings"
+
+	"github.com/adlternative/tinygitfs/pkg/metadata"
+	log "github.com/sirupsen/logrus"
+)
+
+// refPath split the path of a file relative to the mount point into the
+// repository and the ref name, ok is false if it is not in a .git directory
+// or it is a lock file
+func refPath(filePath string) (repo string, ref string, ok bool) {
+	if strings.HasSuffix(filePath, lockSuffix) {
+		return "", "", false
+	}
+	elems := strings.Split(filePath, "/")
+	for i, elem := range elems {
+		if elem == gitDirName && i+1 < len(elems) {
+			return strings.Join(elems[:i], "/"), strings.Join(elems[i+1:], "/"), true
+		}
+	}
+	return "", "", false
+}
+
+// publishRefEvent publish the change of the ref file at filePath,
+// which is only logged if it fails, since the ref has been changed
+func (gitFs *GitFs) publishRefEvent(ctx context.Context, filePath string, old string, new string) {
+	repo, ref, ok := refPath(filePath)
+	if !ok {
+		return
+	}
+	event := &metadata.RefEvent{
+		Repo: repo,
+		Ref:  ref,
+		Old:  strings.TrimSpace(old),
+		New:  strings.TrimSpace(new),
+	}
+	if err := gitFs.DefaultDataSource.Meta.PublishRefEvent(ctx, event); err != nil {
+		log.WithFields(
+			log.Fields{
+				"repo": repo,
+				"ref":  ref,
+			}).WithError(err).Warn("publish ref event failed")
+	}
+}
+
+// isRef return true if the file name in the directory is stored as a ref
+func (node *Node) isRef(name string) bool {
+	switch node.gitfs.backend(childGitPath(node.gitPath, name, metadata.TypeFile), metadata.TypeFile) {
+	case RefBackend, SymRefBackend:
+		return true
+	default:
+		return false
+	}
+}
+
+// refValue return the value of the ref file name in the directory, "" if it does not exist
+func (node *Node) refValue(ctx context.Context, name string) string {
+	dentry, find, err := node.gitfs.DefaultDataSource.Meta.GetDentry(ctx, node.inode, name)
+	if err != nil || !find || dentry.Typ != metadata.TypeFile {
+		return ""
+	}
+	value, _, err := node.gitfs.DefaultDataSource.Meta.RefGet(ctx, dentry.Ino)
+	if err != nil {
+		return ""
+	}
+	return value
+}
+
+// childPath return the path of the file name in the directory relative to the mount point
+func (node *Node) childPath(name string) string {
+	dirPath := node.Path(nil)
+	if dirPath == "" {
+		return name
+	}
+	return dirPath + "/" + name
+}
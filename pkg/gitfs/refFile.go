@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"github.com/adlternative/tinygitfs/pkg/datasource"
 	"github.com/adlternative/tinygitfs/pkg/metadata"
-	"github.com/go-redis/redis/v8"
 	"github.com/hanwen/go-fuse/v2/fuse"
 	log "github.com/sirupsen/logrus"
 	"sync"
@@ -22,21 +21,26 @@ type RefFile struct {
 
 	buf   []byte
 	clean bool
+	// synced is the value stored in the metadata
+	synced string
+	// node is the fuse node the file is opened from, which locate the ref
+	node *Node
 }
 
 type RefFileHandler struct {
 	file *RefFile
 }
 
-func NewRefFile(ctx context.Context, inode metadata.Ino, dataSource *datasource.DataSource, gitFs *GitFs) (*RefFile, error) {
+func NewRefFile(ctx context.Context, inode metadata.Ino, dataSource *datasource.DataSource, gitFs *GitFs) (File, error) {
 	var buf []byte
-	data, err := dataSource.Meta.RefGet(ctx, inode)
-	if err == nil {
+	data, find, err := dataSource.Meta.RefGet(ctx, inode)
+	if err != nil {
+		return nil, err
+	}
+	if find {
 		buf = []byte(data)
-	} else if err == redis.Nil {
-		buf = make([]byte, 0, 36)
 	} else {
-		return nil, err
+		buf = make([]byte, 0, 36)
 	}
 
 	return &RefFile{
@@ -47,14 +51,16 @@ func NewRefFile(ctx context.Context, inode metadata.Ino, dataSource *datasource.
 		releaseOnce: &sync.Once{},
 		buf:         buf,
 		clean:       true,
+		synced:      data,
 	}, nil
 }
 
-func (file *RefFile) NewFileHandler() FileHandler {
+func (file *RefFile) NewFileHandler(node *Node, flags uint32) FileHandler {
 	file.mu.Lock()
 	defer file.mu.Unlock()
 
 	file.ref++
+	file.node = node
 
 	return &RefFileHandler{
 		file: file,
@@ -86,6 +92,38 @@ func (file *RefFile) Release(ctx context.Context) error {
 	return file.gitfs.ReleaseFile(ctx, file.inode)
 }
 
+// sync store the buffer and the file size to the metadata,
+// and publish the ref event if the value is changed
+func (file *RefFile) sync(ctx context.Context) syscall.Errno {
+	if !file.clean {
+		err := file.DataSource.Meta.RefSet(ctx, file.inode, string(file.buf))
+		if err != nil {
+			return syscall.EIO
+		}
+		file.clean = true
+	}
+	if value := string(file.buf); value != file.synced {
+		if file.node != nil {
+			file.gitfs.publishRefEvent(ctx, file.node.Path(nil), file.synced, value)
+		}
+		file.synced = value
+	}
+
+	// update file size
+	attr, eno := file.DataSource.Meta.Getattr(ctx, file.inode)
+	if eno != syscall.F_OK {
+		return eno
+	}
+	attr.Length = uint64(len(file.buf))
+
+	err := file.Meta.SetattrDirectly(ctx, file.inode, attr)
+	if err != nil {
+		return syscall.EIO
+	}
+
+	return syscall.F_OK
+}
+
 // Write will write the dest data to file begin at offset
 func (fh *RefFileHandler) Write(ctx context.Context, data []byte, off int64) (written uint32, errno syscall.Errno) {
 	log.WithFields(
@@ -146,27 +184,7 @@ func (fh *RefFileHandler) Fsync(ctx context.Context, flags uint32) syscall.Errno
 	fh.file.mu.Lock()
 	defer fh.file.mu.Unlock()
 
-	if !fh.file.clean {
-		err := fh.file.DataSource.Meta.RefSet(ctx, fh.file.inode, string(fh.file.buf))
-		if err != nil {
-			return syscall.EIO
-		}
-		fh.file.clean = true
-	}
-
-	// update file size
-	attr, eno := fh.file.DataSource.Meta.Getattr(ctx, fh.file.inode)
-	if eno != syscall.F_OK {
-		return eno
-	}
-	attr.Length = uint64(len(fh.file.buf))
-
-	err := fh.file.Meta.SetattrDirectly(ctx, fh.file.inode, attr)
-	if err != nil {
-		return syscall.EIO
-	}
-
-	return syscall.F_OK
+	return fh.file.sync(ctx)
 }
 
 // Flush will be called when file closed. (maybe called many times)
@@ -180,24 +198,21 @@ func (fh *RefFileHandler) Flush(ctx context.Context) syscall.Errno {
 	fh.file.mu.Lock()
 	defer fh.file.mu.Unlock()
 
-	if !fh.file.clean {
-		err := fh.file.DataSource.Meta.RefSet(ctx, fh.file.inode, string(fh.file.buf))
-		if err != nil {
-			return syscall.EIO
-		}
-		fh.file.clean = true
-	}
+	return fh.file.sync(ctx)
+}
 
-	// update file size
-	attr, eno := fh.file.DataSource.Meta.Getattr(ctx, fh.file.inode)
-	if eno != syscall.F_OK {
-		return eno
-	}
-	attr.Length = uint64(len(fh.file.buf))
+// Release drop the reference of the handler to the ref file, the value cached
+// by the file is dropped with the last reference, so the ref updated by other
+// mounts is read from the metadata again when it is opened next time
+func (fh *RefFileHandler) Release(ctx context.Context) syscall.Errno {
+	log.WithFields(
+		log.Fields{
+			"inode": fh.file.inode,
+		}).Debug("Release")
 
-	err := fh.file.Meta.SetattrDirectly(ctx, fh.file.inode, attr)
+	err := fh.file.Release(ctx)
 	if err != nil {
-		return syscall.EIO
+		return syscall.ENOENT
 	}
 
 	return syscall.F_OK
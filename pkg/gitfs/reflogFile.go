@@ -0,0 +1,345 @@
+package gitfs
+
+import (
+	"context"
+	"fmt"
+	"github.com/adlternative/tinygitfs/pkg/datasource"
+	"github.com/adlternative/tinygitfs/pkg/metadata"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"syscall"
+)
+
+// ReflogFile is a reflog, which is stored as a list of entries in the metadata.
+// Every write at the end of the file is appended as an entry in one round trip,
+// other writes rewrite the whole reflog, which only happen when it is expired.
+// A reflog written by the page pool before is read from its chunks until it is
+// written, see migrate.
+type ReflogFile struct {
+	inode metadata.Ino
+	*datasource.DataSource
+	gitfs       *GitFs
+	mu          *sync.Mutex
+	ref         int
+	releaseOnce *sync.Once
+
+	// migrated is true once the file has no chunks left, see migrate
+	migrated bool
+}
+
+type ReflogFileHandler struct {
+	file *ReflogFile
+	// append is true if the file is opened with O_APPEND, whose writes are
+	// always at the end, so they are appended without checking the offset
+	append bool
+	// buf is the content read by the last read from the beginning
+	buf []byte
+}
+
+func NewReflogFile(ctx context.Context, inode metadata.Ino, dataSource *datasource.DataSource, gitFs *GitFs) (File, error) {
+	return &ReflogFile{
+		inode:       inode,
+		DataSource:  dataSource,
+		gitfs:       gitFs,
+		mu:          &sync.Mutex{},
+		releaseOnce: &sync.Once{},
+	}, nil
+}
+
+func (file *ReflogFile) NewFileHandler(node *Node, flags uint32) FileHandler {
+	file.mu.Lock()
+	defer file.mu.Unlock()
+
+	file.ref++
+
+	return &ReflogFileHandler{
+		file:   file,
+		append: flags&syscall.O_APPEND != 0,
+	}
+}
+
+func (file *ReflogFile) UnRef(release func()) error {
+	file.mu.Lock()
+	defer file.mu.Unlock()
+
+	file.ref--
+	if file.ref < 0 {
+		log.Errorf("file ref down to negative value: %d", file.ref)
+		return fmt.Errorf("file ref down to negative value: %d", file.ref)
+	} else if file.ref == 0 {
+		file.releaseOnce.Do(release)
+	}
+	return nil
+}
+
+func (file *ReflogFile) Ref() int {
+	file.mu.Lock()
+	defer file.mu.Unlock()
+
+	return file.ref
+}
+
+func (file *ReflogFile) Release(ctx context.Context) error {
+	return file.gitfs.ReleaseFile(ctx, file.inode)
+}
+
+// content return the reflog, or the content of the chunks of the file if it
+// was written by the page pool before, whose length is kept in its attr
+func (file *ReflogFile) content(ctx context.Context) ([]byte, syscall.Errno) {
+	content, err := file.Meta.ReflogGet(ctx, file.inode)
+	if err != nil {
+		return nil, syscall.EIO
+	}
+	if len(content) > 0 || file.migrated {
+		return content, syscall.F_OK
+	}
+	attr, eno := file.Meta.Getattr(ctx, file.inode)
+	if eno != syscall.F_OK {
+		return nil, eno
+	}
+	if attr.Length == 0 {
+		return content, syscall.F_OK
+	}
+	return readLegacyContent(ctx, file.DataSource, file.inode, attr.Length)
+}
+
+// migrate store the content of the chunks of the file written by the page
+// pool before as the entries of the reflog, and drop the chunks and clear the
+// length in the attr, which is done before the reflog is written the first
+// time the file is opened
+func (file *ReflogFile) migrate(ctx context.Context) syscall.Errno {
+	if file.migrated {
+		return syscall.F_OK
+	}
+	attr, eno := file.Meta.Getattr(ctx, file.inode)
+	if eno != syscall.F_OK {
+		return eno
+	}
+	if attr.Length > 0 {
+		length, err := file.Meta.ReflogLength(ctx, file.inode)
+		if err != nil {
+			return syscall.EIO
+		}
+		// the content may be stored already by a migration which failed
+		// before the chunks are dropped
+		if length == 0 {
+			content, eno := readLegacyContent(ctx, file.DataSource, file.inode, attr.Length)
+			if eno != syscall.F_OK {
+				return eno
+			}
+			if err := file.Meta.ReflogSet(ctx, file.inode, content); err != nil {
+				return syscall.EIO
+			}
+		}
+		if err := dropLegacyContent(ctx, file.DataSource, file.inode); err != nil {
+			return syscall.EIO
+		}
+		attr.Length = 0
+		if err := file.Meta.SetattrDirectly(ctx, file.inode, attr); err != nil {
+			return syscall.EIO
+		}
+	}
+	file.migrated = true
+	return syscall.F_OK
+}
+
+// resize change the length of the reflog, the new part is filled with zero
+func (file *ReflogFile) resize(ctx context.Context, size uint64) error {
+	content, err := file.Meta.ReflogGet(ctx, file.inode)
+	if err != nil {
+		return err
+	}
+	if size < uint64(len(content)) {
+		content = content[:size]
+	} else {
+		content = append(content, make([]byte, size-uint64(len(content)))...)
+	}
+	return file.Meta.ReflogSet(ctx, file.inode, content)
+}
+
+var _ = (fs.FileHandle)((*ReflogFileHandler)(nil))
+var _ = (fs.FileWriter)((*ReflogFileHandler)(nil))
+var _ = (fs.FileReader)((*ReflogFileHandler)(nil))
+var _ = (fs.FileFlusher)((*ReflogFileHandler)(nil))
+var _ = (fs.FileFsyncer)((*ReflogFileHandler)(nil))
+var _ = (fs.FileReleaser)((*ReflogFileHandler)(nil))
+var _ = (fs.FileGetattrer)((*ReflogFileHandler)(nil))
+var _ = (fs.FileSetattrer)((*ReflogFileHandler)(nil))
+
+// Write append the data to the reflog if it is written at the end,
+// otherwise the reflog is rewritten with the data at offset
+func (fh *ReflogFileHandler) Write(ctx context.Context, data []byte, off int64) (written uint32, errno syscall.Errno) {
+	log.WithFields(
+		log.Fields{
+			"length": len(data),
+			"offset": off,
+			"append": fh.append,
+			"inode":  fh.file.inode,
+		}).Debug("Write")
+
+	fh.file.mu.Lock()
+	defer fh.file.mu.Unlock()
+
+	if eno := fh.file.migrate(ctx); eno != syscall.F_OK {
+		return 0, eno
+	}
+	if !fh.append {
+		length, err := fh.file.Meta.ReflogLength(ctx, fh.file.inode)
+		if err != nil {
+			return 0, syscall.EIO
+		}
+		if uint64(off) != length {
+			content, err := fh.file.Meta.ReflogGet(ctx, fh.file.inode)
+			if err != nil {
+				return 0, syscall.EIO
+			}
+			end := off + int64(len(data))
+			if int64(len(content)) < end {
+				content = append(content, make([]byte, end-int64(len(content)))...)
+			}
+			copy(content[off:end], data)
+			if err := fh.file.Meta.ReflogSet(ctx, fh.file.inode, content); err != nil {
+				return 0, syscall.EIO
+			}
+			fh.buf = nil
+			return uint32(len(data)), syscall.F_OK
+		}
+	}
+
+	if err := fh.file.Meta.ReflogAppend(ctx, fh.file.inode, data); err != nil {
+		return 0, syscall.EIO
+	}
+	fh.buf = nil
+	return uint32(len(data)), syscall.F_OK
+}
+
+// Read read the reflog from the metadata when it is read from the beginning,
+// and the following reads of the handler are served by the content read
+func (fh *ReflogFileHandler) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	log.WithFields(
+		log.Fields{
+			"dest length": len(dest),
+			"offset":      off,
+			"inode":       fh.file.inode,
+		}).Debug("Read")
+
+	fh.file.mu.Lock()
+	defer fh.file.mu.Unlock()
+
+	if off == 0 || fh.buf == nil {
+		content, eno := fh.file.content(ctx)
+		if eno != syscall.F_OK {
+			return nil, eno
+		}
+		fh.buf = content
+	}
+	if off >= int64(len(fh.buf)) {
+		return fuse.ReadResultData(nil), syscall.F_OK
+	}
+	n := copy(dest, fh.buf[off:])
+	return fuse.ReadResultData(dest[:n]), syscall.F_OK
+}
+
+// Fsync do nothing, since the writes are stored to the metadata directly.
+func (fh *ReflogFileHandler) Fsync(ctx context.Context, flags uint32) syscall.Errno {
+	return syscall.F_OK
+}
+
+// Flush do nothing, since the writes are stored to the metadata directly.
+func (fh *ReflogFileHandler) Flush(ctx context.Context) syscall.Errno {
+	return syscall.F_OK
+}
+
+// Release file handler release
+func (fh *ReflogFileHandler) Release(ctx context.Context) syscall.Errno {
+	log.WithFields(
+		log.Fields{
+			"inode": fh.file.inode,
+		}).Debug("Release")
+
+	err := fh.file.Release(ctx)
+	if err != nil {
+		return syscall.ENOENT
+	}
+
+	return syscall.F_OK
+}
+
+// Setattr set the attr to the metadata, and resize the reflog if the size is set
+func (fh *ReflogFileHandler) Setattr(ctx context.Context, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	fh.file.mu.Lock()
+	defer fh.file.mu.Unlock()
+
+	if _, ok := in.GetSize(); ok {
+		if eno := fh.file.migrate(ctx); eno != syscall.F_OK {
+			return eno
+		}
+	}
+	attr, eno := fh.file.Meta.Getattr(ctx, fh.file.inode)
+	if eno != syscall.F_OK {
+		return eno
+	}
+	if atime, ok := in.GetATime(); ok {
+		metadata.SetTime(&attr.Atime, &attr.Atimensec, atime)
+	}
+	if ctime, ok := in.GetCTime(); ok {
+		metadata.SetTime(&attr.Ctime, &attr.Ctimensec, ctime)
+	}
+	if uid, ok := in.GetUID(); ok {
+		attr.Uid = uid
+	}
+	if gid, ok := in.GetGID(); ok {
+		attr.Gid = gid
+	}
+	if mode, ok := in.GetMode(); ok {
+		attr.Mode = uint16(mode)
+	}
+	if size, ok := in.GetSize(); ok {
+		if err := fh.file.resize(ctx, size); err != nil {
+			return syscall.EIO
+		}
+		fh.buf = nil
+	}
+	err := fh.file.Meta.SetattrDirectly(ctx, fh.file.inode, attr)
+	if err != nil {
+		return syscall.EIO
+	}
+	if eno := fh.file.gitfs.setReflogLength(ctx, fh.file.inode, attr); eno != syscall.F_OK {
+		return eno
+	}
+	metadata.ToAttrOut(fh.file.inode, attr, &out.Attr)
+	return syscall.F_OK
+}
+
+// Getattr get the attr from the metadata with the length of the reflog
+func (fh *ReflogFileHandler) Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno {
+	fh.file.mu.Lock()
+	defer fh.file.mu.Unlock()
+
+	attr, eno := fh.file.Meta.Getattr(ctx, fh.file.inode)
+	if eno != 0 {
+		return eno
+	}
+	if eno := fh.file.gitfs.setReflogLength(ctx, fh.file.inode, attr); eno != syscall.F_OK {
+		return eno
+	}
+	metadata.ToAttrOut(fh.file.inode, attr, &out.Attr)
+	return syscall.F_OK
+}
+
+// setReflogLength set the length of attr to the length of the reflog, which
+// is not kept in the attr of the inode, since an append does not read it.
+// The attr keep the length of a reflog written by the page pool before until
+// it is migrated, see ReflogFile.migrate, which is 0 otherwise.
+func (gitFs *GitFs) setReflogLength(ctx context.Context, inode metadata.Ino, attr *metadata.Attr) syscall.Errno {
+	length, err := gitFs.DefaultDataSource.Meta.ReflogLength(ctx, inode)
+	if err != nil {
+		return syscall.EIO
+	}
+	if length > 0 {
+		attr.Length = length
+	}
+	return syscall.F_OK
+}
@@ -28,7 +28,7 @@ type RegularFile struct {
 	gitfs       *GitFs
 }
 
-func NewRegularFile(ctx context.Context, inode metadata.Ino, dataSource *datasource.DataSource, gitFs *GitFs) (*RegularFile, error) {
+func NewRegularFile(ctx context.Context, inode metadata.Ino, dataSource *datasource.DataSource, gitFs *GitFs) (File, error) {
 	pagePool, err := page.NewPagePool(ctx, dataSource, inode)
 	if err != nil {
 		return nil, err
@@ -61,7 +61,7 @@ func NewRegularFile(ctx context.Context, inode metadata.Ino, dataSource *datasou
 	}, nil
 }
 
-func (file *RegularFile) NewFileHandler() FileHandler {
+func (file *RegularFile) NewFileHandler(node *Node, flags uint32) FileHandler {
 	file.mu.Lock()
 	defer file.mu.Unlock()
 
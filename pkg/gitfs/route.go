@@ -0,0 +1,225 @@
+package gitfs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/adlternative/tinygitfs/pkg/metadata"
+)
+
+// Route store the files in .git directories matching Pattern by Backend
+type Route struct {
+	// Pattern is a slash-separated glob relative to the .git directory,
+	// "**" matches any number of directories, e.g. logs/**
+	Pattern string
+	Backend FileBackend
+}
+
+// ParseRoute parse a route in the form "pattern=class", e.g. "index=local"
+func ParseRoute(route string) (Route, error) {
+	idx := strings.LastIndexByte(route, '=')
+	if idx <= 0 {
+		return Route{}, fmt.Errorf("route %q is not in the form pattern=class", route)
+	}
+	pattern := strings.Trim(route[:idx], "/")
+	for _, elem := range strings.Split(pattern, "/") {
+		if _, err := path.Match(elem, ""); err != nil {
+			return Route{}, fmt.Errorf("bad pattern of route %q: %w", route, err)
+		}
+	}
+	backend, err := ParseFileBackend(route[idx+1:])
+	if err != nil {
+		return Route{}, fmt.Errorf("bad route %q: %w", route, err)
+	}
+	return Route{
+		Pattern: pattern,
+		Backend: backend,
+	}, nil
+}
+
+func (route Route) String() string {
+	return route.Pattern + "=" + route.Backend.String()
+}
+
+// Match return true if gitPath or the file it is the temporary file of match
+// the pattern of the route, so that a file is renamed from its temporary file
+// in the same backend
+func (route Route) Match(gitPath string) bool {
+	pattern := strings.Split(route.Pattern, "/")
+	if matchElems(pattern, strings.Split(gitPath, "/")) {
+		return true
+	}
+	for _, suffix := range tempSuffixes {
+		target := strings.TrimSuffix(gitPath, suffix)
+		if target != gitPath && matchElems(pattern, strings.Split(target, "/")) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchElems(pattern []string, elems []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(elems); i++ {
+				if matchElems(pattern[1:], elems[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(elems) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], elems[0]); !ok {
+			return false
+		}
+		pattern, elems = pattern[1:], elems[1:]
+	}
+	return len(elems) == 0
+}
+
+// lockSuffix is the suffix of the lock files, which git write a file in
+// before it is renamed into place
+const lockSuffix = ".lock"
+
+// tempSuffixes are the suffixes of the temporary files of git, the lock files
+// and packed-refs.new
+var tempSuffixes = []string{lockSuffix, ".new"}
+
+// RouteTable is a PathClassifier which choose the backend by the first
+// matched route, files matching no route are stored in the object storage
+type RouteTable []Route
+
+// DefaultRoutes store HEAD, FETCH_HEAD, ORIG_HEAD as symbolic refs, everything
+// under refs as refs, packed-refs as ref records, everything under logs as
+// reflogs, and loose objects by their oid, they are a part of the route table
+// stored by the first mount of a volume, see LoadRouteTable
+var DefaultRoutes = RouteTable{
+	{Pattern: "HEAD", Backend: SymRefBackend},
+	{Pattern: "FETCH_HEAD", Backend: SymRefBackend},
+	{Pattern: "ORIG_HEAD", Backend: SymRefBackend},
+	{Pattern: "refs/**", Backend: RefBackend},
+	{Pattern: "packed-refs", Backend: PackedRefsBackend},
+	{Pattern: "logs/**", Backend: ReflogBackend},
+	{Pattern: "objects/??/*", Backend: LooseObjectBackend},
+}
+
+// NewRouteTable parse the routes, which are tried before the default routes
+func NewRouteTable(routes []string) (RouteTable, error) {
+	table, err := parseRoutes(routes)
+	if err != nil {
+		return nil, err
+	}
+	return append(table, DefaultRoutes...), nil
+}
+
+func parseRoutes(routes []string) (RouteTable, error) {
+	table := make(RouteTable, 0, len(routes)+len(DefaultRoutes))
+	for _, r := range routes {
+		route, err := ParseRoute(r)
+		if err != nil {
+			return nil, err
+		}
+		table = append(table, route)
+	}
+	return table, nil
+}
+
+// routesSetting is the setting of the volume which store its route table
+const routesSetting = "routes"
+
+// LoadRouteTable return the route table of the volume, which is stored by
+// the first mount from routes and the default routes, so that all the mounts
+// store a file by the same backend even if the default routes are changed.
+// The routes of a later mount must be the stored ones if any is given.
+func LoadRouteTable(ctx context.Context, meta metadata.Meta, routes []string) (RouteTable, error) {
+	table, err := NewRouteTable(routes)
+	if err != nil {
+		return nil, err
+	}
+	value, err := json.Marshal(table.Strings())
+	if err != nil {
+		return nil, err
+	}
+	stored, err := meta.InitSetting(ctx, routesSetting, value)
+	if err != nil {
+		return nil, fmt.Errorf("store the routes of the volume failed with %w", err)
+	}
+	storedTable, err := parseStoredRoutes(stored)
+	if err != nil {
+		return nil, err
+	}
+	if len(routes) > 0 && !table.equal(storedTable) {
+		return nil, fmt.Errorf("routes %q mismatch the routes %q of the volume", table.Strings(), storedTable.Strings())
+	}
+	return storedTable, nil
+}
+
+// VolumeRouteTable return the route table stored by the first mount of the
+// volume, or the default routes if it has not been mounted yet
+func VolumeRouteTable(ctx context.Context, meta metadata.Meta) (RouteTable, error) {
+	stored, err := meta.GetSetting(ctx, routesSetting)
+	if err != nil {
+		return nil, fmt.Errorf("get the routes of the volume failed with %w", err)
+	}
+	if stored == nil {
+		return NewRouteTable(nil)
+	}
+	return parseStoredRoutes(stored)
+}
+
+func parseStoredRoutes(stored []byte) (RouteTable, error) {
+	var routes []string
+	if err := json.Unmarshal(stored, &routes); err != nil {
+		return nil, fmt.Errorf("bad routes of the volume: %w", err)
+	}
+	table, err := parseRoutes(routes)
+	if err != nil {
+		return nil, fmt.Errorf("bad routes of the volume: %w", err)
+	}
+	return table, nil
+}
+
+// Strings return the routes in the form "pattern=class"
+func (table RouteTable) Strings() []string {
+	routes := make([]string, len(table))
+	for i, route := range table {
+		routes[i] = route.String()
+	}
+	return routes
+}
+
+func (table RouteTable) equal(other RouteTable) bool {
+	if len(table) != len(other) {
+		return false
+	}
+	for i := range table {
+		if table[i] != other[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (table RouteTable) Classify(gitPath string) FileBackend {
+	for _, route := range table {
+		if route.Match(gitPath) {
+			return route.Backend
+		}
+	}
+	return PageBackend
+}
+
+// uses return true if any route store files by backend
+func (table RouteTable) uses(backend FileBackend) bool {
+	for _, route := range table {
+		if route.Backend == backend {
+			return true
+		}
+	}
+	return false
+}
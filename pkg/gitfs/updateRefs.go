@@ -0,0 +1,35 @@
+package gitfs
+
+import (
+	"context"
+	"fmt"
+	"path"
+
+	"github.com/adlternative/tinygitfs/pkg/metadata"
+)
+
+// UpdateRefs apply the updates to the refs of the repository at repo by
+// metadata.Meta.UpdateRefs, which store the refs as ref records, packed-refs
+// as its ref records and delete the reflogs by their inodes, so the routes of
+// the volume must store the refs, packed-refs and the reflogs of the deleted
+// refs that way, a reflog stored by the page pool is deleted with its chunks.
+func UpdateRefs(ctx context.Context, meta metadata.Meta, repo string, updates []*metadata.RefUpdate) error {
+	routes, err := VolumeRouteTable(ctx, meta)
+	if err != nil {
+		return err
+	}
+	if backend := routes.Classify("packed-refs"); backend != PackedRefsBackend {
+		return fmt.Errorf("packed-refs is routed to %s instead of %s", backend, PackedRefsBackend)
+	}
+	for _, update := range updates {
+		if backend := routes.Classify(update.Ref); backend != RefBackend {
+			return fmt.Errorf("ref %s is routed to %s instead of %s", update.Ref, backend, RefBackend)
+		}
+		switch backend := routes.Classify(path.Join("logs", update.Ref)); backend {
+		case ReflogBackend, PageBackend:
+		default:
+			return fmt.Errorf("reflog of ref %s is routed to %s, which cannot be deleted with it", update.Ref, backend)
+		}
+	}
+	return meta.UpdateRefs(ctx, repo, updates)
+}
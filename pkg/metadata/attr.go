@@ -2,7 +2,6 @@ package metadata
 
 import (
 	"context"
-	"encoding/json"
 	"github.com/hanwen/go-fuse/v2/fuse"
 	"syscall"
 )
@@ -33,6 +32,7 @@ type Attr struct {
 	Nlink     uint32 `json:"nlink,omitempty"`     // number of links (sub-directories or hardlinks)
 	Length    uint64 `json:"length,omitempty"`    // length of regular file
 	Rdev      uint32 `json:"rdev,omitempty"`      // device number
+	Parent    Ino    `json:"parent,omitempty"`    // parent inode of a directory
 }
 
 // SMode is the file mode including type and unix permission.
@@ -125,41 +125,28 @@ func GetFiletype(mode uint16) uint8 {
 }
 
 // Getattr return the attributes of the specified inode
-func (r *RedisMeta) Getattr(ctx context.Context, ino Ino) (*Attr, syscall.Errno) {
-	attr := &Attr{}
-	data, err := r.rdb.Get(ctx, inodeKey(ino)).Bytes()
-	if err != nil {
-		return nil, errno(err)
-	}
-	err = json.Unmarshal(data, attr)
+func (m *baseMeta) Getattr(ctx context.Context, ino Ino) (*Attr, syscall.Errno) {
+	var attr *Attr
+	err := m.engine.view(ctx, func(tx metaTxn) error {
+		var err error
+		attr, err = tx.getattr(ino)
+		return err
+	})
 	if err != nil {
 		return nil, errno(err)
 	}
 	return attr, 0
 }
 
-func (r *RedisMeta) SetattrDirectly(ctx context.Context, ino Ino, attr *Attr) error {
-	jsonAttr, err := json.Marshal(&attr)
-	if err != nil {
-		return err
-	}
-	_, err = r.rdb.Set(ctx, inodeKey(ino), jsonAttr, 0).Result()
-
-	if err != nil {
-		return err
-	}
-	return nil
+func (m *baseMeta) SetattrDirectly(ctx context.Context, ino Ino, attr *Attr) error {
+	return m.engine.txn(ctx, func(tx metaTxn) error {
+		return tx.setattr(ino, attr)
+	})
 }
 
-func (r *RedisMeta) Ref(ctx context.Context, inode Ino) syscall.Errno {
-	attr, eno := r.Getattr(ctx, inode)
-	if eno != syscall.F_OK {
-		return eno
-	}
-	attr.Nlink++
-	err := r.SetattrDirectly(ctx, inode, attr)
-	if err != nil {
-		return errno(err)
-	}
-	return syscall.F_OK
+func (m *baseMeta) Ref(ctx context.Context, inode Ino) syscall.Errno {
+	err := m.engine.txn(ctx, func(tx metaTxn) error {
+		return ref(tx, inode)
+	})
+	return errno(err)
 }
@@ -0,0 +1,271 @@
+package metadata
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func init() {
+	Register("bolt", func(url string) (Meta, error) {
+		return NewBoltMeta(url)
+	})
+}
+
+var _ Meta = (*BoltMeta)(nil)
+
+// metaBucket is the bolt bucket which holds all the keys,
+// hashes such as d{inode} and c{inode} are nested buckets of it.
+var metaBucket = []byte("tinygitfs")
+
+// BoltMeta is a single-node metadata engine stored in a local bolt database file
+type BoltMeta struct {
+	*baseMeta
+	db *bolt.DB
+}
+
+// NewBoltMeta create a new meta instance with url like bolt:///var/lib/tinygitfs/meta.db
+func NewBoltMeta(url string) (*BoltMeta, error) {
+	path := strings.TrimPrefix(url, "bolt://")
+	if path == "" {
+		return nil, fmt.Errorf("invalid bolt url %s: missing database path", url)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if errors.Is(err, bolt.ErrTimeout) {
+		// bolt hold an exclusive lock of the file while it is open
+		return nil, fmt.Errorf("open %s: the bolt database is in use by another process, e.g. a mount of it: %w", path, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(metaBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltMeta{
+		baseMeta: newBaseMeta(&kvEngine{client: &boltClient{db: db, broker: newBroker()}}),
+		db:       db,
+	}, nil
+}
+
+// Close release the database file
+func (b *BoltMeta) Close() error {
+	return b.db.Close()
+}
+
+// boltClient deliver the published messages only in this process,
+// since the database can not be opened by others
+type boltClient struct {
+	db *bolt.DB
+	*broker
+}
+
+func (c *boltClient) txn(ctx context.Context, fn func(tx kvTxn) error) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		return fn(&boltTxn{bucket: tx.Bucket(metaBucket)})
+	})
+}
+
+// batch is the same as txn, since a bolt transaction has no round trip
+func (c *boltClient) batch(ctx context.Context, fn func(tx kvTxn) error) error {
+	return c.txn(ctx, fn)
+}
+
+func (c *boltClient) view(ctx context.Context, fn func(tx kvTxn) error) error {
+	return c.db.View(func(tx *bolt.Tx) error {
+		return fn(&boltTxn{bucket: tx.Bucket(metaBucket)})
+	})
+}
+
+type boltTxn struct {
+	bucket *bolt.Bucket
+}
+
+// copyBytes copy value out of the bolt mmap, which is invalid after the transaction
+func copyBytes(value []byte) []byte {
+	if value == nil {
+		return nil
+	}
+	return append([]byte{}, value...)
+}
+
+func (tx *boltTxn) get(key string) ([]byte, error) {
+	return copyBytes(tx.bucket.Get([]byte(key))), nil
+}
+
+func (tx *boltTxn) set(key string, value []byte) error {
+	return tx.bucket.Put([]byte(key), value)
+}
+
+func (tx *boltTxn) del(keys ...string) error {
+	for _, key := range keys {
+		var err error
+		if tx.bucket.Bucket([]byte(key)) != nil {
+			err = tx.bucket.DeleteBucket([]byte(key))
+		} else {
+			err = tx.bucket.Delete([]byte(key))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tx *boltTxn) incrBy(key string, value int64) (int64, error) {
+	var cur int64
+	if data := tx.bucket.Get([]byte(key)); data != nil {
+		var err error
+		cur, err = strconv.ParseInt(string(data), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("value of %s is not an integer: %w", key, err)
+		}
+	}
+	cur += value
+	return cur, tx.bucket.Put([]byte(key), []byte(strconv.FormatInt(cur, 10)))
+}
+
+func (tx *boltTxn) incr(key string, value int64) error {
+	_, err := tx.incrBy(key, value)
+	return err
+}
+
+// rpush store the values of a list in a nested bucket keyed by their sequence
+func (tx *boltTxn) rpush(key string, value []byte) error {
+	list, err := tx.bucket.CreateBucketIfNotExists([]byte(key))
+	if err != nil {
+		return err
+	}
+	seq, err := list.NextSequence()
+	if err != nil {
+		return err
+	}
+	index := make([]byte, 8)
+	binary.BigEndian.PutUint64(index, seq)
+	return list.Put(index, value)
+}
+
+func (tx *boltTxn) lrange(key string) ([][]byte, error) {
+	list := tx.bucket.Bucket([]byte(key))
+	if list == nil {
+		return nil, nil
+	}
+	var values [][]byte
+	err := list.ForEach(func(_, value []byte) error {
+		values = append(values, copyBytes(value))
+		return nil
+	})
+	return values, err
+}
+
+func (tx *boltTxn) hget(key, field string) ([]byte, error) {
+	hash := tx.bucket.Bucket([]byte(key))
+	if hash == nil {
+		return nil, nil
+	}
+	return copyBytes(hash.Get([]byte(field))), nil
+}
+
+func (tx *boltTxn) hset(key, field string, value []byte) error {
+	hash, err := tx.bucket.CreateBucketIfNotExists([]byte(key))
+	if err != nil {
+		return err
+	}
+	return hash.Put([]byte(field), value)
+}
+
+func (tx *boltTxn) hsetnx(key, field string, value []byte) (bool, error) {
+	hash, err := tx.bucket.CreateBucketIfNotExists([]byte(key))
+	if err != nil {
+		return false, err
+	}
+	if hash.Get([]byte(field)) != nil {
+		return false, nil
+	}
+	return true, hash.Put([]byte(field), value)
+}
+
+func (tx *boltTxn) hdel(key string, fields ...string) error {
+	hash := tx.bucket.Bucket([]byte(key))
+	if hash == nil {
+		return nil
+	}
+	for _, field := range fields {
+		if err := hash.Delete([]byte(field)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hscan return the fields after cursor in order, the cursor is the last field returned
+func (tx *boltTxn) hscan(key, cursor string, count int) ([]string, [][]byte, string, error) {
+	hash := tx.bucket.Bucket([]byte(key))
+	if hash == nil {
+		return nil, nil, "", nil
+	}
+
+	var fields []string
+	var values [][]byte
+	c := hash.Cursor()
+	k, v := c.First()
+	if cursor != "" {
+		k, v = c.Seek([]byte(cursor))
+		if k != nil && string(k) == cursor {
+			k, v = c.Next()
+		}
+	}
+	for ; k != nil; k, v = c.Next() {
+		if len(fields) == count {
+			return fields, values, fields[len(fields)-1], nil
+		}
+		fields = append(fields, string(k))
+		values = append(values, copyBytes(v))
+	}
+	return fields, values, "", nil
+}
+
+func (tx *boltTxn) mget(keys ...string) ([][]byte, error) {
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		values[i] = copyBytes(tx.bucket.Get([]byte(key)))
+	}
+	return values, nil
+}
+
+func (tx *boltTxn) hgetall(key string) (map[string][]byte, error) {
+	values := make(map[string][]byte)
+	hash := tx.bucket.Bucket([]byte(key))
+	if hash == nil {
+		return values, nil
+	}
+	err := hash.ForEach(func(field, value []byte) error {
+		values[string(field)] = copyBytes(value)
+		return nil
+	})
+	return values, err
+}
+
+func (tx *boltTxn) hlen(key string) (int64, error) {
+	hash := tx.bucket.Bucket([]byte(key))
+	if hash == nil {
+		return 0, nil
+	}
+	return int64(hash.Stats().KeyN), nil
+}
@@ -2,114 +2,454 @@ package metadata
 
 import (
 	"context"
-	"encoding/json"
-	"github.com/go-redis/redis/v8"
+	"errors"
 	log "github.com/sirupsen/logrus"
-	"strconv"
+	"time"
 )
 
 type ChunkAttr struct {
 	Offset      int64  `json:"offset"`
 	Length      int    `json:"length"`
 	StoragePath string `json:"storagePath"`
+	// ObjectOffset is the offset of the chunk in the object at StoragePath,
+	// which is not zero if the object hold the whole file
+	ObjectOffset int64 `json:"objectOffset,omitempty"`
+	// Compression is the algorithm the chunk is compressed with in the
+	// object, "" if it is stored as it is
+	Compression string `json:"compression,omitempty"`
+	// StoredLength is the length of the compressed chunk in the object
+	StoredLength int `json:"storedLength,omitempty"`
+	// Reused is set if the object was stored before and is not uploaded for
+	// the chunk, so the chunk must refer to a live ref of it
+	Reused bool `json:"-"`
+	// Reserved is set if the object is uploaded after ReserveChunkRef, so
+	// the chunk must refer to the ref reserved for it, which is gone if gc
+	// deleted the object meanwhile
+	Reserved bool `json:"-"`
 }
 
+// storedLength return the length of the chunk in the object
+func (chunkAttr *ChunkAttr) storedLength() int {
+	if chunkAttr.Compression == "" {
+		return chunkAttr.Length
+	}
+	return chunkAttr.StoredLength
+}
+
+// ChunkRef count the chunks of all the files which refer to the object at
+// StoragePath, so the object is stored once however many files contain it.
+// A chunk ref without chunks is either reserved by the writers uploading the
+// object until Pending, or the tombstone of the object while gc delete it.
+type ChunkRef struct {
+	StoragePath string `json:"-"`
+	// Refs is the number of chunks refer to the object
+	Refs int64 `json:"refs"`
+	// Size is the size of the object
+	Size int64 `json:"size"`
+	// Bytes is the total length of the chunks refer to the object
+	Bytes int64 `json:"bytes"`
+	// Pending is the unix time until which the object is reserved by the
+	// writers uploading it, so gc does not delete it meanwhile
+	Pending int64 `json:"pending,omitempty"`
+}
+
+func (ref *ChunkRef) tombstone() bool {
+	return ref.Refs <= 0 && ref.Pending == 0
+}
+
+// reserved return true if a writer may still be uploading the object
+func (ref *ChunkRef) reserved() bool {
+	return ref.Pending > time.Now().Unix()
+}
+
+// ErrChunkFenced is returned when a chunk is set to an object which is being
+// deleted by gc, or to a reused object which is no longer referred, the object
+// must be stored again once the tombstone is cleared
+var ErrChunkFenced = errors.New("object of the chunk is being deleted by gc")
+
+// fencePollInterval is how often GetChunkRef check the tombstone of an object
+const fencePollInterval = 50 * time.Millisecond
+
+// reserveTTL is how long an object is reserved by ReserveChunkRef, a writer
+// which take longer to upload it find the reservation gone and upload it again
+const reserveTTL = 10 * time.Minute
+
 func chunkKey(inode Ino) string {
 	return "c" + inode.String()
 }
 
 // SetChunkMeta
 // inode[pagenum] -> { offset. length, storagePath }
-func (r *RedisMeta) SetChunkMeta(ctx context.Context, inode Ino, pageNum int64, offset int64, lens int, storagePath string) error {
+func (m *baseMeta) SetChunkMeta(ctx context.Context, inode Ino, pageNum int64, offset int64, lens int, storagePath string) error {
 	log.WithFields(log.Fields{
 		"inode":       inode,
 		"pageNum":     pageNum,
 		"offset":      offset,
 		"length":      lens,
 		"storagePath": storagePath,
-	}).Debug("Redis SetChunkMeta")
+	}).Debug("SetChunkMeta")
 
-	jsonChunkAttr, err := json.Marshal(&ChunkAttr{
-		Offset:      offset,
-		Length:      lens,
-		StoragePath: storagePath,
+	return m.engine.txn(ctx, func(tx metaTxn) error {
+		return linkChunk(tx, inode, pageNum, &ChunkAttr{
+			Offset:      offset,
+			Length:      lens,
+			StoragePath: storagePath,
+		})
 	})
-	if err != nil {
-		return err
-	}
+}
 
-	err = r.rdb.HSet(ctx, chunkKey(inode), pageNum, jsonChunkAttr).Err()
-	if err != nil {
-		return err
-	}
-	return nil
+// SetChunkAttr set the chunk of the page to chunkAttr
+func (m *baseMeta) SetChunkAttr(ctx context.Context, inode Ino, pageNum int64, chunkAttr *ChunkAttr) error {
+	log.WithFields(log.Fields{
+		"inode":        inode,
+		"pageNum":      pageNum,
+		"offset":       chunkAttr.Offset,
+		"length":       chunkAttr.Length,
+		"storagePath":  chunkAttr.StoragePath,
+		"objectOffset": chunkAttr.ObjectOffset,
+	}).Debug("SetChunkAttr")
+
+	return m.engine.txn(ctx, func(tx metaTxn) error {
+		return linkChunk(tx, inode, pageNum, chunkAttr)
+	})
 }
 
-func (r *RedisMeta) DeleteChunkMeta(ctx context.Context, inode Ino, pageNum int64) error {
+func (m *baseMeta) DeleteChunkMeta(ctx context.Context, inode Ino, pageNum int64) error {
 	log.WithFields(log.Fields{
 		"inode":   inode,
 		"pageNum": pageNum,
-	}).Debug("Redis DeleteChunkMeta")
+	}).Debug("DeleteChunkMeta")
 
-	err := r.rdb.HDel(ctx, chunkKey(inode), strconv.FormatInt(pageNum, 10)).Err()
-	if err != nil {
+	return m.engine.txn(ctx, func(tx metaTxn) error {
+		return unlinkChunk(tx, inode, pageNum)
+	})
+}
+
+func (m *baseMeta) GetChunkMeta(ctx context.Context, inode Ino, pageNum int64) (*ChunkAttr, bool, error) {
+	var chunkAttr *ChunkAttr
+	err := m.engine.view(ctx, func(tx metaTxn) error {
+		var err error
+		chunkAttr, err = tx.getChunk(inode, pageNum)
 		return err
+	})
+	if err != nil {
+		return nil, false, err
 	}
-	return nil
+	return chunkAttr, chunkAttr != nil, nil
 }
 
-func (r *RedisMeta) GetChunkMeta(ctx context.Context, inode Ino, pageNum int64) (*ChunkAttr, bool, error) {
-	chunkAttr := &ChunkAttr{}
+func (m *baseMeta) TruncateChunkMeta(ctx context.Context, inode Ino, lastPageNum int64, lastPageLength int) error {
+	return m.engine.txn(ctx, func(tx metaTxn) error {
+		chunkAttrs, err := tx.chunks(inode)
+		if err != nil {
+			return err
+		}
 
-	jsonChunkAttr, err := r.rdb.HGet(ctx, chunkKey(inode), strconv.FormatInt(pageNum, 10)).Bytes()
-	if err != nil {
-		if err == redis.Nil {
-			return nil, false, nil
+		for curPageNum, chunkAttr := range chunkAttrs {
+			if curPageNum > lastPageNum || (curPageNum == lastPageNum && lastPageLength == 0) {
+				err := unlinkChunk(tx, inode, curPageNum)
+				if err != nil {
+					return err
+				}
+			} else if curPageNum == lastPageNum {
+				chunkAttr.Length = lastPageLength
+				err = linkChunk(tx, inode, curPageNum, chunkAttr)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// GetChunkRef return the chunk ref of the object at storagePath, false if no
+// chunk refer to it. It wait while the object is being deleted by gc, so the
+// object can be stored again after it is gone.
+func (m *baseMeta) GetChunkRef(ctx context.Context, storagePath string) (*ChunkRef, bool, error) {
+	for {
+		var ref *ChunkRef
+		err := m.engine.view(ctx, func(tx metaTxn) error {
+			var err error
+			ref, err = tx.getChunkRef(storagePath)
+			return err
+		})
+		if err != nil {
+			return nil, false, err
+		}
+		if ref == nil || !ref.tombstone() {
+			return ref, ref != nil && ref.Refs > 0, nil
+		}
+		if err := waitFence(ctx); err != nil {
+			return nil, false, err
 		}
-		return nil, false, err
 	}
+}
 
-	err = json.Unmarshal(jsonChunkAttr, chunkAttr)
-	if err != nil {
-		return nil, false, err
+// ReserveChunkRef reserve the object at storagePath before it is uploaded, so
+// gc does not delete it until the chunks refer to it. It wait while the object
+// is being deleted by gc.
+func (m *baseMeta) ReserveChunkRef(ctx context.Context, storagePath string) error {
+	for {
+		fenced := false
+		err := m.engine.txn(ctx, func(tx metaTxn) error {
+			ref, err := tx.getChunkRef(storagePath)
+			if err != nil {
+				return err
+			}
+			if ref == nil {
+				ref = &ChunkRef{StoragePath: storagePath}
+			} else if ref.tombstone() {
+				fenced = true
+				return nil
+			}
+			ref.Pending = time.Now().Add(reserveTTL).Unix()
+			return tx.setChunkRef(ref)
+		})
+		if err != nil || !fenced {
+			return err
+		}
+		if err := waitFence(ctx); err != nil {
+			return err
+		}
 	}
-	return chunkAttr, true, nil
+}
 
+// waitFence wait for a while before the tombstone of an object is checked again
+func waitFence(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(fencePollInterval):
+		return nil
+	}
 }
 
-func (r *RedisMeta) TruncateChunkMeta(ctx context.Context, inode Ino, lastPageNum int64, lastPageLength int) error {
-	chunkAttrs, err := r.rdb.HGetAll(ctx, chunkKey(inode)).Result()
+// FenceChunkRef write the tombstone of the object at storagePath before gc
+// delete it, false if any chunk refer to it, a writer reserved it, or it is
+// already fenced
+func (m *baseMeta) FenceChunkRef(ctx context.Context, storagePath string) (bool, error) {
+	fenced := false
+	err := m.engine.txn(ctx, func(tx metaTxn) error {
+		ref, err := tx.getChunkRef(storagePath)
+		if err != nil {
+			return err
+		}
+		// the reservation of a writer which did not finish is expired
+		if ref != nil && (ref.Refs > 0 || ref.reserved() || ref.tombstone()) {
+			return nil
+		}
+		fenced = true
+		return tx.setChunkRef(&ChunkRef{StoragePath: storagePath})
+	})
 	if err != nil {
-		return err
+		return false, err
 	}
+	return fenced, nil
+}
 
-	for key, jsonChunkAttr := range chunkAttrs {
-		curPageNum, err := strconv.ParseInt(key, 10, 64)
-		if err != nil {
+// UnfenceChunkRef clear the tombstone of the object at storagePath written by
+// FenceChunkRef once gc is done with it
+func (m *baseMeta) UnfenceChunkRef(ctx context.Context, storagePath string) error {
+	return m.engine.txn(ctx, func(tx metaTxn) error {
+		ref, err := tx.getChunkRef(storagePath)
+		if err != nil || ref == nil || !ref.tombstone() {
 			return err
 		}
-		if curPageNum > lastPageNum || (curPageNum == lastPageNum && lastPageLength == 0) {
-			err := r.rdb.HDel(ctx, chunkKey(inode), key).Err()
-			if err != nil {
-				return err
+		return tx.delChunkRef(storagePath)
+	})
+}
+
+// DedupeStats is how much the chunks of the files are deduplicated in the object storage
+type DedupeStats struct {
+	// Objects is the number of objects referred by chunks
+	Objects int64 `json:"objects"`
+	// Chunks is the number of chunks refer to the objects
+	Chunks int64 `json:"chunks"`
+	// LogicalBytes is the total length of the chunks
+	LogicalBytes int64 `json:"logicalBytes"`
+	// StoredBytes is the total size of the objects
+	StoredBytes int64 `json:"storedBytes"`
+}
+
+// Ratio return how many times the chunks are larger than the objects stored for them
+func (stats *DedupeStats) Ratio() float64 {
+	if stats.StoredBytes == 0 {
+		return 1
+	}
+	return float64(stats.LogicalBytes) / float64(stats.StoredBytes)
+}
+
+// chunkRefsBatch is how many chunk refs are read in a transaction by DedupeStats
+const chunkRefsBatch = 1000
+
+// DedupeStats sum the chunk refs of all the objects
+func (m *baseMeta) DedupeStats(ctx context.Context) (*DedupeStats, error) {
+	stats := &DedupeStats{}
+	cursor := ""
+	for {
+		var refs []*ChunkRef
+		err := m.engine.view(ctx, func(tx metaTxn) error {
+			var err error
+			refs, cursor, err = tx.scanChunkRefs(cursor, chunkRefsBatch)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, ref := range refs {
+			if ref.Refs <= 0 {
+				continue
 			}
-		} else if curPageNum == lastPageNum {
-			chunkAttr := &ChunkAttr{}
-			err = json.Unmarshal([]byte(jsonChunkAttr), chunkAttr)
+			stats.Objects++
+			stats.Chunks += ref.Refs
+			stats.LogicalBytes += ref.Bytes
+			stats.StoredBytes += ref.Size
+		}
+		if cursor == "" {
+			return stats, nil
+		}
+	}
+}
+
+// inodesBatch is how many inodes are read in a transaction by LiveStoragePaths
+const inodesBatch = 1000
+
+// LiveStoragePaths return the storage paths of the objects referred by the
+// chunks of all the existing inodes, the chunks left by the inodes removed
+// before they are released with the inodes are not live
+func (m *baseMeta) LiveStoragePaths(ctx context.Context) (map[string]struct{}, error) {
+	curInode, err := m.CurInodeCount(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make(map[string]struct{})
+	for first := Ino(1); uint64(first) <= curInode; first += inodesBatch {
+		inos := make([]Ino, 0, inodesBatch)
+		for ino := first; ino < first+inodesBatch && uint64(ino) <= curInode; ino++ {
+			inos = append(inos, ino)
+		}
+		err := m.engine.view(ctx, func(tx metaTxn) error {
+			attrs, err := tx.getattrs(inos)
 			if err != nil {
 				return err
 			}
-			chunkAttr.Length = lastPageLength
-			jsonChunkAttr, err := json.Marshal(chunkAttr)
-			if err != nil {
-				return err
+			for i, attr := range attrs {
+				if attr == nil {
+					continue
+				}
+				chunkAttrs, err := tx.chunks(inos[i])
+				if err != nil {
+					return err
+				}
+				for _, chunkAttr := range chunkAttrs {
+					paths[chunkAttr.StoragePath] = struct{}{}
+				}
 			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return paths, nil
+}
 
-			err = r.rdb.HSet(ctx, chunkKey(inode), lastPageNum, jsonChunkAttr).Err()
-			if err != nil {
-				return err
-			}
+// linkChunk set the chunk of the page, and move its reference from the
+// object of the old chunk to the object of the new one
+func linkChunk(tx metaTxn, inode Ino, pageNum int64, chunkAttr *ChunkAttr) error {
+	old, err := tx.getChunk(inode, pageNum)
+	if err != nil {
+		return err
+	}
+	// ref the new object before deref the old one, so the ref of an object
+	// the page is set to again is not dropped in between
+	if err := refChunk(tx, chunkAttr); err != nil {
+		return err
+	}
+	if old != nil {
+		if err := derefChunk(tx, old); err != nil {
+			return err
+		}
+	}
+	return tx.setChunk(inode, pageNum, chunkAttr)
+}
+
+// unlinkChunk delete the chunk of the page and its reference to the object
+func unlinkChunk(tx metaTxn, inode Ino, pageNum int64) error {
+	old, err := tx.getChunk(inode, pageNum)
+	if err != nil {
+		return err
+	}
+	if old == nil {
+		return nil
+	}
+	if err := derefChunk(tx, old); err != nil {
+		return err
+	}
+	return tx.delChunk(inode, pageNum)
+}
+
+// releaseChunks delete all the chunks of the inode which is removed
+func releaseChunks(tx metaTxn, inode Ino) error {
+	chunkAttrs, err := tx.chunks(inode)
+	if err != nil {
+		return err
+	}
+	for pageNum, chunkAttr := range chunkAttrs {
+		if err := derefChunk(tx, chunkAttr); err != nil {
+			return err
+		}
+		if err := tx.delChunk(inode, pageNum); err != nil {
+			return err
 		}
 	}
 	return nil
 }
+
+// refChunk add the reference of the chunk to the ref of the object. A reused
+// object may be deleted by gc since it was found referred, and an uploaded
+// object since its reservation expired, then the ref is gone or a tombstone.
+func refChunk(tx metaTxn, chunkAttr *ChunkAttr) error {
+	ref, err := tx.getChunkRef(chunkAttr.StoragePath)
+	if err != nil {
+		return err
+	}
+	if ref == nil {
+		if chunkAttr.Reused || chunkAttr.Reserved {
+			return ErrChunkFenced
+		}
+		ref = &ChunkRef{StoragePath: chunkAttr.StoragePath}
+	} else if ref.tombstone() || (chunkAttr.Reused && ref.Refs <= 0) {
+		return ErrChunkFenced
+	}
+	ref.Refs++
+	ref.Bytes += int64(chunkAttr.Length)
+	// the object may hold the whole file, whose size is known by its last chunk
+	if size := chunkAttr.ObjectOffset + int64(chunkAttr.storedLength()); size > ref.Size {
+		ref.Size = size
+	}
+	return tx.setChunkRef(ref)
+}
+
+// derefChunk drop the reference of the chunk, the ref of the object is
+// deleted when no chunk refer to it
+func derefChunk(tx metaTxn, chunkAttr *ChunkAttr) error {
+	ref, err := tx.getChunkRef(chunkAttr.StoragePath)
+	if err != nil {
+		return err
+	}
+	if ref == nil || ref.Refs <= 0 {
+		// the chunk was written before the chunks are counted, or the
+		// object is deleted by gc without it
+		return nil
+	}
+	ref.Refs--
+	ref.Bytes -= int64(chunkAttr.Length)
+	// the ref is kept for the writers which reserved it
+	if ref.Refs <= 0 && !ref.reserved() {
+		return tx.delChunkRef(chunkAttr.StoragePath)
+	}
+	return tx.setChunkRef(ref)
+}
@@ -2,8 +2,6 @@ package metadata
 
 import (
 	"context"
-	"encoding/json"
-	"github.com/go-redis/redis/v8"
 	"github.com/hanwen/go-fuse/v2/fuse"
 	"syscall"
 )
@@ -22,97 +20,210 @@ func dentryKey(inode Ino) string {
 	return "d" + inode.String()
 }
 
+// DirEntry is a dentry with the attributes of its inode
+type DirEntry struct {
+	Name string
+	Ino  Ino
+	Attr *Attr
+}
+
+// dirStreamBatch is the number of the dentries a DirStream fetch at once
+const dirStreamBatch = 512
+
+// dirStreamWindow is the number of the last pages whose names a DirStream
+// keep to drop the duplicates
+const dirStreamWindow = 2
+
+// DirStream list a directory page by page, the dentries are scanned with a
+// cursor and the attributes of a page are fetched in a batch. The order of
+// the entries is stable while the directory is not changed, so the offsets
+// are the same if the stream is read again for seekdir.
 type DirStream struct {
+	ctx  context.Context
 	ino  Ino
-	meta *RedisMeta
+	meta Meta
 
-	totalCnt int
-	curPos   int
+	cursor string
+	eof    bool
+	err    error
 
-	dentries []*Dentry
+	entries []*DirEntry
+	curPos  int
+	// seen is the names returned in the last pages, since HSCAN may return a
+	// dentry twice if the hash is rehashed, and the duplicates are returned
+	// by the pages next to each other. The engines scanning by the order of
+	// the names never return a dentry twice.
+	seen [dirStreamWindow]map[string]struct{}
 }
 
-func NewDirStream(ctx context.Context, ino Ino, meta *RedisMeta) (*DirStream, error) {
+func NewDirStream(ctx context.Context, ino Ino, meta Meta) (*DirStream, error) {
 	ds := &DirStream{
-		ino:    ino,
-		curPos: 0,
-		meta:   meta,
+		ctx:  ctx,
+		ino:  ino,
+		meta: meta,
 	}
-	dentries, err := meta.GetAllDentries(ctx, ino)
-	if err != nil {
+	if err := ds.fetch(); err != nil {
 		return nil, err
 	}
-	ds.dentries = dentries
-	ds.totalCnt = len(dentries)
-
+	// the stream outlives the request opening it
+	ds.ctx = context.Background()
 	return ds, nil
 }
 
-func (ds *DirStream) HasNext() bool {
-	return ds.curPos < ds.totalCnt
+// fetch read the next non-empty page of the directory
+func (ds *DirStream) fetch() error {
+	for !ds.eof {
+		entries, cursor, err := ds.meta.ScanDentries(ds.ctx, ds.ino, ds.cursor, dirStreamBatch)
+		if err != nil {
+			return err
+		}
+		ds.cursor = cursor
+		ds.eof = cursor == ""
+
+		ds.entries = ds.entries[:0]
+		ds.curPos = 0
+		copy(ds.seen[1:], ds.seen[:dirStreamWindow-1])
+		ds.seen[0] = make(map[string]struct{}, len(entries))
+		for _, entry := range entries {
+			if ds.returned(entry.Name) {
+				continue
+			}
+			ds.seen[0][entry.Name] = struct{}{}
+			ds.entries = append(ds.entries, entry)
+		}
+		if len(ds.entries) > 0 {
+			return nil
+		}
+	}
+	return nil
 }
 
-func (ds *DirStream) Next() (de fuse.DirEntry, eno syscall.Errno) {
-	ctx := context.TODO()
+// returned return true if the name is returned in the last pages
+func (ds *DirStream) returned(name string) bool {
+	for _, names := range ds.seen {
+		if _, ok := names[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (ds *DirStream) HasNext() bool {
+	if ds.err != nil {
+		return true
+	}
+	if ds.curPos < len(ds.entries) {
+		return true
+	}
+	ds.err = ds.fetch()
+	return ds.err != nil || ds.curPos < len(ds.entries)
+}
 
-	if ds.curPos > ds.totalCnt {
-		return de, syscall.EIO
+// NextEntry return the next entry with its attributes
+func (ds *DirStream) NextEntry() (*DirEntry, syscall.Errno) {
+	if ds.err != nil {
+		return nil, errno(ds.err)
 	}
+	if ds.curPos >= len(ds.entries) {
+		return nil, syscall.EIO
+	}
+	entry := ds.entries[ds.curPos]
+	ds.curPos++
+	return entry, syscall.F_OK
+}
 
-	dentry := ds.dentries[ds.curPos]
-	de.Name = dentry.name
-	de.Ino = uint64(dentry.Ino)
-	attr, eno := ds.meta.Getattr(ctx, dentry.Ino)
-	if eno != 0 {
+func (ds *DirStream) Next() (de fuse.DirEntry, eno syscall.Errno) {
+	entry, eno := ds.NextEntry()
+	if eno != syscall.F_OK {
 		return de, eno
 	}
-	de.Mode = uint32(attr.Mode)
-	ds.curPos++
-	return
+	de.Name = entry.Name
+	de.Ino = uint64(entry.Ino)
+	de.Mode = entry.Attr.SMode()
+	return de, syscall.F_OK
 }
 
 func (ds *DirStream) Close() {
-	// nothing
+	ds.entries = nil
+	ds.seen = [dirStreamWindow]map[string]struct{}{}
 }
 
-// GetDentry check if directory parent have a dentry with the name, if have, return the dentry
-func (r *RedisMeta) GetDentry(ctx context.Context, parent Ino, name string) (*Dentry, bool, error) {
-	d := &Dentry{
-		name: name,
-	}
-	data, err := r.rdb.HGet(ctx, dentryKey(parent), name).Bytes()
-	if err != nil {
-		if err == redis.Nil {
-			return nil, false, nil
+// ScanDentries return about limit entries of the directory from cursor with
+// their attributes, and the next cursor, "" is both the first and the last cursor
+func (m *baseMeta) ScanDentries(ctx context.Context, ino Ino, cursor string, limit int) ([]*DirEntry, string, error) {
+	var entries []*DirEntry
+	var next string
+	err := m.engine.view(ctx, func(tx metaTxn) error {
+		var dentries []*Dentry
+		var err error
+		dentries, next, err = tx.scanDentries(ino, cursor, limit)
+		if err != nil || len(dentries) == 0 {
+			return err
 		}
-		return nil, false, err
-	}
 
-	err = json.Unmarshal(data, &d.DentryData)
+		inos := make([]Ino, len(dentries))
+		for i, dentry := range dentries {
+			inos[i] = dentry.Ino
+		}
+		attrs, err := tx.getattrs(inos)
+		if err != nil {
+			return err
+		}
+
+		entries = make([]*DirEntry, 0, len(dentries))
+		for i, dentry := range dentries {
+			// the inode has been removed after the dentry is read
+			if attrs[i] == nil {
+				continue
+			}
+			entries = append(entries, &DirEntry{
+				Name: dentry.name,
+				Ino:  dentry.Ino,
+				Attr: attrs[i],
+			})
+		}
+		return nil
+	})
 	if err != nil {
-		return nil, false, err
+		return nil, "", err
 	}
-	return d, true, nil
+	return entries, next, nil
 }
 
-func (r *RedisMeta) SetDentry(ctx context.Context, parent Ino, name string, inode Ino, typ uint8) error {
-	jsonDentry, err := json.Marshal(&DentryData{
-		Ino: inode,
-		Typ: typ,
+// GetDentry check if directory parent have a dentry with the name, if have, return the dentry
+func (m *baseMeta) GetDentry(ctx context.Context, parent Ino, name string) (*Dentry, bool, error) {
+	var dentry *Dentry
+	err := m.engine.view(ctx, func(tx metaTxn) error {
+		var err error
+		dentry, err = tx.getDentry(parent, name)
+		return err
 	})
 	if err != nil {
-		return err
+		return nil, false, err
 	}
-	return r.rdb.HSet(ctx, dentryKey(parent), name, jsonDentry).Err()
+	return dentry, dentry != nil, nil
 }
 
-func (r *RedisMeta) DelDentry(ctx context.Context, parent Ino, name string) error {
-	return r.rdb.HDel(ctx, dentryKey(parent), name).Err()
+func (m *baseMeta) SetDentry(ctx context.Context, parent Ino, name string, inode Ino, typ uint8) error {
+	return m.engine.txn(ctx, func(tx metaTxn) error {
+		return tx.setDentry(parent, name, inode, typ)
+	})
+}
+
+func (m *baseMeta) DelDentry(ctx context.Context, parent Ino, name string) error {
+	return m.engine.txn(ctx, func(tx metaTxn) error {
+		return tx.delDentry(parent, name)
+	})
 }
 
 // GetDirectoryLength get the dentries' number of the directory with specified inode
-func (r *RedisMeta) GetDirectoryLength(ctx context.Context, ino Ino) (int64, error) {
-	lens, err := r.rdb.HLen(ctx, dentryKey(ino)).Result()
+func (m *baseMeta) GetDirectoryLength(ctx context.Context, ino Ino) (int64, error) {
+	var lens int64
+	err := m.engine.view(ctx, func(tx metaTxn) error {
+		var err error
+		lens, err = tx.dirLength(ino)
+		return err
+	})
 	if err != nil {
 		return 0, err
 	}
@@ -120,56 +231,57 @@ func (r *RedisMeta) GetDirectoryLength(ctx context.Context, ino Ino) (int64, err
 }
 
 // GetAllDentries return all dentries of the directory with specified inode
-func (r *RedisMeta) GetAllDentries(ctx context.Context, ino Ino) ([]*Dentry, error) {
+func (m *baseMeta) GetAllDentries(ctx context.Context, ino Ino) ([]*Dentry, error) {
 	var dentries []*Dentry
-
-	result, err := r.rdb.HGetAll(ctx, dentryKey(ino)).Result()
-	if err != nil {
-		return dentries, err
-	}
-
-	for name, info := range result {
-		dentry := &Dentry{
-			name: name,
-		}
-		err := json.Unmarshal([]byte(info), &dentry.DentryData)
-		if err != nil {
-			return dentries, err
-		}
-		dentries = append(dentries, dentry)
-	}
-	return dentries, nil
+	err := m.engine.view(ctx, func(tx metaTxn) error {
+		var err error
+		dentries, err = tx.dentries(ino)
+		return err
+	})
+	return dentries, err
 }
 
 // Rmdir remove a directory with name in parent inode
-func (r *RedisMeta) Rmdir(ctx context.Context, parent Ino, name string) syscall.Errno {
-	dentry, find, err := r.GetDentry(ctx, parent, name)
+func (m *baseMeta) Rmdir(ctx context.Context, parent Ino, name string) syscall.Errno {
+	err := m.engine.txn(ctx, func(tx metaTxn) error {
+		return rmdir(tx, parent, name)
+	})
+	return errno(err)
+}
+
+// rmdir remove an empty directory in a transaction
+func rmdir(tx metaTxn, parent Ino, name string) error {
+	dentry, err := tx.getDentry(parent, name)
 	if err != nil {
-		return errno(err)
+		return err
 	}
-	if !find {
+	if dentry == nil {
 		return syscall.ENOENT
 	}
-	attr, eno := r.Getattr(ctx, dentry.Ino)
-	if eno != syscall.F_OK {
-		return eno
+	attr, err := tx.getattr(dentry.Ino)
+	if err != nil {
+		return err
 	}
 	if attr.Typ != TypeDirectory {
 		return syscall.EPERM
 	}
-	if attr.Nlink != 2 {
+	length, err := tx.dirLength(dentry.Ino)
+	if err != nil {
+		return err
+	}
+	if length != 0 {
 		return syscall.ENOTEMPTY
 	}
-	attr.Nlink -= 2
 
-	r.rdb.HDel(ctx, dentryKey(parent), name)
-	r.rdb.Del(ctx, inodeKey(dentry.Ino))
-
-	pattr, eno := r.Getattr(ctx, parent)
-	pattr.Nlink--
-	if err := r.SetattrDirectly(ctx, parent, pattr); err != nil {
-		return errno(err)
+	err = tx.delDentry(parent, name)
+	if err != nil {
+		return err
+	}
+	err = tx.delattr(dentry.Ino)
+	if err != nil {
+		return err
 	}
 
-	return syscall.F_OK
+	// parent.link--
+	return unref(tx, parent)
 }
@@ -2,7 +2,6 @@ package metadata
 
 import (
 	"context"
-	"encoding/json"
 	log "github.com/sirupsen/logrus"
 	"strconv"
 	"syscall"
@@ -19,15 +18,73 @@ func inodeKey(inode Ino) string {
 	return "i" + inode.String()
 }
 
-// MkNod create a new inode
-func (r *RedisMeta) MkNod(ctx context.Context, parent Ino, _type uint8, name string, mode uint32, dev uint32) (*Attr, Ino, syscall.Errno) {
-	attr := &Attr{}
-	ino, err := r.nextInode(ctx)
+// MkNod create a new inode, EEXIST if the name already exists in parent
+func (m *baseMeta) MkNod(ctx context.Context, parent Ino, _type uint8, name string, mode uint32, dev uint32) (*Attr, Ino, syscall.Errno) {
+	if _type == TypeSymlink {
+		return nil, 0, syscall.EINVAL
+	}
+	return m.mknod(ctx, parent, _type, name, mode, dev, "")
+}
+
+// mknod create a new inode, target is only used by symlink
+func (m *baseMeta) mknod(ctx context.Context, parent Ino, _type uint8, name string, mode uint32, dev uint32, target string) (*Attr, Ino, syscall.Errno) {
+	ino, err := m.nextInode(ctx)
 	if err != nil {
 		log.Error("get next inode failed")
 		return nil, 0, errno(err)
 	}
+	attr := newAttr(parent, _type, mode, dev, target)
+
+	var existAttr *Attr
+	err = m.engine.txn(ctx, func(tx metaTxn) error {
+		parentAttr, err := tx.getattr(parent)
+		if err != nil {
+			return err
+		}
+		if parentAttr.Typ != TypeDirectory {
+			return syscall.ENOTDIR
+		}
+
+		// create the dentry only if it does not exist, so that the exclusive
+		// create of git lock files like HEAD.lock race safely between mounts
+		dentry, err := tx.createDentry(parent, name, ino, _type)
+		if err != nil {
+			return err
+		}
+		if dentry != nil {
+			existAttr, err = tx.getattr(dentry.Ino)
+			if err != nil {
+				return err
+			}
+			return syscall.EEXIST
+		}
+
+		err = tx.setattr(ino, attr)
+		if err != nil {
+			return err
+		}
+		if _type == TypeSymlink {
+			err = tx.setSymlink(ino, target)
+			if err != nil {
+				return err
+			}
+		}
+		// a sub-directory link to its parent by ".."
+		if _type == TypeDirectory {
+			return ref(tx, parent)
+		}
+		return nil
+	})
+	if err != nil {
+		return existAttr, 0, errno(err)
+	}
+
+	return attr, ino, 0
+}
 
+// newAttr return the attributes of a new inode in parent
+func newAttr(parent Ino, _type uint8, mode uint32, dev uint32, target string) *Attr {
+	attr := &Attr{}
 	ts := time.Now()
 	SetTime(&attr.Atime, &attr.Atimensec, ts)
 	SetTime(&attr.Mtime, &attr.Mtimensec, ts)
@@ -42,41 +99,34 @@ func (r *RedisMeta) MkNod(ctx context.Context, parent Ino, _type uint8, name str
 	if _type == TypeDirectory {
 		attr.Nlink = 2
 		attr.Length = 4 << 10
+		attr.Parent = parent
 	} else {
 		attr.Nlink = 1
 		if _type == TypeSymlink {
-			attr.Length = uint64(len(name))
+			attr.Length = uint64(len(target))
 		} else {
 			attr.Length = 0
 		}
 	}
-	// if parent.dentries have new node
-	_, find, err := r.GetDentry(ctx, parent, name)
+	return attr
+}
+
+// ref increase the link count of the inode in a transaction
+func ref(tx metaTxn, inode Ino) error {
+	attr, err := tx.getattr(inode)
 	if err != nil {
-		log.WithError(err).Error("get dentry failed")
-		return nil, 0, errno(err)
+		return err
 	}
-	if find {
-		attr, eno := r.Getattr(ctx, ino)
-		if eno != 0 {
-			log.WithField("errno", eno).Error("get attr failed")
-			return nil, 0, eno
-		}
-		return attr, 0, syscall.EEXIST
-	}
-
-	jsonAttr, err := json.Marshal(attr)
-	r.rdb.Set(ctx, inodeKey(ino), jsonAttr, 0)
-	//log.WithField("inode", ino).Info("create inode")
+	attr.Nlink++
+	return tx.setattr(inode, attr)
+}
 
-	err = r.SetDentry(ctx, parent, name, ino, _type)
+// unref decrease the link count of the inode in a transaction
+func unref(tx metaTxn, inode Ino) error {
+	attr, err := tx.getattr(inode)
 	if err != nil {
-		return nil, 0, errno(err)
-	}
-	eno := r.Ref(ctx, parent)
-	if eno != syscall.F_OK {
-		return nil, 0, eno
+		return err
 	}
-
-	return attr, ino, 0
+	attr.Nlink--
+	return tx.setattr(inode, attr)
 }
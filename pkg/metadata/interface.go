@@ -0,0 +1,167 @@
+package metadata
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Meta is the interface of a metadata engine, it maintains inodes, dentries,
+// chunk metadata, git refs and the file system attributes.
+type Meta interface {
+	// Init initialize the root inode and the file system attributes
+	Init(ctx context.Context) error
+
+	// Getattr return the attributes of the specified inode
+	Getattr(ctx context.Context, ino Ino) (*Attr, syscall.Errno)
+	// SetattrDirectly overwrite the attributes of the specified inode
+	SetattrDirectly(ctx context.Context, ino Ino, attr *Attr) error
+	// Ref increase the link count of the specified inode
+	Ref(ctx context.Context, inode Ino) syscall.Errno
+
+	// MkNod atomically create a new inode with name in parent, EEXIST if the name exists
+	MkNod(ctx context.Context, parent Ino, _type uint8, name string, mode uint32, dev uint32) (*Attr, Ino, syscall.Errno)
+	// Link create a hard link of target with name in parent
+	Link(ctx context.Context, parent Ino, target Ino, name string) (*Attr, syscall.Errno)
+	// Unlink remove a non-directory entry with name in parent
+	Unlink(ctx context.Context, parent Ino, name string) syscall.Errno
+	// Rename move parent/oldName to newParent/newName, flags is 0, RenameNoReplace or RenameExchange
+	Rename(ctx context.Context, parent Ino, oldName string, newParent Ino, newName string, flags uint32) syscall.Errno
+	// Rmdir remove an empty directory with name in parent
+	Rmdir(ctx context.Context, parent Ino, name string) syscall.Errno
+	// Symlink create a symbolic link with name in parent which point to target
+	Symlink(ctx context.Context, parent Ino, name string, target string) (*Attr, Ino, syscall.Errno)
+	// Readlink return the target of the symbolic link
+	Readlink(ctx context.Context, ino Ino) (string, syscall.Errno)
+
+	// GetXattr return the value of the extended attribute, ENODATA if it does not exist
+	GetXattr(ctx context.Context, ino Ino, name string) ([]byte, syscall.Errno)
+	// SetXattr set the value of the extended attribute, flags is XattrCreate or XattrReplace
+	SetXattr(ctx context.Context, ino Ino, name string, value []byte, flags uint32) syscall.Errno
+	// ListXattr return the names of all the extended attributes of the inode
+	ListXattr(ctx context.Context, ino Ino) ([]string, syscall.Errno)
+	// RemoveXattr remove the extended attribute, ENODATA if it does not exist
+	RemoveXattr(ctx context.Context, ino Ino, name string) syscall.Errno
+
+	// NewSession register a new session, whose locks are alive until it expire
+	NewSession(ctx context.Context) (uint64, error)
+	// RefreshSession extend the expire time of the session
+	RefreshSession(ctx context.Context, sid uint64) error
+	// CloseSession release all the locks of the session, remove the inodes it
+	// sustains and remove it
+	CloseSession(ctx context.Context, sid uint64) error
+	// CleanStaleSessions reclaim the locks of the expired sessions
+	CleanStaleSessions(ctx context.Context) error
+	// OpenFile record that the inode is opened by the session, so that it is
+	// sustained by the session if it is unlinked by any client until CloseFile
+	OpenFile(ctx context.Context, sid uint64, inode Ino) error
+	// CloseFile drop a record of OpenFile, the inode is removed when it is
+	// closed for the last time if it was unlinked
+	CloseFile(ctx context.Context, sid uint64, inode Ino) error
+	// Getlk return the first posix lock conflicting with lk in out
+	Getlk(ctx context.Context, ino Ino, sid, owner uint64, lk *fuse.FileLock, out *fuse.FileLock) syscall.Errno
+	// Setlk acquire or release the posix lock lk, EAGAIN if it conflict with others
+	Setlk(ctx context.Context, ino Ino, sid, owner uint64, lk *fuse.FileLock) syscall.Errno
+	// Flock acquire or release the flock of the owner, EAGAIN if it conflict with others
+	Flock(ctx context.Context, ino Ino, sid, owner uint64, ltype uint32) syscall.Errno
+
+	GetDentry(ctx context.Context, parent Ino, name string) (*Dentry, bool, error)
+	SetDentry(ctx context.Context, parent Ino, name string, inode Ino, typ uint8) error
+	DelDentry(ctx context.Context, parent Ino, name string) error
+	GetDirectoryLength(ctx context.Context, ino Ino) (int64, error)
+	// ScanDentries return a page of the directory entries with their attributes from cursor
+	ScanDentries(ctx context.Context, ino Ino, cursor string, limit int) ([]*DirEntry, string, error)
+	GetAllDentries(ctx context.Context, ino Ino) ([]*Dentry, error)
+
+	SetChunkMeta(ctx context.Context, inode Ino, pageNum int64, offset int64, lens int, storagePath string) error
+	// SetChunkAttr set the chunk of the page, which may be a part of a larger object
+	SetChunkAttr(ctx context.Context, inode Ino, pageNum int64, chunkAttr *ChunkAttr) error
+	DeleteChunkMeta(ctx context.Context, inode Ino, pageNum int64) error
+	GetChunkMeta(ctx context.Context, inode Ino, pageNum int64) (*ChunkAttr, bool, error)
+	TruncateChunkMeta(ctx context.Context, inode Ino, lastPageNum int64, lastPageLength int) error
+	// GetChunkRef return false if no chunk refer to the object at storagePath,
+	// it wait while the object is being deleted by gc
+	GetChunkRef(ctx context.Context, storagePath string) (*ChunkRef, bool, error)
+	// ReserveChunkRef keep gc from deleting the object at storagePath while it
+	// is uploaded, the chunks set to it must be marked Reserved
+	ReserveChunkRef(ctx context.Context, storagePath string) error
+	// FenceChunkRef write the tombstone of an object no chunk refer to before gc delete it,
+	// false if any chunk refer to it or it is reserved, and UnfenceChunkRef clear the tombstone after
+	FenceChunkRef(ctx context.Context, storagePath string) (bool, error)
+	UnfenceChunkRef(ctx context.Context, storagePath string) error
+	// DedupeStats return how much the chunks are deduplicated in the object storage
+	DedupeStats(ctx context.Context) (*DedupeStats, error)
+	// LiveStoragePaths return the storage paths of the objects referred by any chunk of the files
+	LiveStoragePaths(ctx context.Context) (map[string]struct{}, error)
+
+	RefSet(ctx context.Context, inode Ino, value string) error
+	// RefGet return the value of the ref stored with inode, and whether it exists
+	RefGet(ctx context.Context, inode Ino) (string, bool, error)
+
+	// PackedRefsSet replace the ref records of the packed-refs file inode
+	PackedRefsSet(ctx context.Context, inode Ino, packedRefs *PackedRefs) error
+	// PackedRefsGet return all the ref records of the packed-refs file inode, and whether it exists
+	PackedRefsGet(ctx context.Context, inode Ino) (*PackedRefs, bool, error)
+	// PackedRefGet return the record of the ref name in the packed-refs file inode, and whether it exists
+	PackedRefGet(ctx context.Context, inode Ino, name string) (*PackedRef, bool, error)
+	PackedRefsDel(ctx context.Context, inode Ino) error
+
+	// ReflogAppend append entry to the reflog stored with inode in one round trip
+	ReflogAppend(ctx context.Context, inode Ino, entry []byte) error
+	// ReflogGet return the content of the reflog stored with inode
+	ReflogGet(ctx context.Context, inode Ino) ([]byte, error)
+	// ReflogLength return the length of the content of the reflog stored with inode
+	ReflogLength(ctx context.Context, inode Ino) (uint64, error)
+	// ReflogSet replace the content of the reflog stored with inode
+	ReflogSet(ctx context.Context, inode Ino, content []byte) error
+
+	// UpdateRefs compare and swap the refs of the repository at repo all or nothing,
+	// a *RefConflictError is returned if the value of any ref is not the expected one.
+	// It store the refs as ref records, see gitfs.UpdateRefs for the routes it need.
+	UpdateRefs(ctx context.Context, repo string, updates []*RefUpdate) error
+
+	// PublishRefEvent notify the watchers that a ref is changed
+	PublishRefEvent(ctx context.Context, event *RefEvent) error
+	// WatchRefEvents return the ref events published from now on until ctx is done
+	WatchRefEvents(ctx context.Context) (<-chan *RefEvent, error)
+
+	// InitSetting store value as the setting name of the volume unless it is
+	// set, and return the stored value, so the first mount decide it
+	InitSetting(ctx context.Context, name string, value []byte) ([]byte, error)
+	// GetSetting return the setting name of the volume, nil if it is not set
+	GetSetting(ctx context.Context, name string) ([]byte, error)
+
+	SetTotalInodeCount(ctx context.Context, totalInodeCount uint64) error
+	TotalInodeCount(ctx context.Context) (uint64, error)
+	CurInodeCount(ctx context.Context) (uint64, error)
+	UpdateUsedSpace(ctx context.Context, size int64) error
+	UsedSpace(ctx context.Context) (uint64, error)
+	SetTotalSpace(ctx context.Context, totalSpace uint64) error
+	TotalSpace(ctx context.Context) (uint64, error)
+}
+
+type Creator func(url string) (Meta, error)
+
+var metaEngines = make(map[string]Creator)
+
+// Register make a metadata engine available by the scheme of the metadata url
+func Register(scheme string, creator Creator) {
+	metaEngines[scheme] = creator
+}
+
+// NewMeta create a metadata engine selected by the scheme of url, e.g. redis://127.0.0.1:6379/1
+func NewMeta(url string) (Meta, error) {
+	p := strings.Index(url, "://")
+	if p < 0 {
+		return nil, fmt.Errorf("invalid metadata url %s: missing scheme", url)
+	}
+	scheme := url[:p]
+	creator, ok := metaEngines[scheme]
+	if !ok {
+		return nil, fmt.Errorf("invalid metadata url %s: unsupported engine %s", url, scheme)
+	}
+	return creator(url)
+}
@@ -0,0 +1,824 @@
+package metadata
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// kvTxn is a transaction over a redis-like key-value store.
+// All the kv engines share the same key layout:
+//
+//	i{inode}   -> json attr
+//	d{inode}   -> hash of name -> json dentry
+//	c{inode}   -> hash of page number -> json chunk attr
+//	r{inode}   -> ref value
+//	k{inode}   -> hash of ref name -> json packed ref record
+//	h{inode}   -> json header of packed-refs
+//	g{inode}   -> list of reflog entries
+//	z{inode}   -> total length of the reflog entries
+//	s{inode}   -> symlink target
+//	x{inode}   -> hash of name -> extended attribute value
+//	p{inode}   -> hash of lock owner -> json posix lock records
+//	f{inode}   -> hash of lock owner -> flock type
+//	l{sid}     -> hash of inode -> "" which the session hold locks on
+//	u{sid}     -> hash of inode -> "" which the session sustain after they are unlinked
+//	o{inode}   -> hash of sid -> "" which have the inode open
+//	n{sid}     -> hash of inode -> "" which the session has open
+//	sessions   -> hash of sid -> expire time
+//	e{sid}     -> expire time of the session, read without the sessions hash
+//	b{path}    -> json chunk ref of the object at storage path
+//	chunkrefpaths -> hash of storage path -> "" of the chunk refs
+//	chunkrefs  -> hash of storage path -> json chunk ref, the legacy layout of the chunk refs
+//	nextinode, nextsession, usedspace, totalinode, totalspace -> counters
+//	settings   -> hash of name -> setting value of the volume
+type kvTxn interface {
+	// get return nil if the key does not exist
+	get(key string) ([]byte, error)
+	// mget return nil for the keys which do not exist
+	mget(keys ...string) ([][]byte, error)
+	set(key string, value []byte) error
+	del(keys ...string) error
+	incrBy(key string, value int64) (int64, error)
+	// incr add value to the integer at key without reading it, so it can be batched
+	incr(key string, value int64) error
+
+	// rpush append the value to the list at key
+	rpush(key string, value []byte) error
+	// lrange return all the values of the list at key
+	lrange(key string) ([][]byte, error)
+
+	// hget return nil if the field does not exist
+	hget(key, field string) ([]byte, error)
+	hset(key, field string, value []byte) error
+	// hsetnx set the field only if it does not exist, return false if it exists
+	hsetnx(key, field string, value []byte) (bool, error)
+	hdel(key string, fields ...string) error
+	hgetall(key string) (map[string][]byte, error)
+	// hscan return about count fields of the hash from cursor and the next cursor,
+	// "" is both the first and the last cursor
+	hscan(key, cursor string, count int) ([]string, [][]byte, string, error)
+	hlen(key string) (int64, error)
+}
+
+// kvClient run functions in the transactions of a kv engine
+type kvClient interface {
+	// txn run fn in a read-write transaction
+	txn(ctx context.Context, fn func(tx kvTxn) error) error
+	// view run fn in a read-only transaction
+	view(ctx context.Context, fn func(tx kvTxn) error) error
+	// batch run fn which only write in a transaction with the least round trips
+	batch(ctx context.Context, fn func(tx kvTxn) error) error
+
+	// publish send msg to the subscribers of channel
+	publish(ctx context.Context, channel string, msg []byte) error
+	// subscribe return the messages published to channel until ctx is done
+	subscribe(ctx context.Context, channel string) (<-chan []byte, error)
+}
+
+// kvEngine is a metaEngine which store metadata in a kvClient
+type kvEngine struct {
+	client kvClient
+}
+
+func (e *kvEngine) txn(ctx context.Context, fn func(tx metaTxn) error) error {
+	return e.client.txn(ctx, func(tx kvTxn) error {
+		return fn(&kvMetaTxn{tx})
+	})
+}
+
+func (e *kvEngine) view(ctx context.Context, fn func(tx metaTxn) error) error {
+	return e.client.view(ctx, func(tx kvTxn) error {
+		return fn(&kvMetaTxn{tx})
+	})
+}
+
+func (e *kvEngine) batch(ctx context.Context, fn func(tx metaTxn) error) error {
+	return e.client.batch(ctx, func(tx kvTxn) error {
+		return fn(&kvMetaTxn{tx})
+	})
+}
+
+func (e *kvEngine) publish(ctx context.Context, channel string, msg []byte) error {
+	return e.client.publish(ctx, channel, msg)
+}
+
+func (e *kvEngine) subscribe(ctx context.Context, channel string) (<-chan []byte, error) {
+	return e.client.subscribe(ctx, channel)
+}
+
+// sortedFields return the fields of a hash and their values in order
+func sortedFields(hash map[string][]byte) ([]string, [][]byte) {
+	fields := make([]string, 0, len(hash))
+	for field := range hash {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	values := make([][]byte, len(fields))
+	for i, field := range fields {
+		values[i] = hash[field]
+	}
+	return fields, values
+}
+
+// kvMetaTxn map metadata to the keys of kvTxn
+type kvMetaTxn struct {
+	kvTxn
+}
+
+func (tx *kvMetaTxn) getattr(ino Ino) (*Attr, error) {
+	data, err := tx.get(inodeKey(ino))
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, syscall.ENOENT
+	}
+	attr := &Attr{}
+	err = json.Unmarshal(data, attr)
+	if err != nil {
+		return nil, err
+	}
+	return attr, nil
+}
+
+func (tx *kvMetaTxn) getattrs(inos []Ino) ([]*Attr, error) {
+	keys := make([]string, len(inos))
+	for i, ino := range inos {
+		keys[i] = inodeKey(ino)
+	}
+	values, err := tx.mget(keys...)
+	if err != nil {
+		return nil, err
+	}
+	attrs := make([]*Attr, len(inos))
+	for i, data := range values {
+		if data == nil {
+			continue
+		}
+		attrs[i] = &Attr{}
+		if err := json.Unmarshal(data, attrs[i]); err != nil {
+			return nil, err
+		}
+	}
+	return attrs, nil
+}
+
+func (tx *kvMetaTxn) setattr(ino Ino, attr *Attr) error {
+	jsonAttr, err := json.Marshal(attr)
+	if err != nil {
+		return err
+	}
+	return tx.set(inodeKey(ino), jsonAttr)
+}
+
+// delattr remove the inode and its extended attributes, ref, packed-refs,
+// reflog and lock records, and the dentries hash if it is an empty directory
+// or the target if it is a symlink
+func (tx *kvMetaTxn) delattr(ino Ino) error {
+	return tx.del(inodeKey(ino), dentryKey(ino), symlinkKey(ino), xattrKey(ino), refKey(ino), packedRefsKey(ino),
+		packedRefsHeaderKey(ino), reflogKey(ino), reflogLengthKey(ino), lockKey(plockKind, ino), lockKey(flockKind, ino))
+}
+
+func (tx *kvMetaTxn) getDentry(parent Ino, name string) (*Dentry, error) {
+	data, err := tx.hget(dentryKey(parent), name)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, nil
+	}
+
+	d := &Dentry{
+		name: name,
+	}
+	err = json.Unmarshal(data, &d.DentryData)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (tx *kvMetaTxn) setDentry(parent Ino, name string, inode Ino, typ uint8) error {
+	jsonDentry, err := json.Marshal(&DentryData{
+		Ino: inode,
+		Typ: typ,
+	})
+	if err != nil {
+		return err
+	}
+	return tx.hset(dentryKey(parent), name, jsonDentry)
+}
+
+func (tx *kvMetaTxn) createDentry(parent Ino, name string, inode Ino, typ uint8) (*Dentry, error) {
+	buf, err := json.Marshal(&DentryData{
+		Ino: inode,
+		Typ: typ,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ok, err := tx.hsetnx(dentryKey(parent), name, buf)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return nil, nil
+	}
+	return tx.getDentry(parent, name)
+}
+
+func (tx *kvMetaTxn) delDentry(parent Ino, name string) error {
+	return tx.hdel(dentryKey(parent), name)
+}
+
+func (tx *kvMetaTxn) dentries(parent Ino) ([]*Dentry, error) {
+	var dentries []*Dentry
+
+	result, err := tx.hgetall(dentryKey(parent))
+	if err != nil {
+		return nil, err
+	}
+
+	for name, info := range result {
+		dentry := &Dentry{
+			name: name,
+		}
+		err := json.Unmarshal(info, &dentry.DentryData)
+		if err != nil {
+			return nil, err
+		}
+		dentries = append(dentries, dentry)
+	}
+	return dentries, nil
+}
+
+func (tx *kvMetaTxn) scanDentries(parent Ino, cursor string, limit int) ([]*Dentry, string, error) {
+	names, values, next, err := tx.hscan(dentryKey(parent), cursor, limit)
+	if err != nil {
+		return nil, "", err
+	}
+	dentries := make([]*Dentry, 0, len(names))
+	for i, name := range names {
+		dentry := &Dentry{
+			name: name,
+		}
+		err := json.Unmarshal(values[i], &dentry.DentryData)
+		if err != nil {
+			return nil, "", err
+		}
+		dentries = append(dentries, dentry)
+	}
+	return dentries, next, nil
+}
+
+func (tx *kvMetaTxn) dirLength(parent Ino) (int64, error) {
+	return tx.hlen(dentryKey(parent))
+}
+
+func (tx *kvMetaTxn) getSymlink(inode Ino) (string, error) {
+	target, err := tx.get(symlinkKey(inode))
+	if err != nil {
+		return "", err
+	}
+	if target == nil {
+		return "", syscall.ENOENT
+	}
+	return string(target), nil
+}
+
+func (tx *kvMetaTxn) setSymlink(inode Ino, target string) error {
+	return tx.set(symlinkKey(inode), []byte(target))
+}
+
+func (tx *kvMetaTxn) getXattr(inode Ino, name string) ([]byte, error) {
+	return tx.hget(xattrKey(inode), name)
+}
+
+func (tx *kvMetaTxn) setXattr(inode Ino, name string, value []byte) error {
+	// hget return nil for a missing field, so never store a nil value
+	if value == nil {
+		value = []byte{}
+	}
+	return tx.hset(xattrKey(inode), name, value)
+}
+
+func (tx *kvMetaTxn) delXattr(inode Ino, name string) error {
+	return tx.hdel(xattrKey(inode), name)
+}
+
+func (tx *kvMetaTxn) xattrs(inode Ino) ([]string, error) {
+	result, err := tx.hgetall(xattrKey(inode))
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(result))
+	for name := range result {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func (tx *kvMetaTxn) getChunk(inode Ino, pageNum int64) (*ChunkAttr, error) {
+	jsonChunkAttr, err := tx.hget(chunkKey(inode), strconv.FormatInt(pageNum, 10))
+	if err != nil {
+		return nil, err
+	}
+	if jsonChunkAttr == nil {
+		return nil, nil
+	}
+
+	chunkAttr := &ChunkAttr{}
+	err = json.Unmarshal(jsonChunkAttr, chunkAttr)
+	if err != nil {
+		return nil, err
+	}
+	return chunkAttr, nil
+}
+
+func (tx *kvMetaTxn) setChunk(inode Ino, pageNum int64, chunkAttr *ChunkAttr) error {
+	jsonChunkAttr, err := json.Marshal(chunkAttr)
+	if err != nil {
+		return err
+	}
+	return tx.hset(chunkKey(inode), strconv.FormatInt(pageNum, 10), jsonChunkAttr)
+}
+
+func (tx *kvMetaTxn) delChunk(inode Ino, pageNum int64) error {
+	return tx.hdel(chunkKey(inode), strconv.FormatInt(pageNum, 10))
+}
+
+func (tx *kvMetaTxn) chunks(inode Ino) (map[int64]*ChunkAttr, error) {
+	result, err := tx.hgetall(chunkKey(inode))
+	if err != nil {
+		return nil, err
+	}
+
+	chunkAttrs := make(map[int64]*ChunkAttr, len(result))
+	for key, jsonChunkAttr := range result {
+		pageNum, err := strconv.ParseInt(key, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		chunkAttr := &ChunkAttr{}
+		err = json.Unmarshal(jsonChunkAttr, chunkAttr)
+		if err != nil {
+			return nil, err
+		}
+		chunkAttrs[pageNum] = chunkAttr
+	}
+	return chunkAttrs, nil
+}
+
+// chunkRefKey is the key of the chunk ref of the object at storagePath, every
+// ref has its own key, so the writers of different objects do not conflict
+func chunkRefKey(storagePath string) string {
+	return "b" + storagePath
+}
+
+// chunkRefPathsKey is the hash of the storage paths of the chunk refs, which
+// is only written in the transactions, so it is not conflicting between them
+const chunkRefPathsKey = "chunkrefpaths"
+
+// legacyChunkRefsKey is the hash of all the chunk refs before they have their
+// own keys, a ref in it is moved to its key when it is changed
+const legacyChunkRefsKey = "chunkrefs"
+
+func (tx *kvMetaTxn) getChunkRef(storagePath string) (*ChunkRef, error) {
+	jsonChunkRef, err := tx.get(chunkRefKey(storagePath))
+	if err != nil {
+		return nil, err
+	}
+	if jsonChunkRef == nil {
+		// the legacy hash is no longer written, so reading it conflict with nothing
+		jsonChunkRef, err = tx.hget(legacyChunkRefsKey, storagePath)
+		if err != nil || jsonChunkRef == nil {
+			return nil, err
+		}
+	}
+	ref := &ChunkRef{StoragePath: storagePath}
+	err = json.Unmarshal(jsonChunkRef, ref)
+	if err != nil {
+		return nil, err
+	}
+	return ref, nil
+}
+
+func (tx *kvMetaTxn) setChunkRef(ref *ChunkRef) error {
+	jsonChunkRef, err := json.Marshal(ref)
+	if err != nil {
+		return err
+	}
+	if err := tx.set(chunkRefKey(ref.StoragePath), jsonChunkRef); err != nil {
+		return err
+	}
+	return tx.hset(chunkRefPathsKey, ref.StoragePath, []byte{})
+}
+
+func (tx *kvMetaTxn) delChunkRef(storagePath string) error {
+	if err := tx.del(chunkRefKey(storagePath)); err != nil {
+		return err
+	}
+	if err := tx.hdel(chunkRefPathsKey, storagePath); err != nil {
+		return err
+	}
+	// the legacy ref would be found again once the key is deleted
+	return tx.hdel(legacyChunkRefsKey, storagePath)
+}
+
+// scanChunkRefs scan the storage paths of the chunk refs and then read their
+// keys, the legacy refs are scanned after all of them
+func (tx *kvMetaTxn) scanChunkRefs(cursor string, limit int) ([]*ChunkRef, string, error) {
+	if strings.HasPrefix(cursor, legacyChunkRefsKey+":") {
+		return tx.scanLegacyChunkRefs(strings.TrimPrefix(cursor, legacyChunkRefsKey+":"), limit)
+	}
+	paths, _, next, err := tx.hscan(chunkRefPathsKey, cursor, limit)
+	if err != nil {
+		return nil, "", err
+	}
+	keys := make([]string, len(paths))
+	for i, path := range paths {
+		keys[i] = chunkRefKey(path)
+	}
+	values, err := tx.mget(keys...)
+	if err != nil {
+		return nil, "", err
+	}
+	refs := make([]*ChunkRef, 0, len(paths))
+	for i, path := range paths {
+		if values[i] == nil {
+			continue
+		}
+		ref := &ChunkRef{StoragePath: path}
+		if err := json.Unmarshal(values[i], ref); err != nil {
+			return nil, "", err
+		}
+		refs = append(refs, ref)
+	}
+	if next == "" {
+		next = legacyChunkRefsKey + ":"
+	}
+	return refs, next, nil
+}
+
+func (tx *kvMetaTxn) scanLegacyChunkRefs(cursor string, limit int) ([]*ChunkRef, string, error) {
+	paths, values, next, err := tx.hscan(legacyChunkRefsKey, cursor, limit)
+	if err != nil {
+		return nil, "", err
+	}
+	refs := make([]*ChunkRef, 0, len(paths))
+	for i, path := range paths {
+		// the ref moved to its key is scanned with the others
+		moved, err := tx.get(chunkRefKey(path))
+		if err != nil {
+			return nil, "", err
+		}
+		if moved != nil {
+			continue
+		}
+		ref := &ChunkRef{StoragePath: path}
+		if err := json.Unmarshal(values[i], ref); err != nil {
+			return nil, "", err
+		}
+		refs = append(refs, ref)
+	}
+	if next == "" {
+		return refs, "", nil
+	}
+	return refs, legacyChunkRefsKey + ":" + next, nil
+}
+
+func (tx *kvMetaTxn) getRef(inode Ino) (string, bool, error) {
+	value, err := tx.get(refKey(inode))
+	if err != nil {
+		return "", false, err
+	}
+	if value == nil {
+		return "", false, nil
+	}
+	return string(value), true, nil
+}
+
+func (tx *kvMetaTxn) setRef(inode Ino, value string) error {
+	return tx.set(refKey(inode), []byte(value))
+}
+
+func (tx *kvMetaTxn) getPackedRefs(inode Ino) (*PackedRefs, error) {
+	data, err := tx.get(packedRefsHeaderKey(inode))
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, nil
+	}
+	header := &packedRefsHeader{}
+	if err := json.Unmarshal(data, header); err != nil {
+		return nil, err
+	}
+
+	records, err := tx.hgetall(packedRefsKey(inode))
+	if err != nil {
+		return nil, err
+	}
+	packedRefs := &PackedRefs{
+		Header: header.Header,
+		Refs:   make([]*PackedRef, 0, len(records)),
+	}
+	names, values := sortedFields(records)
+	for i, name := range names {
+		ref := &PackedRef{}
+		if err := json.Unmarshal(values[i], ref); err != nil {
+			return nil, err
+		}
+		ref.Name = name
+		packedRefs.Refs = append(packedRefs.Refs, ref)
+	}
+	return packedRefs, nil
+}
+
+func (tx *kvMetaTxn) getPackedRef(inode Ino, name string) (*PackedRef, error) {
+	data, err := tx.hget(packedRefsKey(inode), name)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, nil
+	}
+	ref := &PackedRef{}
+	if err := json.Unmarshal(data, ref); err != nil {
+		return nil, err
+	}
+	ref.Name = name
+	return ref, nil
+}
+
+func (tx *kvMetaTxn) setPackedRefs(inode Ino, packedRefs *PackedRefs) error {
+	header, err := json.Marshal(&packedRefsHeader{Header: packedRefs.Header})
+	if err != nil {
+		return err
+	}
+	err = tx.del(packedRefsKey(inode))
+	if err != nil {
+		return err
+	}
+	for _, ref := range packedRefs.Refs {
+		data, err := json.Marshal(ref)
+		if err != nil {
+			return err
+		}
+		if err := tx.hset(packedRefsKey(inode), ref.Name, data); err != nil {
+			return err
+		}
+	}
+	return tx.set(packedRefsHeaderKey(inode), header)
+}
+
+func (tx *kvMetaTxn) delPackedRefs(inode Ino) error {
+	return tx.del(packedRefsKey(inode), packedRefsHeaderKey(inode))
+}
+
+func (tx *kvMetaTxn) reflog(inode Ino) ([][]byte, error) {
+	return tx.lrange(reflogKey(inode))
+}
+
+func (tx *kvMetaTxn) reflogLength(inode Ino) (int64, error) {
+	data, err := tx.get(reflogLengthKey(inode))
+	if err != nil || data == nil {
+		return 0, err
+	}
+	length, err := strconv.ParseInt(string(data), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("length of reflog %d is not an integer: %w", inode, err)
+	}
+	return length, nil
+}
+
+// appendReflog push the entry and add its length without reading, so the
+// append of redis is a single MULTI/EXEC in a batch
+func (tx *kvMetaTxn) appendReflog(inode Ino, entry []byte) error {
+	if err := tx.rpush(reflogKey(inode), entry); err != nil {
+		return err
+	}
+	return tx.incr(reflogLengthKey(inode), int64(len(entry)))
+}
+
+func (tx *kvMetaTxn) delReflog(inode Ino) error {
+	return tx.del(reflogKey(inode), reflogLengthKey(inode))
+}
+
+const sessionsKey = "sessions"
+
+func sessionLockKey(sid uint64) string {
+	return "l" + strconv.FormatUint(sid, 10)
+}
+
+func sustainedKey(sid uint64) string {
+	return "u" + strconv.FormatUint(sid, 10)
+}
+
+func sessionExpireKey(sid uint64) string {
+	return "e" + strconv.FormatUint(sid, 10)
+}
+
+func sessionOpenedKey(sid uint64) string {
+	return "n" + strconv.FormatUint(sid, 10)
+}
+
+func (tx *kvMetaTxn) locks(kind byte, inode Ino) (map[lockOwner][]byte, error) {
+	result, err := tx.hgetall(lockKey(kind, inode))
+	if err != nil {
+		return nil, err
+	}
+	locks := make(map[lockOwner][]byte, len(result))
+	for field, value := range result {
+		owner, err := parseLockOwner(field)
+		if err != nil {
+			return nil, err
+		}
+		locks[owner] = value
+	}
+	return locks, nil
+}
+
+func (tx *kvMetaTxn) setLock(kind byte, inode Ino, owner lockOwner, value []byte) error {
+	if value == nil {
+		return tx.hdel(lockKey(kind, inode), owner.String())
+	}
+	return tx.hset(lockKey(kind, inode), owner.String(), value)
+}
+
+func (tx *kvMetaTxn) sessions() (map[uint64]int64, error) {
+	result, err := tx.hgetall(sessionsKey)
+	if err != nil {
+		return nil, err
+	}
+	sessions := make(map[uint64]int64, len(result))
+	for field, value := range result {
+		sid, err := strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		sessions[sid], err = strconv.ParseInt(string(value), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sessions, nil
+}
+
+// sessionExpire read the key of the session, so that only the heartbeats of
+// the session conflict with the transaction instead of the heartbeats of all
+func (tx *kvMetaTxn) sessionExpire(sid uint64) (int64, error) {
+	value, err := tx.get(sessionExpireKey(sid))
+	if err != nil {
+		return 0, err
+	}
+	if value == nil {
+		// the session is not refreshed since its key is added
+		value, err = tx.hget(sessionsKey, strconv.FormatUint(sid, 10))
+		if err != nil || value == nil {
+			return 0, err
+		}
+	}
+	return strconv.ParseInt(string(value), 10, 64)
+}
+
+func (tx *kvMetaTxn) setSession(sid uint64, expire int64) error {
+	value := []byte(strconv.FormatInt(expire, 10))
+	if err := tx.hset(sessionsKey, strconv.FormatUint(sid, 10), value); err != nil {
+		return err
+	}
+	return tx.set(sessionExpireKey(sid), value)
+}
+
+func (tx *kvMetaTxn) delSession(sid uint64) error {
+	if err := tx.hdel(sessionsKey, strconv.FormatUint(sid, 10)); err != nil {
+		return err
+	}
+	result, err := tx.hgetall(sessionOpenedKey(sid))
+	if err != nil {
+		return err
+	}
+	for field := range result {
+		inode, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return err
+		}
+		if err := tx.hdel(openedKey(Ino(inode)), strconv.FormatUint(sid, 10)); err != nil {
+			return err
+		}
+	}
+	return tx.del(sessionLockKey(sid), sustainedKey(sid), sessionOpenedKey(sid), sessionExpireKey(sid))
+}
+
+func (tx *kvMetaTxn) sessionLocks(sid uint64) ([]Ino, error) {
+	result, err := tx.hgetall(sessionLockKey(sid))
+	if err != nil {
+		return nil, err
+	}
+	inodes := make([]Ino, 0, len(result))
+	for field := range result {
+		inode, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		inodes = append(inodes, Ino(inode))
+	}
+	return inodes, nil
+}
+
+func (tx *kvMetaTxn) addSessionLock(sid uint64, inode Ino) error {
+	return tx.hset(sessionLockKey(sid), inode.String(), []byte{})
+}
+
+func (tx *kvMetaTxn) delSessionLock(sid uint64, inode Ino) error {
+	return tx.hdel(sessionLockKey(sid), inode.String())
+}
+
+func (tx *kvMetaTxn) sustained(sid uint64) ([]Ino, error) {
+	result, err := tx.hgetall(sustainedKey(sid))
+	if err != nil {
+		return nil, err
+	}
+	inodes := make([]Ino, 0, len(result))
+	for field := range result {
+		inode, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		inodes = append(inodes, Ino(inode))
+	}
+	return inodes, nil
+}
+
+func (tx *kvMetaTxn) addSustained(sid uint64, inode Ino) error {
+	return tx.hset(sustainedKey(sid), inode.String(), []byte{})
+}
+
+func (tx *kvMetaTxn) delSustained(sid uint64, inode Ino) error {
+	return tx.hdel(sustainedKey(sid), inode.String())
+}
+
+func openedKey(inode Ino) string {
+	return "o" + inode.String()
+}
+
+func (tx *kvMetaTxn) opened(inode Ino) ([]uint64, error) {
+	result, err := tx.hgetall(openedKey(inode))
+	if err != nil {
+		return nil, err
+	}
+	sids := make([]uint64, 0, len(result))
+	for field := range result {
+		sid, err := strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		sids = append(sids, sid)
+	}
+	return sids, nil
+}
+
+func (tx *kvMetaTxn) addOpened(inode Ino, sid uint64) error {
+	if err := tx.hset(openedKey(inode), strconv.FormatUint(sid, 10), []byte{}); err != nil {
+		return err
+	}
+	return tx.hset(sessionOpenedKey(sid), inode.String(), []byte{})
+}
+
+func (tx *kvMetaTxn) delOpened(inode Ino, sid uint64) error {
+	if err := tx.hdel(openedKey(inode), strconv.FormatUint(sid, 10)); err != nil {
+		return err
+	}
+	return tx.hdel(sessionOpenedKey(sid), inode.String())
+}
+
+func (tx *kvMetaTxn) getCounter(name string) (int64, error) {
+	value, err := tx.get(name)
+	if err != nil || value == nil {
+		return 0, err
+	}
+	return strconv.ParseInt(string(value), 10, 64)
+}
+
+func (tx *kvMetaTxn) setCounter(name string, value int64) error {
+	return tx.set(name, []byte(strconv.FormatInt(value, 10)))
+}
+
+func (tx *kvMetaTxn) incrCounter(name string, value int64) (int64, error) {
+	return tx.incrBy(name, value)
+}
+
+const settingsKey = "settings"
+
+func (tx *kvMetaTxn) getSetting(name string) ([]byte, error) {
+	return tx.hget(settingsKey, name)
+}
+
+func (tx *kvMetaTxn) setSetting(name string, value []byte) error {
+	return tx.hset(settingsKey, name, value)
+}
@@ -0,0 +1,261 @@
+package metadata
+
+import (
+	"context"
+	"syscall"
+)
+
+// flags of Rename, the same as renameat2(2)
+const (
+	RenameNoReplace = 1 << 0
+	RenameExchange  = 1 << 1
+)
+
+func (m *baseMeta) Link(ctx context.Context, parent Ino, target Ino, name string) (*Attr, syscall.Errno) {
+	var attr *Attr
+	err := m.engine.txn(ctx, func(tx metaTxn) error {
+		var err error
+		attr, err = link(tx, parent, target, name)
+		return err
+	})
+	if err != nil {
+		return nil, errno(err)
+	}
+	return attr, syscall.F_OK
+}
+
+func link(tx metaTxn, parent Ino, target Ino, name string) (*Attr, error) {
+	// target.link++
+	attr, err := tx.getattr(target)
+	if err != nil {
+		return nil, err
+	}
+	if attr.Typ == TypeDirectory {
+		return nil, syscall.EISDIR
+	}
+	parentAttr, err := tx.getattr(parent)
+	if err != nil {
+		return nil, err
+	}
+	if parentAttr.Typ != TypeDirectory {
+		return nil, syscall.ENOTDIR
+	}
+
+	// d[parent][name] = target if it does not exist
+	dentry, err := tx.createDentry(parent, name, target, attr.Typ)
+	if err != nil {
+		return nil, err
+	}
+	if dentry != nil {
+		return nil, syscall.EEXIST
+	}
+
+	attr.Nlink++
+	err = tx.setattr(target, attr)
+	if err != nil {
+		return nil, err
+	}
+	return attr, nil
+}
+
+func (m *baseMeta) Unlink(ctx context.Context, parent Ino, name string) syscall.Errno {
+	err := m.engine.txn(ctx, func(tx metaTxn) error {
+		return unlink(tx, parent, name)
+	})
+	return errno(err)
+}
+
+// unlink remove the dentry of the file, and the inode if it is the last link
+// unless it is open, in which case it is sustained by the sessions which have
+// it open until it is closed
+func unlink(tx metaTxn, parent Ino, name string) error {
+	dentry, err := tx.getDentry(parent, name)
+	if err != nil {
+		return err
+	}
+	if dentry == nil {
+		return syscall.ENOENT
+	}
+	if dentry.Typ == TypeDirectory {
+		return syscall.EISDIR
+	}
+	attr, err := tx.getattr(dentry.Ino)
+	if err != nil {
+		return err
+	}
+
+	attr.Nlink--
+
+	err = tx.delDentry(parent, name)
+	if err != nil {
+		return err
+	}
+	if attr.Nlink == 0 {
+		sustained, err := sustain(tx, dentry.Ino)
+		if err != nil {
+			return err
+		}
+		if !sustained {
+			return removeInode(tx, dentry.Ino, attr)
+		}
+	}
+	return tx.setattr(dentry.Ino, attr)
+}
+
+// removeInode delete the inode whose last link is removed with its chunks
+func removeInode(tx metaTxn, inode Ino, attr *Attr) error {
+	err := releaseChunks(tx, inode)
+	if err != nil {
+		return err
+	}
+	err = tx.delattr(inode)
+	if err != nil {
+		return err
+	}
+	_, err = tx.incrCounter(UsedSpace, -int64(attr.Length))
+	return err
+}
+
+// isAncestor return true if dir is ino or one of its ancestors, which is
+// found by walking up the parents of the directories to the root
+func isAncestor(tx metaTxn, dir Ino, ino Ino) (bool, error) {
+	for ino != dir {
+		attr, err := tx.getattr(ino)
+		if err != nil {
+			return false, err
+		}
+		// directories created before the parent is recorded have no parent
+		if attr.Parent == 0 || attr.Parent == ino {
+			return false, nil
+		}
+		ino = attr.Parent
+	}
+	return true, nil
+}
+
+// moveDir update the parent of the directory ino which move from parent to newParent
+func moveDir(tx metaTxn, ino Ino, parent Ino, newParent Ino) error {
+	if parent == newParent {
+		return nil
+	}
+	// a directory can not be moved into its own subtree
+	cycle, err := isAncestor(tx, ino, newParent)
+	if err != nil {
+		return err
+	}
+	if cycle {
+		return syscall.EINVAL
+	}
+
+	attr, err := tx.getattr(ino)
+	if err != nil {
+		return err
+	}
+	attr.Parent = newParent
+	err = tx.setattr(ino, attr)
+	if err != nil {
+		return err
+	}
+
+	// the ".." of the directory move from parent to newParent
+	err = unref(tx, parent)
+	if err != nil {
+		return err
+	}
+	return ref(tx, newParent)
+}
+
+// Rename move parent/oldName to newParent/newName, flags can be RenameNoReplace
+// which fail with EEXIST if newName exists, or RenameExchange which swap them.
+// An existing newName is replaced if it is a file or an empty directory.
+func (m *baseMeta) Rename(ctx context.Context, parent Ino, oldName string, newParent Ino, newName string, flags uint32) syscall.Errno {
+	switch flags {
+	case 0, RenameNoReplace, RenameExchange:
+	default:
+		return syscall.EINVAL
+	}
+	if parent == newParent && oldName == newName {
+		return syscall.F_OK
+	}
+
+	err := m.engine.txn(ctx, func(tx metaTxn) error {
+		dentry, err := tx.getDentry(parent, oldName)
+		if err != nil {
+			return err
+		}
+		if dentry == nil {
+			return syscall.ENOENT
+		}
+		newParentAttr, err := tx.getattr(newParent)
+		if err != nil {
+			return err
+		}
+		if newParentAttr.Typ != TypeDirectory {
+			return syscall.ENOTDIR
+		}
+
+		replaceDentry, err := tx.getDentry(newParent, newName)
+		if err != nil {
+			return err
+		}
+
+		if flags == RenameExchange {
+			if replaceDentry == nil {
+				return syscall.ENOENT
+			}
+			if dentry.Typ == TypeDirectory {
+				if err := moveDir(tx, dentry.Ino, parent, newParent); err != nil {
+					return err
+				}
+			}
+			if replaceDentry.Typ == TypeDirectory {
+				if err := moveDir(tx, replaceDentry.Ino, newParent, parent); err != nil {
+					return err
+				}
+			}
+			err = tx.setDentry(parent, oldName, replaceDentry.Ino, replaceDentry.Typ)
+			if err != nil {
+				return err
+			}
+			return tx.setDentry(newParent, newName, dentry.Ino, dentry.Typ)
+		}
+
+		// if newDir[newName] exists, replace it
+		if replaceDentry != nil {
+			if flags == RenameNoReplace {
+				return syscall.EEXIST
+			}
+			// both are links of the same inode
+			if replaceDentry.Ino == dentry.Ino {
+				return nil
+			}
+			if dentry.Typ == TypeDirectory && replaceDentry.Typ != TypeDirectory {
+				return syscall.ENOTDIR
+			}
+			if dentry.Typ != TypeDirectory && replaceDentry.Typ == TypeDirectory {
+				return syscall.EISDIR
+			}
+
+			if replaceDentry.Typ == TypeDirectory {
+				err = rmdir(tx, newParent, newName)
+			} else {
+				err = unlink(tx, newParent, newName)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		if dentry.Typ == TypeDirectory {
+			if err := moveDir(tx, dentry.Ino, parent, newParent); err != nil {
+				return err
+			}
+		}
+		err = tx.delDentry(parent, oldName)
+		if err != nil {
+			return err
+		}
+		return tx.setDentry(newParent, newName, dentry.Ino, dentry.Typ)
+	})
+	return errno(err)
+}
@@ -0,0 +1,395 @@
+package metadata
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// CurSession is the counter to allocate session ids
+	CurSession = "nextsession"
+
+	// SessionTTL is how long a session keep its locks without a heartbeat,
+	// the locks of the expired sessions are reclaimed by the others
+	SessionTTL = 60 * time.Second
+
+	plockKind byte = 'p'
+	flockKind byte = 'f'
+)
+
+// lockOwner identify the owner of a lock across mounts,
+// sid is the session of the mount, owner is the lock owner from the kernel
+type lockOwner struct {
+	sid   uint64
+	owner uint64
+}
+
+func (o lockOwner) String() string {
+	return fmt.Sprintf("%d:%x", o.sid, o.owner)
+}
+
+func parseLockOwner(s string) (lockOwner, error) {
+	sid, owner, ok := strings.Cut(s, ":")
+	if !ok {
+		return lockOwner{}, fmt.Errorf("bad lock owner: %s", s)
+	}
+	var o lockOwner
+	var err error
+	o.sid, err = strconv.ParseUint(sid, 10, 64)
+	if err != nil {
+		return lockOwner{}, fmt.Errorf("bad lock owner: %s", s)
+	}
+	o.owner, err = strconv.ParseUint(owner, 16, 64)
+	if err != nil {
+		return lockOwner{}, fmt.Errorf("bad lock owner: %s", s)
+	}
+	return o, nil
+}
+
+func lockKey(kind byte, inode Ino) string {
+	return string(kind) + inode.String()
+}
+
+// plockRecord is a posix lock on the range [Start, End]
+type plockRecord struct {
+	Type  uint32 `json:"type"`
+	Pid   uint32 `json:"pid"`
+	Start uint64 `json:"start"`
+	End   uint64 `json:"end"`
+}
+
+func (r *plockRecord) overlap(o *plockRecord) bool {
+	return r.Start <= o.End && o.Start <= r.End
+}
+
+func (r *plockRecord) conflict(o *plockRecord) bool {
+	return r.overlap(o) && (r.Type == syscall.F_WRLCK || o.Type == syscall.F_WRLCK)
+}
+
+// updatePlocks apply the lock lk to the sorted records of an owner,
+// which replace the overlapped ranges and merge the adjacent ones
+func updatePlocks(records []plockRecord, lk plockRecord) []plockRecord {
+	result := make([]plockRecord, 0, len(records)+2)
+	for _, r := range records {
+		if !r.overlap(&lk) {
+			result = append(result, r)
+			continue
+		}
+		if r.Start < lk.Start {
+			left := r
+			left.End = lk.Start - 1
+			result = append(result, left)
+		}
+		if r.End > lk.End {
+			right := r
+			right.Start = lk.End + 1
+			result = append(result, right)
+		}
+	}
+	if lk.Type != syscall.F_UNLCK {
+		result = append(result, lk)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Start < result[j].Start
+	})
+
+	merged := result[:0]
+	for _, r := range result {
+		if n := len(merged); n > 0 {
+			last := &merged[n-1]
+			if last.Type == r.Type && last.End != math.MaxUint64 && last.End+1 == r.Start {
+				last.End = r.End
+				continue
+			}
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+func loadPlocks(value []byte) ([]plockRecord, error) {
+	var records []plockRecord
+	if err := json.Unmarshal(value, &records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// sessionAlive return whether the session is not expired. Only the session
+// itself is read, so the transaction is not aborted by the heartbeats of the others.
+func sessionAlive(tx metaTxn, sid uint64) (bool, error) {
+	expire, err := tx.sessionExpire(sid)
+	if err != nil {
+		return false, err
+	}
+	return expire > time.Now().Unix(), nil
+}
+
+// setLockRecord store the lock record of the owner and maintain the lock index of its session
+func setLockRecord(tx metaTxn, kind byte, inode Ino, owner lockOwner, value []byte) error {
+	if err := tx.setLock(kind, inode, owner, value); err != nil {
+		return err
+	}
+	if value != nil {
+		return tx.addSessionLock(owner.sid, inode)
+	}
+	for _, k := range []byte{plockKind, flockKind} {
+		locks, err := tx.locks(k, inode)
+		if err != nil {
+			return err
+		}
+		for o := range locks {
+			if o.sid == owner.sid {
+				return nil
+			}
+		}
+	}
+	return tx.delSessionLock(owner.sid, inode)
+}
+
+// NewSession register a new session, whose locks are alive until it expire
+func (m *baseMeta) NewSession(ctx context.Context) (uint64, error) {
+	var sid int64
+	err := m.engine.txn(ctx, func(tx metaTxn) error {
+		var err error
+		sid, err = tx.incrCounter(CurSession, 1)
+		if err != nil {
+			return err
+		}
+		return tx.setSession(uint64(sid), time.Now().Add(SessionTTL).Unix())
+	})
+	if err != nil {
+		return 0, err
+	}
+	return uint64(sid), nil
+}
+
+// RefreshSession extend the expire time of the session
+func (m *baseMeta) RefreshSession(ctx context.Context, sid uint64) error {
+	return m.engine.txn(ctx, func(tx metaTxn) error {
+		return tx.setSession(sid, time.Now().Add(SessionTTL).Unix())
+	})
+}
+
+// CloseSession release all the locks of the session, remove the inodes it
+// sustains, e.g. which were open when the client crashed, and remove it
+func (m *baseMeta) CloseSession(ctx context.Context, sid uint64) error {
+	return m.engine.txn(ctx, func(tx metaTxn) error {
+		sustained, err := tx.sustained(sid)
+		if err != nil {
+			return err
+		}
+		for _, inode := range sustained {
+			if err := closeInode(tx, sid, inode); err != nil {
+				return err
+			}
+		}
+
+		inodes, err := tx.sessionLocks(sid)
+		if err != nil {
+			return err
+		}
+		for _, inode := range inodes {
+			for _, kind := range []byte{plockKind, flockKind} {
+				locks, err := tx.locks(kind, inode)
+				if err != nil {
+					return err
+				}
+				for owner := range locks {
+					if owner.sid != sid {
+						continue
+					}
+					if err := tx.setLock(kind, inode, owner, nil); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		return tx.delSession(sid)
+	})
+}
+
+// CleanStaleSessions reclaim the locks of the expired sessions, e.g. from the crashed clients
+func (m *baseMeta) CleanStaleSessions(ctx context.Context) error {
+	var sessions map[uint64]int64
+	err := m.engine.view(ctx, func(tx metaTxn) error {
+		var err error
+		sessions, err = tx.sessions()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+	for sid, expire := range sessions {
+		if expire > now {
+			continue
+		}
+		log.WithFields(
+			log.Fields{
+				"session": sid,
+				"expire":  time.Unix(expire, 0),
+			}).Info("clean stale session")
+		if err := m.CloseSession(ctx, sid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Getlk return the first posix lock conflicting with lk in out, whose type is F_UNLCK if there is none
+func (m *baseMeta) Getlk(ctx context.Context, inode Ino, sid, owner uint64, lk *fuse.FileLock, out *fuse.FileLock) syscall.Errno {
+	want := plockRecord{Type: lk.Typ, Start: lk.Start, End: lk.End}
+	*out = fuse.FileLock{Typ: syscall.F_UNLCK}
+
+	err := m.engine.view(ctx, func(tx metaTxn) error {
+		locks, err := tx.locks(plockKind, inode)
+		if err != nil {
+			return err
+		}
+		for o, value := range locks {
+			if o == (lockOwner{sid, owner}) {
+				continue
+			}
+			records, err := loadPlocks(value)
+			if err != nil {
+				return err
+			}
+			for _, r := range records {
+				if !r.conflict(&want) {
+					continue
+				}
+				alive, err := sessionAlive(tx, o.sid)
+				if err != nil {
+					return err
+				}
+				if !alive {
+					break
+				}
+				*out = fuse.FileLock{Typ: r.Type, Pid: r.Pid, Start: r.Start, End: r.End}
+				return nil
+			}
+		}
+		return nil
+	})
+	return errno(err)
+}
+
+// Setlk acquire or release the posix lock lk, EAGAIN if it conflict with the locks of other owners
+func (m *baseMeta) Setlk(ctx context.Context, inode Ino, sid, owner uint64, lk *fuse.FileLock) syscall.Errno {
+	switch lk.Typ {
+	case syscall.F_RDLCK, syscall.F_WRLCK, syscall.F_UNLCK:
+	default:
+		return syscall.EINVAL
+	}
+	if lk.Start > lk.End {
+		return syscall.EINVAL
+	}
+	want := plockRecord{Type: lk.Typ, Pid: lk.Pid, Start: lk.Start, End: lk.End}
+	me := lockOwner{sid, owner}
+
+	err := m.engine.txn(ctx, func(tx metaTxn) error {
+		locks, err := tx.locks(plockKind, inode)
+		if err != nil {
+			return err
+		}
+		if want.Type != syscall.F_UNLCK {
+			for o, value := range locks {
+				if o == me {
+					continue
+				}
+				records, err := loadPlocks(value)
+				if err != nil {
+					return err
+				}
+				for _, r := range records {
+					if !r.conflict(&want) {
+						continue
+					}
+					alive, err := sessionAlive(tx, o.sid)
+					if err != nil {
+						return err
+					}
+					if alive {
+						return syscall.EAGAIN
+					}
+					break
+				}
+			}
+		}
+
+		var records []plockRecord
+		if value, ok := locks[me]; ok {
+			records, err = loadPlocks(value)
+			if err != nil {
+				return err
+			}
+		} else if want.Type == syscall.F_UNLCK {
+			return nil
+		}
+		records = updatePlocks(records, want)
+		if len(records) == 0 {
+			return setLockRecord(tx, plockKind, inode, me, nil)
+		}
+		value, err := json.Marshal(records)
+		if err != nil {
+			return err
+		}
+		return setLockRecord(tx, plockKind, inode, me, value)
+	})
+	return errno(err)
+}
+
+// Flock acquire or release the flock of the owner, EAGAIN if it conflict with the locks of other owners
+func (m *baseMeta) Flock(ctx context.Context, inode Ino, sid, owner uint64, ltype uint32) syscall.Errno {
+	var value []byte
+	switch ltype {
+	case syscall.F_RDLCK:
+		value = []byte{'R'}
+	case syscall.F_WRLCK:
+		value = []byte{'W'}
+	case syscall.F_UNLCK:
+	default:
+		return syscall.EINVAL
+	}
+	me := lockOwner{sid, owner}
+
+	err := m.engine.txn(ctx, func(tx metaTxn) error {
+		locks, err := tx.locks(flockKind, inode)
+		if err != nil {
+			return err
+		}
+		if value == nil {
+			if _, ok := locks[me]; !ok {
+				return nil
+			}
+			return setLockRecord(tx, flockKind, inode, me, nil)
+		}
+
+		for o, v := range locks {
+			if o == me || (value[0] != 'W' && string(v) != "W") {
+				continue
+			}
+			alive, err := sessionAlive(tx, o.sid)
+			if err != nil {
+				return err
+			}
+			if alive {
+				return syscall.EAGAIN
+			}
+		}
+		return setLockRecord(tx, flockKind, inode, me, value)
+	})
+	return errno(err)
+}
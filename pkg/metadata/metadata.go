@@ -2,8 +2,6 @@ package metadata
 
 import (
 	"context"
-	"fmt"
-	"github.com/go-redis/redis/v8"
 	log "github.com/sirupsen/logrus"
 	"os"
 	"runtime/debug"
@@ -22,27 +20,11 @@ func init() {
 	gid = os.Getgid()
 }
 
-type RedisMeta struct {
-	rdb *redis.Client
-}
-
-// NewRedisMeta create a new meta instenance
-func NewRedisMeta(url string) (*RedisMeta, error) {
-	rdb, err := newRedisClient(url)
-	if err != nil {
-		return nil, err
-	}
-
-	return &RedisMeta{
-		rdb: rdb,
-	}, nil
-}
-
-func (r *RedisMeta) Init(ctx context.Context) error {
+func (m *baseMeta) Init(ctx context.Context) error {
 	rootInode := Ino(1)
 
 	// have initialed
-	if _, err := r.rdb.Get(context.Background(), inodeKey(rootInode)).Result(); err == nil {
+	if _, eno := m.Getattr(ctx, rootInode); eno == syscall.F_OK {
 		return nil
 	}
 
@@ -51,6 +33,7 @@ func (r *RedisMeta) Init(ctx context.Context) error {
 		Mode:   uint16(0755),
 		Nlink:  2,
 		Length: 4 << 10,
+		Parent: rootInode,
 		Uid:    uint32(uid),
 		Gid:    uint32(gid),
 	}
@@ -60,39 +43,21 @@ func (r *RedisMeta) Init(ctx context.Context) error {
 	SetTime(&rootAttr.Ctime, &rootAttr.Ctimensec, ts)
 
 	// root attr 序列化后写到 i1
-	err := r.SetattrDirectly(ctx, rootInode, rootAttr)
+	err := m.SetattrDirectly(ctx, rootInode, rootAttr)
 	if err != nil {
 		return err
 	}
-	r.SetTotalInodeCount(ctx, 1<<30)
+	err = m.SetTotalInodeCount(ctx, 1<<30)
 	if err != nil {
 		return err
 	}
-	r.SetTotalSpace(ctx, 1<<30)
+	err = m.SetTotalSpace(ctx, 1<<30)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func newRedisClient(url string) (*redis.Client, error) {
-	opt, err := redis.ParseURL(url)
-	if err != nil {
-		return nil, fmt.Errorf("parse %s: %s", url, err)
-	}
-	if opt.Password == "" && os.Getenv("REDIS_PASSWORD") != "" {
-		opt.Password = os.Getenv("REDIS_PASSWORD")
-	}
-
-	opt.MaxRetries = 3
-	opt.MinRetryBackoff = time.Millisecond * 100
-	opt.MaxRetryBackoff = time.Minute * 1
-	opt.ReadTimeout = time.Second * 30
-	opt.WriteTimeout = time.Second * 5
-
-	return redis.NewClient(opt), nil
-}
-
 func errno(err error) syscall.Errno {
 	if err == nil {
 		return 0
@@ -100,9 +65,6 @@ func errno(err error) syscall.Errno {
 	if eno, ok := err.(syscall.Errno); ok {
 		return eno
 	}
-	if err == redis.Nil {
-		return syscall.ENOENT
-	}
 
 	debug.PrintStack()
 	log.WithError(err).Error("meet bad error")
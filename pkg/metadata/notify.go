@@ -0,0 +1,107 @@
+package metadata
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// refEventsChannel is the channel ref events are published to
+const refEventsChannel = "refevents"
+
+// subscribeBuffer is the number of messages buffered for a subscriber,
+// messages are dropped if the subscriber is too slow to receive them
+const subscribeBuffer = 256
+
+// RefEvent is published when a ref is changed
+type RefEvent struct {
+	// Repo is the path of the repository relative to the mount point
+	Repo string `json:"repo"`
+	// Ref is the name of the ref, e.g. refs/heads/master or HEAD
+	Ref string `json:"ref"`
+	// Old is the value before the change, empty if the ref is created
+	Old string `json:"old"`
+	// New is the value after the change, empty if the ref is deleted
+	New string `json:"new"`
+}
+
+func (m *baseMeta) PublishRefEvent(ctx context.Context, event *RefEvent) error {
+	msg, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return m.engine.publish(ctx, refEventsChannel, msg)
+}
+
+func (m *baseMeta) WatchRefEvents(ctx context.Context) (<-chan *RefEvent, error) {
+	msgs, err := m.engine.subscribe(ctx, refEventsChannel)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make(chan *RefEvent)
+	go func() {
+		defer close(events)
+		for msg := range msgs {
+			event := &RefEvent{}
+			if err := json.Unmarshal(msg, event); err != nil {
+				log.WithError(err).Warn("skip bad ref event")
+				continue
+			}
+			select {
+			case events <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
+// broker deliver the published messages to the subscribers in this process
+type broker struct {
+	mu   sync.Mutex
+	subs map[string]map[chan []byte]struct{}
+}
+
+func newBroker() *broker {
+	return &broker{
+		subs: make(map[string]map[chan []byte]struct{}),
+	}
+}
+
+func (b *broker) publish(ctx context.Context, channel string, msg []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for sub := range b.subs[channel] {
+		select {
+		case sub <- msg:
+		default:
+			log.WithField("channel", channel).Warn("subscriber is too slow, drop message")
+		}
+	}
+	return nil
+}
+
+func (b *broker) subscribe(ctx context.Context, channel string) (<-chan []byte, error) {
+	sub := make(chan []byte, subscribeBuffer)
+
+	b.mu.Lock()
+	if b.subs[channel] == nil {
+		b.subs[channel] = make(map[chan []byte]struct{})
+	}
+	b.subs[channel][sub] = struct{}{}
+	b.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		b.mu.Lock()
+		delete(b.subs[channel], sub)
+		b.mu.Unlock()
+		close(sub)
+	}()
+	return sub, nil
+}
@@ -0,0 +1,90 @@
+package metadata
+
+import (
+	"context"
+	log "github.com/sirupsen/logrus"
+)
+
+// OpenFile record that the inode is opened by the session in the metadata, so
+// an unlink from any client sustain the inode until it is closed, and it can
+// still be read and written through the handles.
+func (m *baseMeta) OpenFile(ctx context.Context, sid uint64, inode Ino) error {
+	return m.engine.txn(ctx, func(tx metaTxn) error {
+		return tx.addOpened(inode, sid)
+	})
+}
+
+// CloseFile drop the record of OpenFile, and remove the inode if it was
+// unlinked and no other session has it open
+func (m *baseMeta) CloseFile(ctx context.Context, sid uint64, inode Ino) error {
+	log.WithFields(log.Fields{
+		"session": sid,
+		"inode":   inode,
+	}).Debug("close file")
+	return m.engine.txn(ctx, func(tx metaTxn) error {
+		return closeInode(tx, sid, inode)
+	})
+}
+
+// openedBy return the alive sessions which have the inode open, the records
+// left by the expired sessions are dropped
+func openedBy(tx metaTxn, inode Ino) ([]uint64, error) {
+	sids, err := tx.opened(inode)
+	if err != nil || len(sids) == 0 {
+		return nil, err
+	}
+	var opened []uint64
+	for _, sid := range sids {
+		alive, err := sessionAlive(tx, sid)
+		if err != nil {
+			return nil, err
+		}
+		if alive {
+			opened = append(opened, sid)
+			continue
+		}
+		if err := tx.delOpened(inode, sid); err != nil {
+			return nil, err
+		}
+	}
+	return opened, nil
+}
+
+// sustain keep the inode whose last link is removed if any session has it
+// open, every such session sustain it until it is closed
+func sustain(tx metaTxn, inode Ino) (bool, error) {
+	sids, err := openedBy(tx, inode)
+	if err != nil || len(sids) == 0 {
+		return false, err
+	}
+	for _, sid := range sids {
+		if err := tx.addSustained(sid, inode); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// closeInode drop the open of the inode by the session, and remove the inode
+// if it is unlinked and no other session has it open
+func closeInode(tx metaTxn, sid uint64, inode Ino) error {
+	if err := tx.delOpened(inode, sid); err != nil {
+		return err
+	}
+	if err := tx.delSustained(sid, inode); err != nil {
+		return err
+	}
+	attrs, err := tx.getattrs([]Ino{inode})
+	if err != nil {
+		return err
+	}
+	attr := attrs[0]
+	if attr == nil || attr.Nlink > 0 {
+		return nil
+	}
+	sids, err := openedBy(tx, inode)
+	if err != nil || len(sids) > 0 {
+		return err
+	}
+	return removeInode(tx, inode, attr)
+}
@@ -0,0 +1,152 @@
+package metadata
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// PackedRef is a ref record of packed-refs
+type PackedRef struct {
+	Name string `json:"-"`
+	Oid  string `json:"oid"`
+	// Peeled is the object an annotated tag point to, which is empty if it is not peeled
+	Peeled string `json:"peeled,omitempty"`
+}
+
+// PackedRefs is the content of a packed-refs file
+type PackedRefs struct {
+	// Header is the comment lines before the refs, e.g. "# pack-refs with: peeled fully-peeled sorted \n"
+	Header string
+	// Refs are the ref records sorted by their names
+	Refs []*PackedRef
+}
+
+// packedRefsHeader is the json stored with the header of packed-refs
+type packedRefsHeader struct {
+	Header string `json:"header"`
+}
+
+func packedRefsKey(inode Ino) string {
+	return "k" + inode.String()
+}
+
+func packedRefsHeaderKey(inode Ino) string {
+	return "h" + inode.String()
+}
+
+// ParsePackedRefs parse the content of a packed-refs file
+func ParsePackedRefs(data []byte) (*PackedRefs, error) {
+	packedRefs := &PackedRefs{}
+	var last *PackedRef
+	var header strings.Builder
+	for lineno := 1; len(data) > 0; lineno++ {
+		idx := bytes.IndexByte(data, '\n')
+		if idx < 0 {
+			return nil, fmt.Errorf("packed-refs line %d: missing newline", lineno)
+		}
+		line := string(data[:idx])
+		data = data[idx+1:]
+
+		switch {
+		case strings.HasPrefix(line, "#"):
+			if len(packedRefs.Refs) > 0 {
+				return nil, fmt.Errorf("packed-refs line %d: comment after refs", lineno)
+			}
+			header.WriteString(line + "\n")
+		case strings.HasPrefix(line, "^"):
+			if last == nil || last.Peeled != "" || !isOid(line[1:]) {
+				return nil, fmt.Errorf("packed-refs line %d: unexpected peeled line", lineno)
+			}
+			last.Peeled = line[1:]
+		default:
+			oid, name, ok := strings.Cut(line, " ")
+			if !ok || !isOid(oid) || name == "" {
+				return nil, fmt.Errorf("packed-refs line %d: bad ref line", lineno)
+			}
+			last = &PackedRef{
+				Name: name,
+				Oid:  oid,
+			}
+			packedRefs.Refs = append(packedRefs.Refs, last)
+		}
+	}
+	packedRefs.Header = header.String()
+	packedRefs.sort()
+	return packedRefs, nil
+}
+
+// isOid return true if s is a sha1 or sha256 object id in hex
+func isOid(s string) bool {
+	if len(s) != 40 && len(s) != 64 {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func (packedRefs *PackedRefs) sort() {
+	sort.SliceStable(packedRefs.Refs, func(i, j int) bool {
+		return packedRefs.Refs[i].Name < packedRefs.Refs[j].Name
+	})
+}
+
+// Bytes render the packed-refs file
+func (packedRefs *PackedRefs) Bytes() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(packedRefs.Header)
+	for _, ref := range packedRefs.Refs {
+		buf.WriteString(ref.Oid + " " + ref.Name + "\n")
+		if ref.Peeled != "" {
+			buf.WriteString("^" + ref.Peeled + "\n")
+		}
+	}
+	return buf.Bytes()
+}
+
+// PackedRefsSet replace the ref records of the packed-refs file inode
+func (m *baseMeta) PackedRefsSet(ctx context.Context, inode Ino, packedRefs *PackedRefs) error {
+	return m.engine.txn(ctx, func(tx metaTxn) error {
+		return tx.setPackedRefs(inode, packedRefs)
+	})
+}
+
+// PackedRefsGet return all the ref records of the packed-refs file inode, and whether it exists
+func (m *baseMeta) PackedRefsGet(ctx context.Context, inode Ino) (*PackedRefs, bool, error) {
+	var packedRefs *PackedRefs
+	err := m.engine.view(ctx, func(tx metaTxn) error {
+		var err error
+		packedRefs, err = tx.getPackedRefs(inode)
+		return err
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return packedRefs, packedRefs != nil, nil
+}
+
+// PackedRefGet return the record of the ref name in the packed-refs file inode, and whether it exists
+func (m *baseMeta) PackedRefGet(ctx context.Context, inode Ino, name string) (*PackedRef, bool, error) {
+	var ref *PackedRef
+	err := m.engine.view(ctx, func(tx metaTxn) error {
+		var err error
+		ref, err = tx.getPackedRef(inode, name)
+		return err
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return ref, ref != nil, nil
+}
+
+func (m *baseMeta) PackedRefsDel(ctx context.Context, inode Ino) error {
+	return m.engine.txn(ctx, func(tx metaTxn) error {
+		return tx.delPackedRefs(inode)
+	})
+}
@@ -2,128 +2,516 @@ package metadata
 
 import (
 	"context"
-	"syscall"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	log "github.com/sirupsen/logrus"
+	"math/rand"
+	"os"
+	"strconv"
+	"time"
 )
 
-func (r *RedisMeta) Link(ctx context.Context, parent Ino, target Ino, name string) (*Attr, syscall.Errno) {
-	return r.link(ctx, parent, target, name, false)
+func init() {
+	newRedis := func(url string) (Meta, error) {
+		return NewRedisMeta(url)
+	}
+	Register("redis", newRedis)
+	Register("rediss", newRedis)
+}
+
+var _ Meta = (*RedisMeta)(nil)
+
+type RedisMeta struct {
+	*baseMeta
+	rdb *redis.Client
 }
 
-func (r *RedisMeta) link(ctx context.Context, parent Ino, target Ino, name string, allowLinkDir bool) (*Attr, syscall.Errno) {
-	_, find, err := r.GetDentry(ctx, parent, name)
+// NewRedisMeta create a new meta instenance
+func NewRedisMeta(url string) (*RedisMeta, error) {
+	rdb, err := newRedisClient(url)
 	if err != nil {
-		return nil, errno(err)
+		return nil, err
+	}
+
+	return &RedisMeta{
+		baseMeta: newBaseMeta(&kvEngine{client: &redisClient{rdb: rdb}}),
+		rdb:      rdb,
+	}, nil
+}
+
+func newRedisClient(url string) (*redis.Client, error) {
+	opt, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %s", url, err)
+	}
+	if opt.Password == "" && os.Getenv("REDIS_PASSWORD") != "" {
+		opt.Password = os.Getenv("REDIS_PASSWORD")
+	}
+
+	opt.MaxRetries = 3
+	opt.MinRetryBackoff = time.Millisecond * 100
+	opt.MaxRetryBackoff = time.Minute * 1
+	opt.ReadTimeout = time.Second * 30
+	opt.WriteTimeout = time.Second * 5
+
+	return redis.NewClient(opt), nil
+}
+
+// txnRetries is the max times to retry a transaction when its watched keys are modified
+const txnRetries = 50
+
+type redisClient struct {
+	rdb *redis.Client
+}
+
+// txn run fn in an optimistic transaction: every key read by fn is WATCHed,
+// and all the writes of fn are buffered and applied in one MULTI/EXEC, which
+// will be retried if any watched key is changed by others meanwhile.
+func (c *redisClient) txn(ctx context.Context, fn func(tx kvTxn) error) error {
+	for i := 0; i < txnRetries; i++ {
+		err := c.rdb.Watch(ctx, func(tx *redis.Tx) error {
+			rtx := newRedisTxn(ctx, tx)
+			rtx.watch = func(key string) error {
+				return tx.Watch(ctx, key).Err()
+			}
+			if err := fn(rtx); err != nil {
+				// fn may fail because it read keys changed by others
+				if cerr := rtx.check(tx); cerr != nil {
+					return cerr
+				}
+				return err
+			}
+			return rtx.commit(tx)
+		})
+		if err != redis.TxFailedErr {
+			return err
+		}
+		log.WithField("retries", i).Debug("redis transaction conflict, retry")
+		time.Sleep(time.Millisecond * time.Duration(rand.Intn(10*(i+1))))
+	}
+	return fmt.Errorf("redis transaction failed after %d retries", txnRetries)
+}
+
+// batch run fn which only write in one MULTI/EXEC, without the WATCH and
+// UNWATCH of txn, so it cost a single round trip.
+func (c *redisClient) batch(ctx context.Context, fn func(tx kvTxn) error) error {
+	rtx := newRedisTxn(ctx, c.rdb)
+	rtx.watch = func(key string) error {
+		return fmt.Errorf("read %s in a redis batch", key)
+	}
+	if err := fn(rtx); err != nil {
+		return err
+	}
+	if len(rtx.ops) == 0 {
+		return nil
+	}
+	_, err := c.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, op := range rtx.ops {
+			op(pipe)
+		}
+		return nil
+	})
+	return err
+}
+
+// view run fn with redis commands directly, it is only used for reading.
+func (c *redisClient) view(ctx context.Context, fn func(tx kvTxn) error) error {
+	return fn(newRedisTxn(ctx, c.rdb))
+}
+
+// channel return the name of channel in the database, since the channels
+// of redis are shared by all the databases
+func (c *redisClient) channel(channel string) string {
+	return fmt.Sprintf("%s.%d", channel, c.rdb.Options().DB)
+}
+
+func (c *redisClient) publish(ctx context.Context, channel string, msg []byte) error {
+	return c.rdb.Publish(ctx, c.channel(channel), msg).Err()
+}
+
+func (c *redisClient) subscribe(ctx context.Context, channel string) (<-chan []byte, error) {
+	pubsub := c.rdb.Subscribe(ctx, c.channel(channel))
+	// wait for the confirmation, so that no message published after return is missed
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return nil, err
+	}
+
+	msgs := make(chan []byte, subscribeBuffer)
+	go func() {
+		defer close(msgs)
+		defer pubsub.Close()
+		ch := pubsub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-ch:
+				if !ok {
+					return
+				}
+				select {
+				case msgs <- []byte(msg.Payload):
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return msgs, nil
+}
+
+type redisTxn struct {
+	ctx context.Context
+	cmd redis.Cmdable
+	// watch is called before reading a key, nil if in a read-only view
+	watch   func(key string) error
+	watched map[string]bool
+
+	// ops are the buffered writes
+	ops []func(pipe redis.Pipeliner)
+	// strs is the values written by this transaction, nil means deleted
+	strs map[string][]byte
+	// hashes is the fields written by this transaction, nil means deleted
+	hashes map[string]map[string][]byte
+	// lists is the values pushed to the lists by this transaction
+	lists map[string][][]byte
+	// incrs is the increments of the counters not read by this transaction
+	incrs map[string]int64
+	// deleted is the hashes and lists deleted by this transaction
+	deleted map[string]bool
+}
+
+func newRedisTxn(ctx context.Context, cmd redis.Cmdable) *redisTxn {
+	return &redisTxn{
+		ctx:     ctx,
+		cmd:     cmd,
+		watched: make(map[string]bool),
+		strs:    make(map[string][]byte),
+		hashes:  make(map[string]map[string][]byte),
+		lists:   make(map[string][][]byte),
+		incrs:   make(map[string]int64),
+		deleted: make(map[string]bool),
 	}
-	if find {
-		return nil, syscall.EEXIST
+}
+
+func (tx *redisTxn) watchKey(key string) error {
+	if tx.watch == nil || tx.watched[key] {
+		return nil
 	}
+	tx.watched[key] = true
+	return tx.watch(key)
+}
 
-	// target.link++
-	attr, eno := r.Getattr(ctx, target)
-	if eno != syscall.F_OK {
-		return nil, eno
+func (tx *redisTxn) write(op func(pipe redis.Pipeliner)) error {
+	if tx.watch == nil {
+		return fmt.Errorf("write in a read-only redis transaction")
 	}
-	if !allowLinkDir && attr.Typ == TypeDirectory {
-		return nil, syscall.EISDIR
+	tx.ops = append(tx.ops, op)
+	return nil
+}
+
+// commit apply the buffered writes, it fails with redis.TxFailedErr if any
+// watched key have been changed, even if there is nothing to write, so that
+// the values fn read are consistent.
+func (tx *redisTxn) commit(rtx *redis.Tx) error {
+	if len(tx.ops) == 0 {
+		return tx.check(rtx)
 	}
+	_, err := rtx.TxPipelined(tx.ctx, func(pipe redis.Pipeliner) error {
+		for _, op := range tx.ops {
+			op(pipe)
+		}
+		return nil
+	})
+	return err
+}
 
-	attr.Nlink++
-	r.SetattrDirectly(ctx, target, attr)
+// check return redis.TxFailedErr if any watched key have been changed
+func (tx *redisTxn) check(rtx *redis.Tx) error {
+	_, err := rtx.TxPipelined(tx.ctx, func(pipe redis.Pipeliner) error {
+		pipe.Ping(tx.ctx)
+		return nil
+	})
+	return err
+}
 
-	// d[parent][name] = target
-	err = r.SetDentry(ctx, parent, name, target, attr.Typ)
+func (tx *redisTxn) get(key string) ([]byte, error) {
+	if value, ok := tx.strs[key]; ok {
+		return value, nil
+	}
+	if err := tx.watchKey(key); err != nil {
+		return nil, err
+	}
+	value, err := tx.cmd.Get(tx.ctx, key).Bytes()
+	if err == redis.Nil {
+		value, err = nil, nil
+	}
 	if err != nil {
-		return nil, errno(err)
+		return nil, err
 	}
+	return tx.addIncr(key, value)
+}
 
-	// parent.link++
-	eno = r.Ref(ctx, parent)
-	if eno != syscall.F_OK {
-		return nil, eno
+// addIncr add the increment of key by this transaction to the value read from redis
+func (tx *redisTxn) addIncr(key string, value []byte) ([]byte, error) {
+	incr, ok := tx.incrs[key]
+	if !ok {
+		return value, nil
+	}
+	var cur int64
+	if value != nil {
+		var err error
+		cur, err = strconv.ParseInt(string(value), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("value of %s is not an integer: %w", key, err)
+		}
 	}
-	return attr, syscall.F_OK
+	return []byte(strconv.FormatInt(cur+incr, 10)), nil
 }
 
-func (r *RedisMeta) Unlink(ctx context.Context, parent Ino, name string) syscall.Errno {
-	return r.unlink(ctx, parent, name, false)
+func (tx *redisTxn) set(key string, value []byte) error {
+	tx.strs[key] = value
+	return tx.write(func(pipe redis.Pipeliner) {
+		pipe.Set(tx.ctx, key, value, 0)
+	})
 }
 
-func (r *RedisMeta) unlink(ctx context.Context, parent Ino, name string, allowUnlinkDir bool) syscall.Errno {
-	dentry, find, err := r.GetDentry(ctx, parent, name)
-	if !allowUnlinkDir && dentry.Typ == TypeDirectory {
-		return syscall.EISDIR
+func (tx *redisTxn) del(keys ...string) error {
+	for _, key := range keys {
+		tx.strs[key] = nil
+		tx.hashes[key] = make(map[string][]byte)
+		tx.lists[key] = nil
+		tx.deleted[key] = true
 	}
+	return tx.write(func(pipe redis.Pipeliner) {
+		pipe.Del(tx.ctx, keys...)
+	})
+}
+
+func (tx *redisTxn) incrBy(key string, value int64) (int64, error) {
+	var cur int64
+	data, err := tx.get(key)
 	if err != nil {
-		return errno(err)
+		return 0, err
 	}
-	if !find {
-		return syscall.ENOENT
+	if data != nil {
+		cur, err = strconv.ParseInt(string(data), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("value of %s is not an integer: %w", key, err)
+		}
 	}
-	attr, eno := r.Getattr(ctx, dentry.Ino)
-	if eno != syscall.F_OK {
-		return eno
+	cur += value
+	return cur, tx.set(key, []byte(strconv.FormatInt(cur, 10)))
+}
+
+// incr queue an INCRBY without reading the key, a later get of the key in
+// this transaction read it from redis and add the increment
+func (tx *redisTxn) incr(key string, value int64) error {
+	if data, ok := tx.strs[key]; ok {
+		var cur int64
+		if data != nil {
+			var err error
+			cur, err = strconv.ParseInt(string(data), 10, 64)
+			if err != nil {
+				return fmt.Errorf("value of %s is not an integer: %w", key, err)
+			}
+		}
+		tx.strs[key] = []byte(strconv.FormatInt(cur+value, 10))
+	} else {
+		tx.incrs[key] += value
 	}
+	return tx.write(func(pipe redis.Pipeliner) {
+		pipe.IncrBy(tx.ctx, key, value)
+	})
+}
 
-	attr.Nlink--
+func (tx *redisTxn) rpush(key string, value []byte) error {
+	tx.lists[key] = append(tx.lists[key], value)
+	return tx.write(func(pipe redis.Pipeliner) {
+		pipe.RPush(tx.ctx, key, value)
+	})
+}
 
-	r.rdb.HDel(ctx, dentryKey(parent), name)
-	if attr.Nlink == 0 {
-		r.rdb.Del(ctx, inodeKey(dentry.Ino))
-		r.UpdateUsedSpace(ctx, -int64(attr.Length))
-	} else if err := r.SetattrDirectly(ctx, dentry.Ino, attr); err != nil {
-		return errno(err)
+func (tx *redisTxn) lrange(key string) ([][]byte, error) {
+	var values [][]byte
+	if !tx.deleted[key] {
+		if err := tx.watchKey(key); err != nil {
+			return nil, err
+		}
+		result, err := tx.cmd.LRange(tx.ctx, key, 0, -1).Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, value := range result {
+			values = append(values, []byte(value))
+		}
 	}
+	return append(values, tx.lists[key]...), nil
+}
 
-	pattr, eno := r.Getattr(ctx, parent)
-	pattr.Nlink--
-	if err := r.SetattrDirectly(ctx, parent, pattr); err != nil {
-		return errno(err)
+func (tx *redisTxn) hget(key, field string) ([]byte, error) {
+	if value, ok := tx.hashes[key][field]; ok {
+		return value, nil
+	}
+	if tx.deleted[key] {
+		return nil, nil
 	}
+	if err := tx.watchKey(key); err != nil {
+		return nil, err
+	}
+	value, err := tx.cmd.HGet(tx.ctx, key, field).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	return value, err
+}
 
-	return syscall.F_OK
+func (tx *redisTxn) hset(key, field string, value []byte) error {
+	if tx.hashes[key] == nil {
+		tx.hashes[key] = make(map[string][]byte)
+	}
+	tx.hashes[key][field] = value
+	return tx.write(func(pipe redis.Pipeliner) {
+		pipe.HSet(tx.ctx, key, field, value)
+	})
 }
 
-func (r *RedisMeta) Rename(ctx context.Context, parent Ino, oldName string, newParent Ino, newName string) syscall.Errno {
-	if parent == newParent && oldName == newName {
-		return syscall.F_OK
+// hsetnx queue a HSETNX, the field is watched by the check before,
+// so the transaction is retried if others create it before commit
+func (tx *redisTxn) hsetnx(key, field string, value []byte) (bool, error) {
+	old, err := tx.hget(key, field)
+	if err != nil || old != nil {
+		return false, err
+	}
+	if tx.hashes[key] == nil {
+		tx.hashes[key] = make(map[string][]byte)
 	}
+	tx.hashes[key][field] = value
+	return true, tx.write(func(pipe redis.Pipeliner) {
+		pipe.HSetNX(tx.ctx, key, field, value)
+	})
+}
 
-	dentry, find, err := r.GetDentry(ctx, parent, oldName)
-	if err != nil {
-		return errno(err)
+func (tx *redisTxn) hdel(key string, fields ...string) error {
+	if tx.hashes[key] == nil {
+		tx.hashes[key] = make(map[string][]byte)
 	}
-	if !find {
-		return syscall.ENOENT
+	for _, field := range fields {
+		tx.hashes[key][field] = nil
 	}
+	return tx.write(func(pipe redis.Pipeliner) {
+		pipe.HDel(tx.ctx, key, fields...)
+	})
+}
 
-	replaceDentry, find, err := r.GetDentry(ctx, newParent, newName)
-	if err != nil {
-		return errno(err)
+func (tx *redisTxn) hgetall(key string) (map[string][]byte, error) {
+	values := make(map[string][]byte)
+	if !tx.deleted[key] {
+		if err := tx.watchKey(key); err != nil {
+			return nil, err
+		}
+		result, err := tx.cmd.HGetAll(tx.ctx, key).Result()
+		if err != nil {
+			return nil, err
+		}
+		for field, value := range result {
+			values[field] = []byte(value)
+		}
 	}
-	// if newDir[newName] exists, unlink it
-	if find {
-		if replaceDentry.Typ == TypeDirectory {
-			return syscall.EISDIR
+	for field, value := range tx.hashes[key] {
+		if value == nil {
+			delete(values, field)
+		} else {
+			values[field] = value
 		}
-		if dentry.Typ == TypeDirectory {
-			return syscall.ENOTDIR
+	}
+	return values, nil
+}
+
+// hscan return a page of the hash by HSCAN, which may return a field more than
+// once if the hash is rehashed meanwhile. The writes of a transaction are not
+// visible to HSCAN, so the whole hash is returned once it is written.
+func (tx *redisTxn) hscan(key, cursor string, count int) ([]string, [][]byte, string, error) {
+	if len(tx.hashes[key]) > 0 || tx.deleted[key] {
+		values, err := tx.hgetall(key)
+		if err != nil {
+			return nil, nil, "", err
 		}
+		fields, sorted := sortedFields(values)
+		return fields, sorted, "", nil
+	}
+	if err := tx.watchKey(key); err != nil {
+		return nil, nil, "", err
+	}
 
-		eno := r.Unlink(ctx, newParent, newName)
-		if eno != syscall.F_OK {
-			return eno
+	var c uint64
+	if cursor != "" {
+		var err error
+		c, err = strconv.ParseUint(cursor, 10, 64)
+		if err != nil {
+			return nil, nil, "", fmt.Errorf("bad hscan cursor %s: %w", cursor, err)
 		}
 	}
-	// link newDir[newName]
-	_, eno := r.link(ctx, newParent, dentry.Ino, newName, true)
-	if eno != syscall.F_OK {
-		return eno
+	kvs, next, err := tx.cmd.HScan(tx.ctx, key, c, "", int64(count)).Result()
+	if err != nil {
+		return nil, nil, "", err
+	}
+	fields := make([]string, 0, len(kvs)/2)
+	values := make([][]byte, 0, len(kvs)/2)
+	for i := 0; i+1 < len(kvs); i += 2 {
+		fields = append(fields, kvs[i])
+		values = append(values, []byte(kvs[i+1]))
 	}
-	// unlink
-	eno = r.unlink(ctx, parent, oldName, true)
-	if eno != syscall.F_OK {
-		return eno
+	if next == 0 {
+		return fields, values, "", nil
 	}
+	return fields, values, strconv.FormatUint(next, 10), nil
+}
 
-	return syscall.F_OK
+// mget get the keys by one MGET
+func (tx *redisTxn) mget(keys ...string) ([][]byte, error) {
+	values := make([][]byte, len(keys))
+	var remote []string
+	var index []int
+	for i, key := range keys {
+		if value, ok := tx.strs[key]; ok {
+			values[i] = value
+			continue
+		}
+		if err := tx.watchKey(key); err != nil {
+			return nil, err
+		}
+		remote = append(remote, key)
+		index = append(index, i)
+	}
+	if len(remote) == 0 {
+		return values, nil
+	}
+
+	result, err := tx.cmd.MGet(tx.ctx, remote...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for i, value := range result {
+		if s, ok := value.(string); ok {
+			values[index[i]] = []byte(s)
+		}
+		values[index[i]], err = tx.addIncr(remote[i], values[index[i]])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+func (tx *redisTxn) hlen(key string) (int64, error) {
+	if len(tx.hashes[key]) > 0 || tx.deleted[key] {
+		values, err := tx.hgetall(key)
+		return int64(len(values)), err
+	}
+	if err := tx.watchKey(key); err != nil {
+		return 0, err
+	}
+	return tx.cmd.HLen(tx.ctx, key).Result()
 }
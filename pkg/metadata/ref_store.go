@@ -6,14 +6,22 @@ func refKey(inode Ino) string {
 	return "r" + inode.String()
 }
 
-func (r *RedisMeta) RefSet(ctx context.Context, inode Ino, value string) error {
-	return r.rdb.Set(ctx, refKey(inode), value, -1).Err()
+func (m *baseMeta) RefSet(ctx context.Context, inode Ino, value string) error {
+	return m.engine.txn(ctx, func(tx metaTxn) error {
+		return tx.setRef(inode, value)
+	})
 }
 
-func (r *RedisMeta) RefGet(ctx context.Context, inode Ino) (string, error) {
-	return r.rdb.Get(ctx, refKey(inode)).Result()
-}
-
-func (r *RedisMeta) RefDel(ctx context.Context, inode Ino) error {
-	return r.rdb.Del(ctx, refKey(inode)).Err()
+func (m *baseMeta) RefGet(ctx context.Context, inode Ino) (string, bool, error) {
+	var value string
+	var find bool
+	err := m.engine.view(ctx, func(tx metaTxn) error {
+		var err error
+		value, find, err = tx.getRef(inode)
+		return err
+	})
+	if err != nil {
+		return "", false, err
+	}
+	return value, find, nil
 }
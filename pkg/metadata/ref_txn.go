@@ -0,0 +1,372 @@
+package metadata
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	gitDirName        = ".git"
+	packedRefsName    = "packed-refs"
+	refDirMode        = 0755
+	refFileMode       = 0644
+	lockFileExtension = ".lock"
+)
+
+// RefUpdate is a compare-and-swap of a ref in UpdateRefs, the value of a ref
+// is the one in its ref file, or the record in packed-refs if there is no file
+type RefUpdate struct {
+	// Ref is the name of the ref relative to the .git directory, e.g. refs/heads/master
+	Ref string
+	// Old is the value the ref must have, a zero oid if the ref must not exist,
+	// or empty if the ref is not checked
+	Old string
+	// New is the value to set, a zero oid to delete the ref, or empty to only check Old
+	New string
+}
+
+// RefConflictError is returned by UpdateRefs if a ref does not have the expected value
+type RefConflictError struct {
+	Ref      string
+	Expected string
+	Actual   string
+}
+
+func (e *RefConflictError) Error() string {
+	if e.Actual == "" {
+		return fmt.Sprintf("ref %s: expected %s, but it does not exist", e.Ref, e.Expected)
+	}
+	return fmt.Sprintf("ref %s: expected %s, but it is %s", e.Ref, e.Expected, e.Actual)
+}
+
+// isZeroOid return true if s is an object id of all zeros, which git use for a missing ref
+func isZeroOid(s string) bool {
+	return isOid(s) && strings.Trim(s, "0") == ""
+}
+
+// checkRefName return an error if ref is not a clean relative path or is a lock file
+func checkRefName(ref string) error {
+	if ref == "" || path.Clean(ref) != ref || strings.HasPrefix(ref, "/") ||
+		strings.HasPrefix(ref, "../") || ref == ".." || strings.HasSuffix(ref, lockFileExtension) {
+		return fmt.Errorf("bad ref name %q", ref)
+	}
+	return nil
+}
+
+// UpdateRefs apply the updates to the refs of the repository at repo, which is a
+// path relative to the root, in one transaction, so either all the refs are
+// updated or none of them is if any Old does not match. The missing directories
+// of the new refs are created, and the changes are published as ref events.
+func (m *baseMeta) UpdateRefs(ctx context.Context, repo string, updates []*RefUpdate) error {
+	repo = strings.Trim(path.Clean("/"+repo), "/")
+	seen := make(map[string]bool, len(updates))
+	for _, update := range updates {
+		if err := checkRefName(update.Ref); err != nil {
+			return err
+		}
+		if (update.Old != "" && !isOid(update.Old)) || (update.New != "" && !isOid(update.New)) {
+			return fmt.Errorf("bad object id of ref %s", update.Ref)
+		}
+		if seen[update.Ref] {
+			return fmt.Errorf("ref %s is updated more than once", update.Ref)
+		}
+		seen[update.Ref] = true
+	}
+
+	var events []*RefEvent
+	err := m.engine.txn(ctx, func(tx metaTxn) error {
+		events = events[:0]
+
+		gitDir, err := lookupDir(tx, Ino(1), path.Join(repo, gitDirName))
+		if err != nil {
+			return err
+		}
+		for _, update := range updates {
+			event, err := updateRef(tx, gitDir, update)
+			if err != nil {
+				return err
+			}
+			if event != nil {
+				event.Repo = repo
+				events = append(events, event)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, event := range events {
+		// the refs have been updated, so the watchers just miss the event
+		if err := m.PublishRefEvent(ctx, event); err != nil {
+			log.WithFields(
+				log.Fields{
+					"repo": event.Repo,
+					"ref":  event.Ref,
+				}).WithError(err).Warn("publish ref event failed")
+		}
+	}
+	return nil
+}
+
+// lookupDir return the inode of the directory at the slash-separated path under dir
+func lookupDir(tx metaTxn, dir Ino, dirPath string) (Ino, error) {
+	for _, name := range strings.Split(dirPath, "/") {
+		if name == "" {
+			continue
+		}
+		dentry, err := tx.getDentry(dir, name)
+		if err != nil {
+			return 0, err
+		}
+		if dentry == nil {
+			return 0, syscall.ENOENT
+		}
+		if dentry.Typ != TypeDirectory {
+			return 0, syscall.ENOTDIR
+		}
+		dir = dentry.Ino
+	}
+	return dir, nil
+}
+
+// updateRef apply the update in the .git directory gitDir, and return the
+// event of the change, nil if the ref is not changed
+func updateRef(tx metaTxn, gitDir Ino, update *RefUpdate) (*RefEvent, error) {
+	elems := strings.Split(update.Ref, "/")
+	name := elems[len(elems)-1]
+
+	// walk down the existing directories of the ref
+	dir := gitDir
+	var missing []string
+	for i, elem := range elems[:len(elems)-1] {
+		dentry, err := tx.getDentry(dir, elem)
+		if err != nil {
+			return nil, err
+		}
+		if dentry == nil {
+			missing = elems[i : len(elems)-1]
+			break
+		}
+		if dentry.Typ != TypeDirectory {
+			return nil, syscall.ENOTDIR
+		}
+		dir = dentry.Ino
+	}
+
+	var dentry *Dentry
+	if missing == nil {
+		var err error
+		dentry, err = tx.getDentry(dir, name)
+		if err != nil {
+			return nil, err
+		}
+		if dentry != nil && dentry.Typ != TypeFile {
+			return nil, syscall.EISDIR
+		}
+		// a git process holding the lock would overwrite the ref
+		lock, err := tx.getDentry(dir, name+lockFileExtension)
+		if err != nil {
+			return nil, err
+		}
+		if lock != nil {
+			return nil, fmt.Errorf("ref %s is locked", update.Ref)
+		}
+	}
+
+	current, packed, err := refValue(tx, gitDir, dentry, update.Ref)
+	if err != nil {
+		return nil, err
+	}
+	// the object ids of the repository are all in its object format
+	for _, oid := range []string{update.Old, update.New} {
+		if isOid(current) && oid != "" && !isZeroOid(oid) && len(oid) != len(current) {
+			return nil, fmt.Errorf("object id %s of ref %s is not in the object format of the repository", oid, update.Ref)
+		}
+	}
+	if update.Old != "" {
+		if isZeroOid(update.Old) {
+			if current != "" {
+				return nil, &RefConflictError{Ref: update.Ref, Expected: update.Old, Actual: current}
+			}
+		} else if current != update.Old {
+			return nil, &RefConflictError{Ref: update.Ref, Expected: update.Old, Actual: current}
+		}
+	}
+	if update.New == "" || update.New == current || (isZeroOid(update.New) && current == "") {
+		return nil, nil
+	}
+
+	event := &RefEvent{
+		Ref: update.Ref,
+		Old: current,
+		New: update.New,
+	}
+	if isZeroOid(update.New) {
+		event.New = ""
+		if dentry != nil {
+			if err := unlink(tx, dir, name); err != nil {
+				return nil, err
+			}
+		}
+		if packed {
+			if err := unpackRef(tx, gitDir, update.Ref); err != nil {
+				return nil, err
+			}
+		}
+		// git delete the reflog of a ref with it
+		if err := deleteReflog(tx, gitDir, update.Ref); err != nil {
+			return nil, err
+		}
+		return event, nil
+	}
+
+	// a ref file take precedence over the record in packed-refs
+	for _, elem := range missing {
+		dir, err = createRefInode(tx, dir, TypeDirectory, elem, refDirMode)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var ino Ino
+	if dentry != nil {
+		ino = dentry.Ino
+	} else {
+		ino, err = createRefInode(tx, dir, TypeFile, name, refFileMode)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	value := update.New + "\n"
+	if err := tx.setRef(ino, value); err != nil {
+		return nil, err
+	}
+	attr, err := tx.getattr(ino)
+	if err != nil {
+		return nil, err
+	}
+	oldLength := attr.Length
+	attr.Length = uint64(len(value))
+	ts := time.Now()
+	SetTime(&attr.Mtime, &attr.Mtimensec, ts)
+	SetTime(&attr.Ctime, &attr.Ctimensec, ts)
+	if err := tx.setattr(ino, attr); err != nil {
+		return nil, err
+	}
+	// the space is released by removeInode when the ref is deleted
+	if _, err := tx.incrCounter(UsedSpace, int64(attr.Length)-int64(oldLength)); err != nil {
+		return nil, err
+	}
+	return event, nil
+}
+
+// deleteReflog remove the reflog of ref in gitDir if it exists
+func deleteReflog(tx metaTxn, gitDir Ino, ref string) error {
+	dir, name := path.Split(path.Join("logs", ref))
+	logDir, err := lookupDir(tx, gitDir, dir)
+	if err == syscall.ENOENT || err == syscall.ENOTDIR {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	dentry, err := tx.getDentry(logDir, name)
+	if err != nil || dentry == nil || dentry.Typ != TypeFile {
+		return err
+	}
+	return unlink(tx, logDir, name)
+}
+
+// refValue return the value of the ref in its ref file dentry, or in packed-refs
+// if dentry is nil, and whether the ref is in packed-refs
+func refValue(tx metaTxn, gitDir Ino, dentry *Dentry, ref string) (string, bool, error) {
+	record, err := packedRef(tx, gitDir, ref)
+	if err != nil {
+		return "", false, err
+	}
+	packed := record != nil
+
+	if dentry != nil {
+		value, _, err := tx.getRef(dentry.Ino)
+		if err != nil {
+			return "", false, err
+		}
+		return strings.TrimSpace(value), packed, nil
+	}
+	if packed {
+		return record.Oid, true, nil
+	}
+	return "", false, nil
+}
+
+// packedRef return the record of ref in the packed-refs of gitDir, nil if it does not exist
+func packedRef(tx metaTxn, gitDir Ino, ref string) (*PackedRef, error) {
+	dentry, err := tx.getDentry(gitDir, packedRefsName)
+	if err != nil || dentry == nil {
+		return nil, err
+	}
+	return tx.getPackedRef(dentry.Ino, ref)
+}
+
+// unpackRef remove the record of ref from the packed-refs of gitDir
+func unpackRef(tx metaTxn, gitDir Ino, ref string) error {
+	dentry, err := tx.getDentry(gitDir, packedRefsName)
+	if err != nil || dentry == nil {
+		return err
+	}
+	packedRefs, err := tx.getPackedRefs(dentry.Ino)
+	if err != nil || packedRefs == nil {
+		return err
+	}
+	refs := packedRefs.Refs[:0]
+	for _, packedRef := range packedRefs.Refs {
+		if packedRef.Name != ref {
+			refs = append(refs, packedRef)
+		}
+	}
+	packedRefs.Refs = refs
+	if err := tx.setPackedRefs(dentry.Ino, packedRefs); err != nil {
+		return err
+	}
+
+	attr, err := tx.getattr(dentry.Ino)
+	if err != nil {
+		return err
+	}
+	attr.Length = uint64(len(packedRefs.Bytes()))
+	ts := time.Now()
+	SetTime(&attr.Mtime, &attr.Mtimensec, ts)
+	SetTime(&attr.Ctime, &attr.Ctimensec, ts)
+	return tx.setattr(dentry.Ino, attr)
+}
+
+// createRefInode create a file or directory in parent in a transaction, and return its inode
+func createRefInode(tx metaTxn, parent Ino, _type uint8, name string, mode uint32) (Ino, error) {
+	ino, err := allocInode(tx)
+	if err != nil {
+		return 0, err
+	}
+
+	dentry, err := tx.createDentry(parent, name, ino, _type)
+	if err != nil {
+		return 0, err
+	}
+	if dentry != nil {
+		return 0, syscall.EEXIST
+	}
+	if err := tx.setattr(ino, newAttr(parent, _type, mode, 0, "")); err != nil {
+		return 0, err
+	}
+	if _type == TypeDirectory {
+		return ino, ref(tx, parent)
+	}
+	return ino, nil
+}
@@ -0,0 +1,61 @@
+package metadata
+
+import (
+	"bytes"
+	"context"
+)
+
+func reflogKey(inode Ino) string {
+	return "g" + inode.String()
+}
+
+func reflogLengthKey(inode Ino) string {
+	return "z" + inode.String()
+}
+
+// ReflogAppend append entry to the reflog of inode in a batch, which cost a
+// single round trip of redis
+func (m *baseMeta) ReflogAppend(ctx context.Context, inode Ino, entry []byte) error {
+	return m.engine.batch(ctx, func(tx metaTxn) error {
+		return tx.appendReflog(inode, entry)
+	})
+}
+
+func (m *baseMeta) ReflogGet(ctx context.Context, inode Ino) ([]byte, error) {
+	var entries [][]byte
+	err := m.engine.view(ctx, func(tx metaTxn) error {
+		var err error
+		entries, err = tx.reflog(inode)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return bytes.Join(entries, nil), nil
+}
+
+func (m *baseMeta) ReflogLength(ctx context.Context, inode Ino) (uint64, error) {
+	var length int64
+	err := m.engine.view(ctx, func(tx metaTxn) error {
+		var err error
+		length, err = tx.reflogLength(inode)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return uint64(length), nil
+}
+
+// ReflogSet replace the entries of the reflog of inode with content
+func (m *baseMeta) ReflogSet(ctx context.Context, inode Ino, content []byte) error {
+	return m.engine.txn(ctx, func(tx metaTxn) error {
+		if err := tx.delReflog(inode); err != nil {
+			return err
+		}
+		if len(content) == 0 {
+			return nil
+		}
+		return tx.appendReflog(inode, content)
+	})
+}
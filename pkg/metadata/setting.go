@@ -0,0 +1,35 @@
+package metadata
+
+import (
+	"context"
+)
+
+func (m *baseMeta) InitSetting(ctx context.Context, name string, value []byte) ([]byte, error) {
+	var stored []byte
+	err := m.engine.txn(ctx, func(tx metaTxn) error {
+		var err error
+		stored, err = tx.getSetting(name)
+		if err != nil || stored != nil {
+			return err
+		}
+		stored = value
+		return tx.setSetting(name, value)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stored, nil
+}
+
+func (m *baseMeta) GetSetting(ctx context.Context, name string) ([]byte, error) {
+	var value []byte
+	err := m.engine.view(ctx, func(tx metaTxn) error {
+		var err error
+		value, err = tx.getSetting(name)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
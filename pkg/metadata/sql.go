@@ -0,0 +1,997 @@
+package metadata
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	log "github.com/sirupsen/logrus"
+)
+
+func init() {
+	Register("sqlite3", func(url string) (Meta, error) {
+		return NewSqlMeta(url)
+	})
+}
+
+var _ Meta = (*SqlMeta)(nil)
+
+const sqlSchema = `
+CREATE TABLE IF NOT EXISTS inodes (
+	ino       INTEGER PRIMARY KEY,
+	flags     INTEGER NOT NULL DEFAULT 0,
+	type      INTEGER NOT NULL,
+	mode      INTEGER NOT NULL,
+	uid       INTEGER NOT NULL,
+	gid       INTEGER NOT NULL,
+	atime     INTEGER NOT NULL,
+	mtime     INTEGER NOT NULL,
+	ctime     INTEGER NOT NULL,
+	atimensec INTEGER NOT NULL,
+	mtimensec INTEGER NOT NULL,
+	ctimensec INTEGER NOT NULL,
+	nlink     INTEGER NOT NULL,
+	length    INTEGER NOT NULL,
+	rdev      INTEGER NOT NULL,
+	parent    INTEGER NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS dentries (
+	parent INTEGER NOT NULL,
+	name   TEXT    NOT NULL,
+	ino    INTEGER NOT NULL,
+	type   INTEGER NOT NULL,
+	PRIMARY KEY (parent, name)
+);
+CREATE INDEX IF NOT EXISTS dentries_ino ON dentries (ino);
+CREATE TABLE IF NOT EXISTS symlinks (
+	ino    INTEGER PRIMARY KEY,
+	target TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS xattrs (
+	ino   INTEGER NOT NULL,
+	name  TEXT    NOT NULL,
+	value BLOB    NOT NULL,
+	PRIMARY KEY (ino, name)
+);
+CREATE TABLE IF NOT EXISTS chunks (
+	ino          INTEGER NOT NULL,
+	page         INTEGER NOT NULL,
+	off          INTEGER NOT NULL,
+	length       INTEGER NOT NULL,
+	storage_path TEXT    NOT NULL,
+	object_off   INTEGER NOT NULL DEFAULT 0,
+	compression  TEXT    NOT NULL DEFAULT '',
+	stored_len   INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (ino, page)
+);
+CREATE TABLE IF NOT EXISTS chunk_refs (
+	path  TEXT    PRIMARY KEY,
+	refs    INTEGER NOT NULL,
+	size    INTEGER NOT NULL,
+	bytes   INTEGER NOT NULL,
+	pending INTEGER NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS refs (
+	ino   INTEGER PRIMARY KEY,
+	value TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS packed_refs (
+	ino    INTEGER NOT NULL,
+	name   TEXT    NOT NULL,
+	oid    TEXT    NOT NULL,
+	peeled TEXT    NOT NULL,
+	PRIMARY KEY (ino, name)
+);
+CREATE TABLE IF NOT EXISTS packed_refs_headers (
+	ino    INTEGER PRIMARY KEY,
+	header TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS reflogs (
+	id    INTEGER PRIMARY KEY AUTOINCREMENT,
+	ino   INTEGER NOT NULL,
+	entry BLOB    NOT NULL
+);
+CREATE INDEX IF NOT EXISTS reflogs_ino ON reflogs (ino);
+CREATE TABLE IF NOT EXISTS locks (
+	ino   INTEGER NOT NULL,
+	kind  INTEGER NOT NULL,
+	sid   INTEGER NOT NULL,
+	owner INTEGER NOT NULL,
+	value BLOB    NOT NULL,
+	PRIMARY KEY (ino, kind, sid, owner)
+);
+CREATE TABLE IF NOT EXISTS sessions (
+	sid    INTEGER PRIMARY KEY,
+	expire INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS session_locks (
+	sid INTEGER NOT NULL,
+	ino INTEGER NOT NULL,
+	PRIMARY KEY (sid, ino)
+);
+CREATE TABLE IF NOT EXISTS sustained (
+	sid INTEGER NOT NULL,
+	ino INTEGER NOT NULL,
+	PRIMARY KEY (sid, ino)
+);
+CREATE TABLE IF NOT EXISTS opened (
+	ino INTEGER NOT NULL,
+	sid INTEGER NOT NULL,
+	PRIMARY KEY (ino, sid)
+);
+CREATE TABLE IF NOT EXISTS messages (
+	id      INTEGER PRIMARY KEY AUTOINCREMENT,
+	channel TEXT    NOT NULL,
+	value   BLOB    NOT NULL,
+	time    INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS counters (
+	name  TEXT PRIMARY KEY,
+	value INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS settings (
+	name  TEXT PRIMARY KEY,
+	value BLOB NOT NULL
+);
+`
+
+// sqlMigrations add the columns added after the tables are created, the
+// errors of the columns which already exist are ignored
+var sqlMigrations = []string{
+	`ALTER TABLE chunks ADD COLUMN object_off INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE chunks ADD COLUMN compression TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE chunks ADD COLUMN stored_len INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE chunk_refs ADD COLUMN pending INTEGER NOT NULL DEFAULT 0`,
+}
+
+// SqlMeta is a metadata engine stored in a sqlite database, inodes, dentries,
+// chunks and refs are kept in their own tables, and every file system
+// operation runs in a single sql transaction.
+type SqlMeta struct {
+	*baseMeta
+	db     *sql.DB
+	readDB *sql.DB
+}
+
+// NewSqlMeta create a new meta instance with url like sqlite3:///var/lib/tinygitfs/meta.db
+func NewSqlMeta(url string) (*SqlMeta, error) {
+	path := strings.TrimPrefix(url, "sqlite3://")
+	if path == "" {
+		return nil, fmt.Errorf("invalid sqlite3 url %s: missing database path", url)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	// take the write lock at the beginning of transactions, so that two
+	// writers never deadlock on upgrading their read locks
+	dsn := fmt.Sprintf("file:%s?_busy_timeout=5000&_journal_mode=WAL&_txlock=immediate&_foreign_keys=off", path)
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", path, err)
+	}
+	if _, err = db.Exec(sqlSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("create tables in %s: %w", path, err)
+	}
+	for _, migration := range sqlMigrations {
+		_, err = db.Exec(migration)
+		if err != nil && !strings.Contains(err.Error(), "duplicate column name") {
+			db.Close()
+			return nil, fmt.Errorf("migrate tables in %s: %w", path, err)
+		}
+	}
+
+	// the read only transactions are deferred, so that they read a snapshot
+	// of the database without taking the write lock
+	readDsn := fmt.Sprintf("file:%s?_busy_timeout=5000&_txlock=deferred&_query_only=1", path)
+	readDB, err := sql.Open("sqlite3", readDsn)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("open %s: %w", path, err)
+	}
+
+	return &SqlMeta{
+		baseMeta: newBaseMeta(&sqlEngine{db: db, readDB: readDB}),
+		db:       db,
+		readDB:   readDB,
+	}, nil
+}
+
+// Close release the database
+func (s *SqlMeta) Close() error {
+	readErr := s.readDB.Close()
+	if err := s.db.Close(); err != nil {
+		return err
+	}
+	return readErr
+}
+
+type sqlEngine struct {
+	db *sql.DB
+	// readDB is the pool of the read only transactions of view
+	readDB *sql.DB
+}
+
+func (e *sqlEngine) txn(ctx context.Context, fn func(tx metaTxn) error) error {
+	tx, err := e.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	err = fn(&sqlTxn{ctx: ctx, q: tx})
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// batch is the same as txn, since sqlite has no round trip
+func (e *sqlEngine) batch(ctx context.Context, fn func(tx metaTxn) error) error {
+	return e.txn(ctx, fn)
+}
+
+// view run fn in a read only transaction, so all the reads see the same
+// snapshot of the database
+func (e *sqlEngine) view(ctx context.Context, fn func(tx metaTxn) error) error {
+	tx, err := e.readDB.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	return fn(&sqlTxn{ctx: ctx, q: tx})
+}
+
+// messageTTL is how long the published messages are kept for the subscribers to poll
+const messageTTL = time.Minute
+
+// messagePollInterval is how often the subscribers poll the new messages
+const messagePollInterval = 100 * time.Millisecond
+
+// publish append msg to the messages table, which is polled by the subscribers
+// in any process, and remove the messages older than messageTTL
+func (e *sqlEngine) publish(ctx context.Context, channel string, msg []byte) error {
+	now := time.Now()
+	_, err := e.db.ExecContext(ctx, `INSERT INTO messages (channel, value, time) VALUES (?, ?, ?)`,
+		channel, msg, now.UnixNano())
+	if err != nil {
+		return err
+	}
+	_, err = e.db.ExecContext(ctx, `DELETE FROM messages WHERE time < ?`, now.Add(-messageTTL).UnixNano())
+	return err
+}
+
+func (e *sqlEngine) subscribe(ctx context.Context, channel string) (<-chan []byte, error) {
+	var last int64
+	err := e.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(id), 0) FROM messages`).Scan(&last)
+	if err != nil {
+		return nil, err
+	}
+
+	msgs := make(chan []byte, subscribeBuffer)
+	go func() {
+		defer close(msgs)
+		ticker := time.NewTicker(messagePollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			values, id, err := e.poll(ctx, channel, last)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.WithError(err).Warn("poll messages failed")
+				}
+				continue
+			}
+			last = id
+			for _, value := range values {
+				select {
+				case msgs <- value:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return msgs, nil
+}
+
+// poll return the messages of channel after id, and the id of the last message
+func (e *sqlEngine) poll(ctx context.Context, channel string, id int64) ([][]byte, int64, error) {
+	rows, err := e.db.QueryContext(ctx, `SELECT id, channel, value FROM messages WHERE id > ? ORDER BY id`, id)
+	if err != nil {
+		return nil, id, err
+	}
+	defer rows.Close()
+
+	var values [][]byte
+	for rows.Next() {
+		var ch string
+		var value []byte
+		if err := rows.Scan(&id, &ch, &value); err != nil {
+			return nil, id, err
+		}
+		if ch == channel {
+			values = append(values, value)
+		}
+	}
+	return values, id, rows.Err()
+}
+
+// sqlQuerier is implemented by both *sql.DB and *sql.Tx
+type sqlQuerier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+type sqlTxn struct {
+	ctx context.Context
+	q   sqlQuerier
+}
+
+func (tx *sqlTxn) exec(query string, args ...interface{}) error {
+	_, err := tx.q.ExecContext(tx.ctx, query, args...)
+	return err
+}
+
+const attrColumns = `flags, type, mode, uid, gid, atime, mtime, ctime,
+	atimensec, mtimensec, ctimensec, nlink, length, rdev, parent`
+
+// rowScanner is *sql.Row or *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanAttr scan the attrColumns of a row into attr
+func scanAttr(row rowScanner, attr *Attr, dest ...interface{}) error {
+	return row.Scan(append(dest,
+		&attr.Flags, &attr.Typ, &attr.Mode, &attr.Uid, &attr.Gid, &attr.Atime, &attr.Mtime, &attr.Ctime,
+		&attr.Atimensec, &attr.Mtimensec, &attr.Ctimensec, &attr.Nlink, &attr.Length, &attr.Rdev, &attr.Parent)...)
+}
+
+func (tx *sqlTxn) getattr(ino Ino) (*Attr, error) {
+	attr := &Attr{}
+	err := scanAttr(tx.q.QueryRowContext(tx.ctx, `SELECT `+attrColumns+` FROM inodes WHERE ino = ?`, ino), attr)
+	if err == sql.ErrNoRows {
+		return nil, syscall.ENOENT
+	}
+	if err != nil {
+		return nil, err
+	}
+	return attr, nil
+}
+
+// sqlMaxVars is the max number of the variables in a statement of sqlite
+const sqlMaxVars = 999
+
+func (tx *sqlTxn) getattrs(inos []Ino) ([]*Attr, error) {
+	attrs := make([]*Attr, len(inos))
+	index := make(map[Ino][]int, len(inos))
+	for i, ino := range inos {
+		index[ino] = append(index[ino], i)
+	}
+
+	for start := 0; start < len(inos); start += sqlMaxVars {
+		end := start + sqlMaxVars
+		if end > len(inos) {
+			end = len(inos)
+		}
+		args := make([]interface{}, 0, end-start)
+		for _, ino := range inos[start:end] {
+			args = append(args, ino)
+		}
+		query := `SELECT ino, ` + attrColumns + ` FROM inodes WHERE ino IN (?` +
+			strings.Repeat(", ?", len(args)-1) + `)`
+
+		err := func() error {
+			rows, err := tx.q.QueryContext(tx.ctx, query, args...)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var ino Ino
+				attr := &Attr{}
+				if err := scanAttr(rows, attr, &ino); err != nil {
+					return err
+				}
+				for _, i := range index[ino] {
+					attrs[i] = attr
+				}
+			}
+			return rows.Err()
+		}()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return attrs, nil
+}
+
+func (tx *sqlTxn) setattr(ino Ino, attr *Attr) error {
+	return tx.exec(`INSERT OR REPLACE INTO inodes (ino, flags, type, mode, uid, gid, atime, mtime, ctime,
+		atimensec, mtimensec, ctimensec, nlink, length, rdev, parent) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		ino, attr.Flags, attr.Typ, attr.Mode, attr.Uid, attr.Gid, attr.Atime, attr.Mtime, attr.Ctime,
+		attr.Atimensec, attr.Mtimensec, attr.Ctimensec, attr.Nlink, attr.Length, attr.Rdev, attr.Parent)
+}
+
+func (tx *sqlTxn) delattr(ino Ino) error {
+	err := tx.exec(`DELETE FROM inodes WHERE ino = ?`, ino)
+	if err != nil {
+		return err
+	}
+	err = tx.exec(`DELETE FROM symlinks WHERE ino = ?`, ino)
+	if err != nil {
+		return err
+	}
+	err = tx.exec(`DELETE FROM xattrs WHERE ino = ?`, ino)
+	if err != nil {
+		return err
+	}
+	err = tx.delRef(ino)
+	if err != nil {
+		return err
+	}
+	err = tx.delPackedRefs(ino)
+	if err != nil {
+		return err
+	}
+	err = tx.delReflog(ino)
+	if err != nil {
+		return err
+	}
+	return tx.exec(`DELETE FROM locks WHERE ino = ?`, ino)
+}
+
+func (tx *sqlTxn) getDentry(parent Ino, name string) (*Dentry, error) {
+	d := &Dentry{
+		name: name,
+	}
+	err := tx.q.QueryRowContext(tx.ctx, `SELECT ino, type FROM dentries WHERE parent = ? AND name = ?`,
+		parent, name).Scan(&d.Ino, &d.Typ)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (tx *sqlTxn) setDentry(parent Ino, name string, inode Ino, typ uint8) error {
+	return tx.exec(`INSERT OR REPLACE INTO dentries (parent, name, ino, type) VALUES (?, ?, ?, ?)`,
+		parent, name, inode, typ)
+}
+
+func (tx *sqlTxn) createDentry(parent Ino, name string, inode Ino, typ uint8) (*Dentry, error) {
+	result, err := tx.q.ExecContext(tx.ctx, `INSERT OR IGNORE INTO dentries (parent, name, ino, type) VALUES (?, ?, ?, ?)`,
+		parent, name, inode, typ)
+	if err != nil {
+		return nil, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if n == 1 {
+		return nil, nil
+	}
+	return tx.getDentry(parent, name)
+}
+
+func (tx *sqlTxn) delDentry(parent Ino, name string) error {
+	return tx.exec(`DELETE FROM dentries WHERE parent = ? AND name = ?`, parent, name)
+}
+
+// scanDentries return the dentries after cursor ordered by name, the cursor is the last name returned
+func (tx *sqlTxn) scanDentries(parent Ino, cursor string, limit int) ([]*Dentry, string, error) {
+	rows, err := tx.q.QueryContext(tx.ctx, `SELECT name, ino, type FROM dentries
+		WHERE parent = ? AND name > ? ORDER BY name LIMIT ?`, parent, cursor, limit)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	var dentries []*Dentry
+	for rows.Next() {
+		dentry := &Dentry{}
+		if err := rows.Scan(&dentry.name, &dentry.Ino, &dentry.Typ); err != nil {
+			return nil, "", err
+		}
+		dentries = append(dentries, dentry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+	if len(dentries) < limit {
+		return dentries, "", nil
+	}
+	return dentries, dentries[len(dentries)-1].name, nil
+}
+
+func (tx *sqlTxn) dentries(parent Ino) ([]*Dentry, error) {
+	rows, err := tx.q.QueryContext(tx.ctx, `SELECT name, ino, type FROM dentries WHERE parent = ?`, parent)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var dentries []*Dentry
+	for rows.Next() {
+		dentry := &Dentry{}
+		if err := rows.Scan(&dentry.name, &dentry.Ino, &dentry.Typ); err != nil {
+			return nil, err
+		}
+		dentries = append(dentries, dentry)
+	}
+	return dentries, rows.Err()
+}
+
+func (tx *sqlTxn) dirLength(parent Ino) (int64, error) {
+	var lens int64
+	err := tx.q.QueryRowContext(tx.ctx, `SELECT COUNT(*) FROM dentries WHERE parent = ?`, parent).Scan(&lens)
+	return lens, err
+}
+
+func (tx *sqlTxn) getSymlink(inode Ino) (string, error) {
+	var target string
+	err := tx.q.QueryRowContext(tx.ctx, `SELECT target FROM symlinks WHERE ino = ?`, inode).Scan(&target)
+	if err == sql.ErrNoRows {
+		return "", syscall.ENOENT
+	}
+	return target, err
+}
+
+func (tx *sqlTxn) setSymlink(inode Ino, target string) error {
+	return tx.exec(`INSERT OR REPLACE INTO symlinks (ino, target) VALUES (?, ?)`, inode, target)
+}
+
+func (tx *sqlTxn) getXattr(inode Ino, name string) ([]byte, error) {
+	var value []byte
+	err := tx.q.QueryRowContext(tx.ctx, `SELECT value FROM xattrs WHERE ino = ? AND name = ?`, inode, name).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	return value, nil
+}
+
+func (tx *sqlTxn) setXattr(inode Ino, name string, value []byte) error {
+	if value == nil {
+		value = []byte{}
+	}
+	return tx.exec(`INSERT OR REPLACE INTO xattrs (ino, name, value) VALUES (?, ?, ?)`, inode, name, value)
+}
+
+func (tx *sqlTxn) delXattr(inode Ino, name string) error {
+	return tx.exec(`DELETE FROM xattrs WHERE ino = ? AND name = ?`, inode, name)
+}
+
+func (tx *sqlTxn) xattrs(inode Ino) ([]string, error) {
+	rows, err := tx.q.QueryContext(tx.ctx, `SELECT name FROM xattrs WHERE ino = ?`, inode)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+func (tx *sqlTxn) getChunk(inode Ino, pageNum int64) (*ChunkAttr, error) {
+	chunkAttr := &ChunkAttr{}
+	err := tx.q.QueryRowContext(tx.ctx, `SELECT off, length, storage_path, object_off, compression, stored_len FROM chunks WHERE ino = ? AND page = ?`,
+		inode, pageNum).Scan(&chunkAttr.Offset, &chunkAttr.Length, &chunkAttr.StoragePath, &chunkAttr.ObjectOffset,
+		&chunkAttr.Compression, &chunkAttr.StoredLength)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return chunkAttr, nil
+}
+
+func (tx *sqlTxn) setChunk(inode Ino, pageNum int64, chunkAttr *ChunkAttr) error {
+	return tx.exec(`INSERT OR REPLACE INTO chunks (ino, page, off, length, storage_path, object_off, compression, stored_len)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		inode, pageNum, chunkAttr.Offset, chunkAttr.Length, chunkAttr.StoragePath, chunkAttr.ObjectOffset,
+		chunkAttr.Compression, chunkAttr.StoredLength)
+}
+
+func (tx *sqlTxn) delChunk(inode Ino, pageNum int64) error {
+	return tx.exec(`DELETE FROM chunks WHERE ino = ? AND page = ?`, inode, pageNum)
+}
+
+func (tx *sqlTxn) chunks(inode Ino) (map[int64]*ChunkAttr, error) {
+	rows, err := tx.q.QueryContext(tx.ctx, `SELECT page, off, length, storage_path, object_off, compression, stored_len FROM chunks WHERE ino = ?`, inode)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	chunkAttrs := make(map[int64]*ChunkAttr)
+	for rows.Next() {
+		var pageNum int64
+		chunkAttr := &ChunkAttr{}
+		if err := rows.Scan(&pageNum, &chunkAttr.Offset, &chunkAttr.Length, &chunkAttr.StoragePath, &chunkAttr.ObjectOffset,
+			&chunkAttr.Compression, &chunkAttr.StoredLength); err != nil {
+			return nil, err
+		}
+		chunkAttrs[pageNum] = chunkAttr
+	}
+	return chunkAttrs, rows.Err()
+}
+
+func (tx *sqlTxn) getChunkRef(storagePath string) (*ChunkRef, error) {
+	ref := &ChunkRef{StoragePath: storagePath}
+	err := tx.q.QueryRowContext(tx.ctx, `SELECT refs, size, bytes, pending FROM chunk_refs WHERE path = ?`,
+		storagePath).Scan(&ref.Refs, &ref.Size, &ref.Bytes, &ref.Pending)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ref, nil
+}
+
+func (tx *sqlTxn) setChunkRef(ref *ChunkRef) error {
+	return tx.exec(`INSERT OR REPLACE INTO chunk_refs (path, refs, size, bytes, pending) VALUES (?, ?, ?, ?, ?)`,
+		ref.StoragePath, ref.Refs, ref.Size, ref.Bytes, ref.Pending)
+}
+
+func (tx *sqlTxn) delChunkRef(storagePath string) error {
+	return tx.exec(`DELETE FROM chunk_refs WHERE path = ?`, storagePath)
+}
+
+func (tx *sqlTxn) scanChunkRefs(cursor string, limit int) ([]*ChunkRef, string, error) {
+	rows, err := tx.q.QueryContext(tx.ctx, `SELECT path, refs, size, bytes, pending FROM chunk_refs
+		WHERE path > ? ORDER BY path LIMIT ?`, cursor, limit)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	var refs []*ChunkRef
+	for rows.Next() {
+		ref := &ChunkRef{}
+		if err := rows.Scan(&ref.StoragePath, &ref.Refs, &ref.Size, &ref.Bytes, &ref.Pending); err != nil {
+			return nil, "", err
+		}
+		refs = append(refs, ref)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+	if len(refs) < limit {
+		return refs, "", nil
+	}
+	return refs, refs[len(refs)-1].StoragePath, nil
+}
+
+func (tx *sqlTxn) getRef(inode Ino) (string, bool, error) {
+	var value string
+	err := tx.q.QueryRowContext(tx.ctx, `SELECT value FROM refs WHERE ino = ?`, inode).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return value, true, nil
+}
+
+func (tx *sqlTxn) setRef(inode Ino, value string) error {
+	return tx.exec(`INSERT OR REPLACE INTO refs (ino, value) VALUES (?, ?)`, inode, value)
+}
+
+func (tx *sqlTxn) delRef(inode Ino) error {
+	return tx.exec(`DELETE FROM refs WHERE ino = ?`, inode)
+}
+
+func (tx *sqlTxn) getPackedRefs(inode Ino) (*PackedRefs, error) {
+	packedRefs := &PackedRefs{}
+	err := tx.q.QueryRowContext(tx.ctx, `SELECT header FROM packed_refs_headers WHERE ino = ?`, inode).Scan(&packedRefs.Header)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.q.QueryContext(tx.ctx, `SELECT name, oid, peeled FROM packed_refs WHERE ino = ? ORDER BY name`, inode)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		ref := &PackedRef{}
+		if err := rows.Scan(&ref.Name, &ref.Oid, &ref.Peeled); err != nil {
+			return nil, err
+		}
+		packedRefs.Refs = append(packedRefs.Refs, ref)
+	}
+	return packedRefs, rows.Err()
+}
+
+func (tx *sqlTxn) getPackedRef(inode Ino, name string) (*PackedRef, error) {
+	ref := &PackedRef{
+		Name: name,
+	}
+	err := tx.q.QueryRowContext(tx.ctx, `SELECT oid, peeled FROM packed_refs WHERE ino = ? AND name = ?`,
+		inode, name).Scan(&ref.Oid, &ref.Peeled)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ref, nil
+}
+
+func (tx *sqlTxn) setPackedRefs(inode Ino, packedRefs *PackedRefs) error {
+	err := tx.exec(`DELETE FROM packed_refs WHERE ino = ?`, inode)
+	if err != nil {
+		return err
+	}
+	for _, ref := range packedRefs.Refs {
+		err = tx.exec(`INSERT OR REPLACE INTO packed_refs (ino, name, oid, peeled) VALUES (?, ?, ?, ?)`,
+			inode, ref.Name, ref.Oid, ref.Peeled)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.exec(`INSERT OR REPLACE INTO packed_refs_headers (ino, header) VALUES (?, ?)`, inode, packedRefs.Header)
+}
+
+func (tx *sqlTxn) delPackedRefs(inode Ino) error {
+	err := tx.exec(`DELETE FROM packed_refs WHERE ino = ?`, inode)
+	if err != nil {
+		return err
+	}
+	return tx.exec(`DELETE FROM packed_refs_headers WHERE ino = ?`, inode)
+}
+
+func (tx *sqlTxn) reflog(inode Ino) ([][]byte, error) {
+	rows, err := tx.q.QueryContext(tx.ctx, `SELECT entry FROM reflogs WHERE ino = ? ORDER BY id`, inode)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries [][]byte
+	for rows.Next() {
+		var entry []byte
+		if err := rows.Scan(&entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func (tx *sqlTxn) reflogLength(inode Ino) (int64, error) {
+	var length int64
+	err := tx.q.QueryRowContext(tx.ctx, `SELECT COALESCE(SUM(LENGTH(entry)), 0) FROM reflogs WHERE ino = ?`, inode).Scan(&length)
+	return length, err
+}
+
+func (tx *sqlTxn) appendReflog(inode Ino, entry []byte) error {
+	return tx.exec(`INSERT INTO reflogs (ino, entry) VALUES (?, ?)`, inode, entry)
+}
+
+func (tx *sqlTxn) delReflog(inode Ino) error {
+	return tx.exec(`DELETE FROM reflogs WHERE ino = ?`, inode)
+}
+
+// lock owners are stored as int64, since sqlite does not support uint64 with the high bit set
+func (tx *sqlTxn) locks(kind byte, inode Ino) (map[lockOwner][]byte, error) {
+	rows, err := tx.q.QueryContext(tx.ctx, `SELECT sid, owner, value FROM locks WHERE ino = ? AND kind = ?`, inode, kind)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	locks := make(map[lockOwner][]byte)
+	for rows.Next() {
+		var sid, owner int64
+		var value []byte
+		if err := rows.Scan(&sid, &owner, &value); err != nil {
+			return nil, err
+		}
+		locks[lockOwner{uint64(sid), uint64(owner)}] = value
+	}
+	return locks, rows.Err()
+}
+
+func (tx *sqlTxn) setLock(kind byte, inode Ino, owner lockOwner, value []byte) error {
+	if value == nil {
+		return tx.exec(`DELETE FROM locks WHERE ino = ? AND kind = ? AND sid = ? AND owner = ?`,
+			inode, kind, int64(owner.sid), int64(owner.owner))
+	}
+	return tx.exec(`INSERT OR REPLACE INTO locks (ino, kind, sid, owner, value) VALUES (?, ?, ?, ?, ?)`,
+		inode, kind, int64(owner.sid), int64(owner.owner), value)
+}
+
+func (tx *sqlTxn) sessions() (map[uint64]int64, error) {
+	rows, err := tx.q.QueryContext(tx.ctx, `SELECT sid, expire FROM sessions`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := make(map[uint64]int64)
+	for rows.Next() {
+		var sid, expire int64
+		if err := rows.Scan(&sid, &expire); err != nil {
+			return nil, err
+		}
+		sessions[uint64(sid)] = expire
+	}
+	return sessions, rows.Err()
+}
+
+func (tx *sqlTxn) sessionExpire(sid uint64) (int64, error) {
+	var expire int64
+	err := tx.q.QueryRowContext(tx.ctx, `SELECT expire FROM sessions WHERE sid = ?`, int64(sid)).Scan(&expire)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return expire, err
+}
+
+func (tx *sqlTxn) setSession(sid uint64, expire int64) error {
+	return tx.exec(`INSERT OR REPLACE INTO sessions (sid, expire) VALUES (?, ?)`, int64(sid), expire)
+}
+
+func (tx *sqlTxn) delSession(sid uint64) error {
+	err := tx.exec(`DELETE FROM sessions WHERE sid = ?`, int64(sid))
+	if err != nil {
+		return err
+	}
+	err = tx.exec(`DELETE FROM session_locks WHERE sid = ?`, int64(sid))
+	if err != nil {
+		return err
+	}
+	err = tx.exec(`DELETE FROM sustained WHERE sid = ?`, int64(sid))
+	if err != nil {
+		return err
+	}
+	return tx.exec(`DELETE FROM opened WHERE sid = ?`, int64(sid))
+}
+
+func (tx *sqlTxn) sessionLocks(sid uint64) ([]Ino, error) {
+	rows, err := tx.q.QueryContext(tx.ctx, `SELECT ino FROM session_locks WHERE sid = ?`, int64(sid))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var inodes []Ino
+	for rows.Next() {
+		var inode Ino
+		if err := rows.Scan(&inode); err != nil {
+			return nil, err
+		}
+		inodes = append(inodes, inode)
+	}
+	return inodes, rows.Err()
+}
+
+func (tx *sqlTxn) addSessionLock(sid uint64, inode Ino) error {
+	return tx.exec(`INSERT OR IGNORE INTO session_locks (sid, ino) VALUES (?, ?)`, int64(sid), inode)
+}
+
+func (tx *sqlTxn) delSessionLock(sid uint64, inode Ino) error {
+	return tx.exec(`DELETE FROM session_locks WHERE sid = ? AND ino = ?`, int64(sid), inode)
+}
+
+func (tx *sqlTxn) sustained(sid uint64) ([]Ino, error) {
+	rows, err := tx.q.QueryContext(tx.ctx, `SELECT ino FROM sustained WHERE sid = ?`, int64(sid))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var inodes []Ino
+	for rows.Next() {
+		var inode Ino
+		if err := rows.Scan(&inode); err != nil {
+			return nil, err
+		}
+		inodes = append(inodes, inode)
+	}
+	return inodes, rows.Err()
+}
+
+func (tx *sqlTxn) addSustained(sid uint64, inode Ino) error {
+	return tx.exec(`INSERT OR IGNORE INTO sustained (sid, ino) VALUES (?, ?)`, int64(sid), inode)
+}
+
+func (tx *sqlTxn) delSustained(sid uint64, inode Ino) error {
+	return tx.exec(`DELETE FROM sustained WHERE sid = ? AND ino = ?`, int64(sid), inode)
+}
+
+func (tx *sqlTxn) opened(inode Ino) ([]uint64, error) {
+	rows, err := tx.q.QueryContext(tx.ctx, `SELECT sid FROM opened WHERE ino = ?`, inode)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sids []uint64
+	for rows.Next() {
+		var sid int64
+		if err := rows.Scan(&sid); err != nil {
+			return nil, err
+		}
+		sids = append(sids, uint64(sid))
+	}
+	return sids, rows.Err()
+}
+
+func (tx *sqlTxn) addOpened(inode Ino, sid uint64) error {
+	return tx.exec(`INSERT OR IGNORE INTO opened (ino, sid) VALUES (?, ?)`, inode, int64(sid))
+}
+
+func (tx *sqlTxn) delOpened(inode Ino, sid uint64) error {
+	return tx.exec(`DELETE FROM opened WHERE ino = ? AND sid = ?`, inode, int64(sid))
+}
+
+func (tx *sqlTxn) getCounter(name string) (int64, error) {
+	var value int64
+	err := tx.q.QueryRowContext(tx.ctx, `SELECT value FROM counters WHERE name = ?`, name).Scan(&value)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return value, err
+}
+
+func (tx *sqlTxn) setCounter(name string, value int64) error {
+	return tx.exec(`INSERT OR REPLACE INTO counters (name, value) VALUES (?, ?)`, name, value)
+}
+
+func (tx *sqlTxn) incrCounter(name string, value int64) (int64, error) {
+	err := tx.exec(`INSERT INTO counters (name, value) VALUES (?, ?)
+		ON CONFLICT (name) DO UPDATE SET value = value + excluded.value`, name, value)
+	if err != nil {
+		return 0, err
+	}
+	return tx.getCounter(name)
+}
+
+func (tx *sqlTxn) getSetting(name string) ([]byte, error) {
+	var value []byte
+	err := tx.q.QueryRowContext(tx.ctx, `SELECT value FROM settings WHERE name = ?`, name).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return value, err
+}
+
+func (tx *sqlTxn) setSetting(name string, value []byte) error {
+	return tx.exec(`INSERT OR REPLACE INTO settings (name, value) VALUES (?, ?)`, name, value)
+}
@@ -2,7 +2,6 @@ package metadata
 
 import (
 	"context"
-	"github.com/go-redis/redis/v8"
 )
 
 const TotalInode = "totalinode"
@@ -11,52 +10,85 @@ const UsedSpace = "usedspace"
 const TotalSpace = "totalspace"
 
 // nextInode get next inode which can be used
-func (r *RedisMeta) nextInode(ctx context.Context) (Ino, error) {
-	ino, err := r.rdb.Incr(ctx, CurInode).Uint64()
+func (m *baseMeta) nextInode(ctx context.Context) (Ino, error) {
+	var ino Ino
+	err := m.engine.txn(ctx, func(tx metaTxn) error {
+		var err error
+		ino, err = allocInode(tx)
+		return err
+	})
 	if err != nil {
 		return -1, err
 	}
+	return ino, nil
+}
+
+// allocInode allocate the next inode in a transaction, which is counted as
+// used by statfs, inode 1 is the root
+func allocInode(tx metaTxn) (Ino, error) {
+	ino, err := tx.incrCounter(CurInode, 1)
+	if err != nil {
+		return 0, err
+	}
 	if ino == 1 {
-		ino, err = r.rdb.Incr(ctx, CurInode).Uint64()
+		ino, err = tx.incrCounter(CurInode, 1)
 		if err != nil {
-			return -1, err
+			return 0, err
 		}
 	}
-	return Ino(ino), err
+	return Ino(ino), nil
+}
+
+// getCounter return the value of the counter, 0 if it does not exist
+func (m *baseMeta) getCounter(ctx context.Context, name string) (uint64, error) {
+	var value int64
+	err := m.engine.view(ctx, func(tx metaTxn) error {
+		var err error
+		value, err = tx.getCounter(name)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	if value < 0 {
+		return 0, nil
+	}
+	return uint64(value), nil
 }
 
-func (r *RedisMeta) SetTotalInodeCount(ctx context.Context, totalInodeCount uint64) error {
-	return r.rdb.Set(ctx, TotalInode, totalInodeCount, -1).Err()
+func (m *baseMeta) setCounter(ctx context.Context, name string, value uint64) error {
+	return m.engine.txn(ctx, func(tx metaTxn) error {
+		return tx.setCounter(name, int64(value))
+	})
 }
 
-func (r *RedisMeta) TotalInodeCount(ctx context.Context) (uint64, error) {
-	return r.rdb.Get(ctx, TotalInode).Uint64()
+func (m *baseMeta) SetTotalInodeCount(ctx context.Context, totalInodeCount uint64) error {
+	return m.setCounter(ctx, TotalInode, totalInodeCount)
 }
 
-func (r *RedisMeta) CurInodeCount(ctx context.Context) (uint64, error) {
-	ino, err := r.rdb.Get(ctx, CurInode).Uint64()
-	if err == redis.Nil {
-		return 0, nil
-	}
-	return ino, err
+func (m *baseMeta) TotalInodeCount(ctx context.Context) (uint64, error) {
+	return m.getCounter(ctx, TotalInode)
 }
 
-func (r *RedisMeta) UpdateUsedSpace(ctx context.Context, size int64) error {
-	return r.rdb.IncrBy(ctx, UsedSpace, size).Err()
+func (m *baseMeta) CurInodeCount(ctx context.Context) (uint64, error) {
+	return m.getCounter(ctx, CurInode)
 }
 
-func (r *RedisMeta) UsedSpace(ctx context.Context) (uint64, error) {
-	usedSpace, err := r.rdb.Get(ctx, UsedSpace).Uint64()
-	if err == redis.Nil {
-		return 0, nil
-	}
-	return usedSpace, err
+func (m *baseMeta) UpdateUsedSpace(ctx context.Context, size int64) error {
+	return m.engine.txn(ctx, func(tx metaTxn) error {
+		_, err := tx.incrCounter(UsedSpace, size)
+		return err
+	})
+}
+
+func (m *baseMeta) UsedSpace(ctx context.Context) (uint64, error) {
+	return m.getCounter(ctx, UsedSpace)
 }
 
-func (r *RedisMeta) SetTotalSpace(ctx context.Context, totalSpace uint64) error {
-	return r.rdb.Set(ctx, TotalSpace, totalSpace, -1).Err()
+func (m *baseMeta) SetTotalSpace(ctx context.Context, totalSpace uint64) error {
+	return m.setCounter(ctx, TotalSpace, totalSpace)
 }
 
-func (r *RedisMeta) TotalSpace(ctx context.Context) (uint64, error) {
-	return r.rdb.Get(ctx, TotalSpace).Uint64()
+func (m *baseMeta) TotalSpace(ctx context.Context) (uint64, error) {
+	return m.getCounter(ctx, TotalSpace)
 }
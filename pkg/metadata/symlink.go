@@ -0,0 +1,32 @@
+package metadata
+
+import (
+	"context"
+	"syscall"
+)
+
+func symlinkKey(inode Ino) string {
+	return "s" + inode.String()
+}
+
+// Symlink create a symlink inode and store its target
+func (m *baseMeta) Symlink(ctx context.Context, parent Ino, name string, target string) (*Attr, Ino, syscall.Errno) {
+	if len(target) == 0 || len(target) > 4096 {
+		return nil, 0, syscall.EINVAL
+	}
+	return m.mknod(ctx, parent, TypeSymlink, name, 0777, 0, target)
+}
+
+// Readlink return the target of the symlink inode
+func (m *baseMeta) Readlink(ctx context.Context, ino Ino) (string, syscall.Errno) {
+	var target string
+	err := m.engine.view(ctx, func(tx metaTxn) error {
+		var err error
+		target, err = tx.getSymlink(ino)
+		return err
+	})
+	if err != nil {
+		return "", errno(err)
+	}
+	return target, syscall.F_OK
+}
@@ -0,0 +1,169 @@
+package metadata
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// metaTxn is a transaction of a metadata engine, baseMeta implement all the
+// file system operations over it, so an engine only need to know how to
+// store inodes, dentries, chunks, refs, reflogs, counters and settings.
+type metaTxn interface {
+	// getattr return syscall.ENOENT if the inode does not exist
+	getattr(ino Ino) (*Attr, error)
+	// getattrs return the attributes of the inodes in a batch, nil for the missing ones
+	getattrs(inos []Ino) ([]*Attr, error)
+	setattr(ino Ino, attr *Attr) error
+	// delattr remove the inode with its symlink, xattrs, ref, packed-refs, reflog and lock records
+	delattr(ino Ino) error
+
+	// getDentry return nil if the dentry does not exist
+	getDentry(parent Ino, name string) (*Dentry, error)
+	setDentry(parent Ino, name string, inode Ino, typ uint8) error
+	// createDentry set the dentry only if it does not exist, and return the
+	// existing one otherwise, which is how the exclusive create is done atomically
+	createDentry(parent Ino, name string, inode Ino, typ uint8) (*Dentry, error)
+	delDentry(parent Ino, name string) error
+	dentries(parent Ino) ([]*Dentry, error)
+	// scanDentries return about limit dentries from cursor and the next cursor,
+	// "" is both the first and the last cursor, the order is stable if the
+	// directory is not changed
+	scanDentries(parent Ino, cursor string, limit int) ([]*Dentry, string, error)
+	dirLength(parent Ino) (int64, error)
+
+	// getSymlink return syscall.ENOENT if the symlink does not exist
+	getSymlink(inode Ino) (string, error)
+	setSymlink(inode Ino, target string) error
+
+	// getXattr return nil if the extended attribute does not exist
+	getXattr(inode Ino, name string) ([]byte, error)
+	setXattr(inode Ino, name string, value []byte) error
+	delXattr(inode Ino, name string) error
+	xattrs(inode Ino) ([]string, error)
+
+	// getChunk return nil if the chunk does not exist
+	getChunk(inode Ino, pageNum int64) (*ChunkAttr, error)
+	setChunk(inode Ino, pageNum int64, chunkAttr *ChunkAttr) error
+	delChunk(inode Ino, pageNum int64) error
+	chunks(inode Ino) (map[int64]*ChunkAttr, error)
+
+	// getChunkRef return nil if no chunk refer to the object at storagePath
+	getChunkRef(storagePath string) (*ChunkRef, error)
+	setChunkRef(ref *ChunkRef) error
+	delChunkRef(storagePath string) error
+	// scanChunkRefs return at most limit chunk refs from cursor and the next cursor,
+	// "" is both the first and the last cursor
+	scanChunkRefs(cursor string, limit int) ([]*ChunkRef, string, error)
+
+	// getRef return false if the ref does not exist
+	getRef(inode Ino) (string, bool, error)
+	setRef(inode Ino, value string) error
+
+	// getPackedRefs return nil if the packed-refs does not exist
+	getPackedRefs(inode Ino) (*PackedRefs, error)
+	// getPackedRef return nil if the ref is not in the packed-refs
+	getPackedRef(inode Ino, name string) (*PackedRef, error)
+	// setPackedRefs replace all the ref records of the packed-refs
+	setPackedRefs(inode Ino, packedRefs *PackedRefs) error
+	delPackedRefs(inode Ino) error
+
+	// reflog return the entries of the reflog in the order they are appended
+	reflog(inode Ino) ([][]byte, error)
+	// reflogLength return the total length of the entries of the reflog
+	reflogLength(inode Ino) (int64, error)
+	// appendReflog append an entry to the reflog without reading anything,
+	// so that it can be run in a batch
+	appendReflog(inode Ino, entry []byte) error
+	delReflog(inode Ino) error
+
+	// locks return the encoded lock records of the inode by owner, kind is plockKind or flockKind
+	locks(kind byte, inode Ino) (map[lockOwner][]byte, error)
+	// setLock store the lock record of the owner, or delete it if value is nil
+	setLock(kind byte, inode Ino, owner lockOwner, value []byte) error
+
+	// sessions return the expire time of all the sessions
+	sessions() (map[uint64]int64, error)
+	// sessionExpire return the expire time of the session, 0 if it does not exist
+	sessionExpire(sid uint64) (int64, error)
+	setSession(sid uint64, expire int64) error
+	// delSession remove the session, its lock index, its sustained inodes and its open files
+	delSession(sid uint64) error
+	// sessionLocks return the inodes which the session may hold locks on
+	sessionLocks(sid uint64) ([]Ino, error)
+	addSessionLock(sid uint64, inode Ino) error
+	delSessionLock(sid uint64, inode Ino) error
+	// sustained return the inodes which are unlinked while the session hold them open
+	sustained(sid uint64) ([]Ino, error)
+	addSustained(sid uint64, inode Ino) error
+	delSustained(sid uint64, inode Ino) error
+	// opened return the sessions which have the inode open
+	opened(inode Ino) ([]uint64, error)
+	addOpened(inode Ino, sid uint64) error
+	delOpened(inode Ino, sid uint64) error
+
+	// getCounter return 0 if the counter does not exist
+	getCounter(name string) (int64, error)
+	setCounter(name string, value int64) error
+	incrCounter(name string, value int64) (int64, error)
+
+	// getSetting return nil if the setting does not exist
+	getSetting(name string) ([]byte, error)
+	setSetting(name string, value []byte) error
+}
+
+// metaEngine run functions in the transactions of a metadata engine
+type metaEngine interface {
+	// txn run fn in a read-write transaction
+	txn(ctx context.Context, fn func(tx metaTxn) error) error
+	// view run fn in a read-only transaction
+	view(ctx context.Context, fn func(tx metaTxn) error) error
+	// batch run fn which only write in a transaction with the least round trips
+	batch(ctx context.Context, fn func(tx metaTxn) error) error
+
+	// publish send msg to the subscribers of channel
+	publish(ctx context.Context, channel string, msg []byte) error
+	// subscribe return the messages published to channel until ctx is done
+	subscribe(ctx context.Context, channel string) (<-chan []byte, error)
+}
+
+// baseMeta implement Meta over a metaEngine
+type baseMeta struct {
+	engine metaEngine
+}
+
+func newBaseMeta(engine metaEngine) *baseMeta {
+	return &baseMeta{
+		engine: countedEngine{engine},
+	}
+}
+
+// transactions is the number of the transactions run by the metadata engines
+// of the process, each of them takes at least a round trip to the metadata
+var transactions int64
+
+// Transactions return the number of the transactions run by the metadata
+// engines of the process, which tell how many round trips an operation take
+// whatever the engine is
+func Transactions() int64 {
+	return atomic.LoadInt64(&transactions)
+}
+
+// countedEngine count the transactions of the engine in transactions
+type countedEngine struct {
+	metaEngine
+}
+
+func (e countedEngine) txn(ctx context.Context, fn func(tx metaTxn) error) error {
+	atomic.AddInt64(&transactions, 1)
+	return e.metaEngine.txn(ctx, fn)
+}
+
+func (e countedEngine) view(ctx context.Context, fn func(tx metaTxn) error) error {
+	atomic.AddInt64(&transactions, 1)
+	return e.metaEngine.view(ctx, fn)
+}
+
+func (e countedEngine) batch(ctx context.Context, fn func(tx metaTxn) error) error {
+	atomic.AddInt64(&transactions, 1)
+	return e.metaEngine.batch(ctx, fn)
+}
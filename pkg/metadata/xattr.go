@@ -0,0 +1,111 @@
+package metadata
+
+import (
+	"context"
+	"syscall"
+)
+
+const (
+	// XattrNameMax is the max length of an extended attribute name
+	XattrNameMax = 255
+	// XattrSizeMax is the max size of an extended attribute value
+	XattrSizeMax = 64 << 10
+
+	XattrCreate  = 1 // setxattr flag: fail if the attribute exists
+	XattrReplace = 2 // setxattr flag: fail if the attribute does not exist
+)
+
+func xattrKey(inode Ino) string {
+	return "x" + inode.String()
+}
+
+// GetXattr return the value of the extended attribute, ENODATA if it does not exist
+func (m *baseMeta) GetXattr(ctx context.Context, ino Ino, name string) ([]byte, syscall.Errno) {
+	if len(name) == 0 || len(name) > XattrNameMax {
+		return nil, syscall.ERANGE
+	}
+
+	var value []byte
+	err := m.engine.view(ctx, func(tx metaTxn) error {
+		var err error
+		value, err = tx.getXattr(ino, name)
+		if err != nil {
+			return err
+		}
+		if value == nil {
+			return syscall.ENODATA
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errno(err)
+	}
+	return value, syscall.F_OK
+}
+
+// SetXattr set the value of the extended attribute, flags is XattrCreate or XattrReplace
+func (m *baseMeta) SetXattr(ctx context.Context, ino Ino, name string, value []byte, flags uint32) syscall.Errno {
+	if len(name) == 0 {
+		return syscall.EINVAL
+	}
+	if len(name) > XattrNameMax {
+		return syscall.ERANGE
+	}
+	if len(value) > XattrSizeMax {
+		return syscall.E2BIG
+	}
+	if flags&^(XattrCreate|XattrReplace) != 0 {
+		return syscall.EINVAL
+	}
+
+	err := m.engine.txn(ctx, func(tx metaTxn) error {
+		if _, err := tx.getattr(ino); err != nil {
+			return err
+		}
+		old, err := tx.getXattr(ino, name)
+		if err != nil {
+			return err
+		}
+		if flags&XattrCreate != 0 && old != nil {
+			return syscall.EEXIST
+		}
+		if flags&XattrReplace != 0 && old == nil {
+			return syscall.ENODATA
+		}
+		return tx.setXattr(ino, name, value)
+	})
+	return errno(err)
+}
+
+// ListXattr return the names of all the extended attributes of the inode
+func (m *baseMeta) ListXattr(ctx context.Context, ino Ino) ([]string, syscall.Errno) {
+	var names []string
+	err := m.engine.view(ctx, func(tx metaTxn) error {
+		var err error
+		names, err = tx.xattrs(ino)
+		return err
+	})
+	if err != nil {
+		return nil, errno(err)
+	}
+	return names, syscall.F_OK
+}
+
+// RemoveXattr remove the extended attribute, ENODATA if it does not exist
+func (m *baseMeta) RemoveXattr(ctx context.Context, ino Ino, name string) syscall.Errno {
+	if len(name) == 0 || len(name) > XattrNameMax {
+		return syscall.ERANGE
+	}
+
+	err := m.engine.txn(ctx, func(tx metaTxn) error {
+		old, err := tx.getXattr(ino, name)
+		if err != nil {
+			return err
+		}
+		if old == nil {
+			return syscall.ENODATA
+		}
+		return tx.delXattr(ino, name)
+	})
+	return errno(err)
+}
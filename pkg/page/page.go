@@ -3,6 +3,7 @@ package page
 import (
 	"bytes"
 	"context"
+	"errors"
 	"github.com/adlternative/tinygitfs/pkg/datasource"
 	"github.com/adlternative/tinygitfs/pkg/metadata"
 	log "github.com/sirupsen/logrus"
@@ -81,24 +82,103 @@ func (p *Page) Fsync(ctx context.Context, source *datasource.DataSource, inode m
 		return source.Meta.DeleteChunkMeta(ctx, inode, p.pageNumber)
 	}
 
-	// TODO txn
-	path := storagePath(inode, p.pageNumber)
-	err := source.Data.Put(path, bytes.NewReader(p.data[:p.size]))
-	if err != nil {
-		log.WithError(err).Errorf("set chunk data failed")
-		return err
-	}
-
-	err = source.Meta.SetChunkMeta(ctx, inode, p.pageNumber, p.pageNumber*PageSize, int(p.size), path)
-	if err != nil {
-		log.WithError(err).Errorf("set chunk metadata failed")
-		return err
+	reuse := true
+	for {
+		chunkAttr, err := storeChunk(ctx, source, p.data[:p.size], reuse)
+		if err != nil {
+			return err
+		}
+		chunkAttr.Offset = p.pageNumber * PageSize
+		err = source.Meta.SetChunkAttr(ctx, inode, p.pageNumber, chunkAttr)
+		if errors.Is(err, metadata.ErrChunkFenced) {
+			// gc is deleting the object, or deleted it since it was found
+			// referred or reserved, which is uploaded again
+			reuse = false
+			continue
+		}
+		if err != nil {
+			log.WithError(err).Errorf("set chunk metadata failed")
+			return err
+		}
+		break
 	}
 
 	p.clean = true
 	return nil
 }
 
+// storeChunk upload the content of a page compressed with the compressor of
+// the source, or as it is if it is not smaller compressed, and return the
+// chunk of it. The content is uploaded only if no chunk refer to the same
+// content compressed in the same way, whose key is the sha256 of the content
+// with the algorithm as the suffix, and reuse is set. A reused chunk is
+// marked, so it is only set if the object is still referred, and an uploaded
+// one is reserved before, so gc does not delete it until it is set.
+func storeChunk(ctx context.Context, source *datasource.DataSource, content []byte, reuse bool) (*metadata.ChunkAttr, error) {
+	path := StoragePath(content)
+	chunkAttr := &metadata.ChunkAttr{
+		Length:      len(content),
+		StoragePath: path,
+	}
+
+	compressor := source.Compressor
+	if reuse {
+		if compressor != nil && compressor.Name() != "" {
+			compressedPath := path + "." + compressor.Name()
+			ref, stored, err := source.Meta.GetChunkRef(ctx, compressedPath)
+			if err != nil {
+				log.WithError(err).Errorf("get chunk ref failed")
+				return nil, err
+			}
+			if stored {
+				chunkAttr.StoragePath = compressedPath
+				chunkAttr.Compression = compressor.Name()
+				chunkAttr.StoredLength = int(ref.Size)
+				chunkAttr.Reused = true
+				return chunkAttr, nil
+			}
+		}
+
+		_, stored, err := source.Meta.GetChunkRef(ctx, path)
+		if err != nil {
+			log.WithError(err).Errorf("get chunk ref failed")
+			return nil, err
+		}
+		if stored {
+			chunkAttr.Reused = true
+			return chunkAttr, nil
+		}
+	}
+
+	data := content
+	if compressor != nil && compressor.Name() != "" {
+		compressed, err := compressor.Compress(content)
+		if err != nil {
+			log.WithError(err).Errorf("compress chunk failed")
+			return nil, err
+		}
+		if len(compressed) < len(content) {
+			data = compressed
+			chunkAttr.StoragePath = path + "." + compressor.Name()
+			chunkAttr.Compression = compressor.Name()
+			chunkAttr.StoredLength = len(compressed)
+		}
+	}
+	// the object may be overwritten in place while gc is deleting it, which
+	// wait for gc and keep it from deleting the object until the chunk is set
+	if err := source.Meta.ReserveChunkRef(ctx, chunkAttr.StoragePath); err != nil {
+		log.WithError(err).Errorf("reserve chunk ref failed")
+		return nil, err
+	}
+	chunkAttr.Reserved = true
+	err := source.Data.Put(chunkAttr.StoragePath, bytes.NewReader(data))
+	if err != nil {
+		log.WithError(err).Errorf("set chunk data failed")
+		return nil, err
+	}
+	return chunkAttr, nil
+}
+
 func NewPage(pageNumber int64) *Page {
 	return &Page{
 		pageNumber: pageNumber,
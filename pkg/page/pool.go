@@ -2,13 +2,17 @@ package page
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"sync"
 	"syscall"
 
+	"github.com/adlternative/tinygitfs/pkg/compress"
+	"github.com/adlternative/tinygitfs/pkg/data"
 	"github.com/adlternative/tinygitfs/pkg/datasource"
 	"github.com/adlternative/tinygitfs/pkg/metadata"
-	"github.com/adlternative/tinygitfs/pkg/utils"
 	"github.com/hanwen/go-fuse/v2/fuse"
 	lru "github.com/hashicorp/golang-lru/v2"
 	log "github.com/sirupsen/logrus"
@@ -288,10 +292,19 @@ func (p *Pool) loadPage(ctx context.Context, pageNum int64) (*Page, bool, error)
 		return nil, false, nil
 	}
 
-	reader, err := p.Data.Get(chunkAttr.StoragePath, 0, PageSize)
+	if chunkAttr.Compression != "" {
+		page, err = p.loadCompressedPage(pageNum, chunkAttr)
+		if err != nil {
+			return nil, false, err
+		}
+		return page, true, nil
+	}
+
+	reader, err := p.Data.Get(chunkAttr.StoragePath, chunkAttr.ObjectOffset, PageSize)
 	if err != nil {
 		return nil, false, err
 	} else {
+		defer reader.Close()
 		page, err = NewPageWithReader(pageNum, reader, PageSize)
 		if err != nil {
 			return nil, false, err
@@ -301,6 +314,46 @@ func (p *Pool) loadPage(ctx context.Context, pageNum int64) (*Page, bool, error)
 	return page, true, nil
 }
 
+// loadCompressedPage read the compressed chunk and decompress it to the page
+func (p *Pool) loadCompressedPage(pageNum int64, chunkAttr *metadata.ChunkAttr) (*Page, error) {
+	page := NewPage(pageNum)
+	n, err := DecompressChunk(p.Data, chunkAttr, page.data)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"inode":       p.inode,
+			"pageNum":     pageNum,
+			"storagePath": chunkAttr.StoragePath,
+			"compression": chunkAttr.Compression,
+		}).WithError(err).Error("decompress chunk failed")
+		return nil, err
+	}
+	// the chunk may be truncated after it was compressed
+	if n > chunkAttr.Length {
+		n = chunkAttr.Length
+	}
+	page.size = int64(n)
+	return page, nil
+}
+
+// DecompressChunk read the compressed chunk from the object storage and
+// decompress it to dst, which must be large enough for a page
+func DecompressChunk(storage data.ObjectStorage, chunkAttr *metadata.ChunkAttr, dst []byte) (int, error) {
+	compressor, err := compress.NewCompressor(chunkAttr.Compression)
+	if err != nil {
+		return 0, err
+	}
+	reader, err := storage.Get(chunkAttr.StoragePath, chunkAttr.ObjectOffset, int64(chunkAttr.StoredLength))
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+	compressed, err := io.ReadAll(reader)
+	if err != nil {
+		return 0, err
+	}
+	return compressor.Decompress(dst, compressed)
+}
+
 func (p *Pool) Setattr(ctx context.Context, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -326,6 +379,14 @@ func defaultCheck(key int64) bool {
 	return true
 }
 
-func storagePath(inode metadata.Ino, pageNum int64) string {
-	return fmt.Sprintf("chunks/%d/%d/%s", inode, pageNum, utils.RandStringBytes(32))
+// StoragePath return the key of content in the object storage, which is its
+// sha256, so the same content of all the files is stored once
+func StoragePath(content []byte) string {
+	sum := sha256.Sum256(content)
+	return StoragePathOfSum(sum[:])
+}
+
+// StoragePathOfSum return the key of the content whose sha256 is sum
+func StoragePathOfSum(sum []byte) string {
+	return "chunks/sha256/" + hex.EncodeToString(sum)
 }
@@ -3,10 +3,15 @@ package test
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
 	"fmt"
 	"github.com/adlternative/tinygitfs/pkg/cmd"
 	"github.com/adlternative/tinygitfs/pkg/data"
+	"github.com/adlternative/tinygitfs/pkg/datasource"
+	"github.com/adlternative/tinygitfs/pkg/gc"
 	"github.com/adlternative/tinygitfs/pkg/gitfs"
+	"github.com/adlternative/tinygitfs/pkg/metadata"
+	"github.com/adlternative/tinygitfs/pkg/page"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/require"
 	"io"
@@ -14,8 +19,11 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
+
+	"golang.org/x/sys/unix"
 )
 
 func TestMount(t *testing.T) {
@@ -30,12 +38,7 @@ func TestMount(t *testing.T) {
 		require.NoError(t, os.RemoveAll(tempMntDir))
 	}()
 
-	server, err := gitfs.Mount(ctx, tempMntDir, false, "redis://"+testStorage.GetRedisURI(), &data.Option{
-		EndPoint:  "http://" + testStorage.GetMinioURI(),
-		Bucket:    "gitfs",
-		Accesskey: "minioadmin",
-		SecretKey: "minioadmin",
-	})
+	server, err := gitfs.Mount(ctx, tempMntDir, false, testStorage.GetMetadataURL(), testStorage.GetDataOption(), nil)
 	require.NoError(t, err)
 	defer func() {
 		require.NoError(t, server.Unmount())
@@ -121,6 +124,387 @@ func TestCreateFileWithContent(t *testing.T) {
 	}
 }
 
+func TestSymlink(t *testing.T) {
+	ctx := context.Background()
+
+	testEnv := CreateTestEnvironment(ctx, t)
+	defer testEnv.Cleanup(ctx, t)
+
+	content := []byte("test message")
+	fileName := filepath.Join(testEnv.Root(), "file")
+	require.NoError(t, os.WriteFile(fileName, content, 0644))
+
+	type TestCases = []struct {
+		linkName string
+		target   string
+	}
+	testCases := TestCases{
+		{
+			linkName: "relative-link",
+			target:   "file",
+		},
+		{
+			linkName: "absolute-link",
+			target:   fileName,
+		},
+	}
+	for _, tc := range testCases {
+		linkName := filepath.Join(testEnv.Root(), tc.linkName)
+		require.NoError(t, os.Symlink(tc.target, linkName))
+
+		fileInfo, err := os.Lstat(linkName)
+		require.NoError(t, err)
+		require.Equalf(t, os.ModeSymlink, fileInfo.Mode()&os.ModeType, "file mode wrong")
+		require.Equalf(t, int64(len(tc.target)), fileInfo.Size(), "link size wrong")
+
+		target, err := os.Readlink(linkName)
+		require.NoError(t, err)
+		require.Equalf(t, tc.target, target, "link target wrong")
+
+		data, err := os.ReadFile(linkName)
+		require.NoError(t, err)
+		require.Equalf(t, content, data, "file data wrong")
+
+		require.NoError(t, os.Remove(linkName))
+		_, err = os.Lstat(linkName)
+		require.True(t, os.IsNotExist(err))
+	}
+}
+
+func TestRenameFlags(t *testing.T) {
+	ctx := context.Background()
+
+	testEnv := CreateTestEnvironment(ctx, t)
+	defer testEnv.Cleanup(ctx, t)
+
+	renameat2 := func(oldName, newName string, flags uint) error {
+		return unix.Renameat2(unix.AT_FDCWD, filepath.Join(testEnv.Root(), oldName),
+			unix.AT_FDCWD, filepath.Join(testEnv.Root(), newName), flags)
+	}
+	readFile := func(name string) string {
+		data, err := os.ReadFile(filepath.Join(testEnv.Root(), name))
+		require.NoError(t, err)
+		return string(data)
+	}
+
+	require.NoError(t, os.WriteFile(filepath.Join(testEnv.Root(), "a"), []byte("a"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(testEnv.Root(), "b"), []byte("b"), 0644))
+	require.NoError(t, os.Mkdir(filepath.Join(testEnv.Root(), "dir"), 0755))
+
+	require.Equal(t, unix.EEXIST, renameat2("a", "b", unix.RENAME_NOREPLACE))
+	require.Equal(t, "a", readFile("a"))
+	require.Equal(t, "b", readFile("b"))
+	require.NoError(t, renameat2("a", "c", unix.RENAME_NOREPLACE))
+	require.Equal(t, "a", readFile("c"))
+
+	require.NoError(t, renameat2("c", "b", unix.RENAME_EXCHANGE))
+	require.Equal(t, "a", readFile("b"))
+	require.Equal(t, "b", readFile("c"))
+	require.Equal(t, unix.ENOENT, renameat2("c", "missing", unix.RENAME_EXCHANGE))
+
+	// exchange a file with a directory
+	require.NoError(t, renameat2("c", "dir", unix.RENAME_EXCHANGE))
+	fileInfo, err := os.Stat(filepath.Join(testEnv.Root(), "c"))
+	require.NoError(t, err)
+	require.True(t, fileInfo.IsDir())
+	require.Equal(t, "b", readFile("dir"))
+
+	require.Equal(t, unix.EINVAL, renameat2("b", "d", unix.RENAME_NOREPLACE|unix.RENAME_EXCHANGE))
+}
+
+func TestRenameDirectory(t *testing.T) {
+	ctx := context.Background()
+
+	testEnv := CreateTestEnvironment(ctx, t)
+	defer testEnv.Cleanup(ctx, t)
+
+	root := testEnv.Root()
+	nlink := func(name string) uint64 {
+		fileInfo, err := os.Stat(filepath.Join(root, name))
+		require.NoError(t, err)
+		return uint64(fileInfo.Sys().(*syscall.Stat_t).Nlink)
+	}
+
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "p1", "d", "sub"), 0755))
+	require.NoError(t, os.Mkdir(filepath.Join(root, "p2"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "p1", "file"), []byte("file"), 0644))
+	require.Equal(t, uint64(3), nlink("p1"))
+	require.Equal(t, uint64(2), nlink("p2"))
+
+	// move a directory to another parent
+	require.NoError(t, os.Rename(filepath.Join(root, "p1", "d"), filepath.Join(root, "p2", "d")))
+	require.Equal(t, uint64(2), nlink("p1"))
+	require.Equal(t, uint64(3), nlink("p2"))
+	require.DirExists(t, filepath.Join(root, "p2", "d", "sub"))
+
+	// replace an empty directory, os.Rename refuse to replace a directory itself
+	require.NoError(t, os.Mkdir(filepath.Join(root, "p1", "empty"), 0755))
+	require.Equal(t, uint64(3), nlink("p1"))
+	require.NoError(t, syscall.Rename(filepath.Join(root, "p2", "d"), filepath.Join(root, "p1", "empty")))
+	require.Equal(t, uint64(3), nlink("p1"))
+	require.Equal(t, uint64(2), nlink("p2"))
+	require.DirExists(t, filepath.Join(root, "p1", "empty", "sub"))
+
+	// a directory which is not empty can not be replaced
+	require.NoError(t, os.Mkdir(filepath.Join(root, "p2", "d"), 0755))
+	err := syscall.Rename(filepath.Join(root, "p2", "d"), filepath.Join(root, "p1", "empty"))
+	require.ErrorIs(t, err, syscall.ENOTEMPTY)
+
+	// a directory and a file can not replace each other
+	err = os.Rename(filepath.Join(root, "p2", "d"), filepath.Join(root, "p1", "file"))
+	require.ErrorIs(t, err, syscall.ENOTDIR)
+	err = syscall.Rename(filepath.Join(root, "p1", "file"), filepath.Join(root, "p2", "d"))
+	require.ErrorIs(t, err, syscall.EISDIR)
+
+	// a directory can not be moved into its own subtree
+	err = os.Rename(filepath.Join(root, "p1"), filepath.Join(root, "p1", "empty", "sub", "p1"))
+	require.ErrorIs(t, err, syscall.EINVAL)
+
+	require.NoError(t, os.Remove(filepath.Join(root, "p1", "empty", "sub")))
+	require.NoError(t, os.Remove(filepath.Join(root, "p1", "empty")))
+	require.Equal(t, uint64(2), nlink("p1"))
+}
+
+func TestUnlinkOpenFile(t *testing.T) {
+	ctx := context.Background()
+
+	testEnv := CreateTestEnvironment(ctx, t)
+	defer testEnv.Cleanup(ctx, t)
+
+	filePath := filepath.Join(testEnv.Root(), "file")
+	f, err := os.Create(filePath)
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = f.Write([]byte("before unlink "))
+	require.NoError(t, err)
+	require.NoError(t, f.Sync())
+
+	require.NoError(t, os.Remove(filePath))
+	_, err = os.Stat(filePath)
+	require.True(t, os.IsNotExist(err))
+
+	// the file can still be written and read through the open handle
+	_, err = f.Write([]byte("after unlink"))
+	require.NoError(t, err)
+	require.NoError(t, f.Sync())
+	info, err := f.Stat()
+	require.NoError(t, err)
+	require.Equal(t, int64(len("before unlink after unlink")), info.Size())
+	got := make([]byte, info.Size())
+	_, err = f.ReadAt(got, 0)
+	require.NoError(t, err)
+	require.Equal(t, "before unlink after unlink", string(got))
+
+	if metaEngine() == "bolt" {
+		require.NoError(t, f.Close())
+		return
+	}
+	meta, err := metadata.NewMeta(testEnv.testStorage.GetMetadataURL())
+	require.NoError(t, err)
+	inode := metadata.Ino(info.Sys().(*syscall.Stat_t).Ino)
+	attr, eno := meta.Getattr(ctx, inode)
+	require.Equal(t, syscall.Errno(0), eno)
+	require.Equal(t, uint32(0), attr.Nlink)
+	require.Equal(t, uint64(info.Size()), attr.Length)
+
+	// the inode and its chunks are removed when it is closed
+	require.NoError(t, f.Close())
+	require.Eventually(t, func() bool {
+		_, eno := meta.Getattr(ctx, inode)
+		return eno == syscall.ENOENT
+	}, 5*time.Second, 100*time.Millisecond)
+	paths, err := meta.LiveStoragePaths(ctx)
+	require.NoError(t, err)
+	require.Empty(t, paths)
+
+	// the inodes sustained by a crashed client are removed with its session
+	require.NoError(t, os.WriteFile(filePath, []byte("crash"), 0644))
+	info, err = os.Stat(filePath)
+	require.NoError(t, err)
+	inode = metadata.Ino(info.Sys().(*syscall.Stat_t).Ino)
+	sid, err := meta.NewSession(ctx)
+	require.NoError(t, err)
+	require.NoError(t, meta.OpenFile(ctx, sid, inode))
+	require.Equal(t, syscall.Errno(0), meta.Unlink(ctx, 1, "file"))
+	_, eno = meta.Getattr(ctx, inode)
+	require.Equal(t, syscall.Errno(0), eno)
+	require.NoError(t, meta.CloseSession(ctx, sid))
+	_, eno = meta.Getattr(ctx, inode)
+	require.Equal(t, syscall.ENOENT, eno)
+}
+
+func TestReaddirLargeDirectory(t *testing.T) {
+	ctx := context.Background()
+
+	testEnv := CreateTestEnvironment(ctx, t)
+	defer testEnv.Cleanup(ctx, t)
+
+	const files = 2000
+	dir := filepath.Join(testEnv.Root(), "dir")
+	require.NoError(t, os.Mkdir(dir, 0755))
+	for i := 0; i < files; i++ {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, fmt.Sprintf("file-%d", i)), nil, 0644))
+	}
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "sub"), 0755))
+
+	f, err := os.Open(dir)
+	require.NoError(t, err)
+	defer f.Close()
+
+	names, err := f.Readdirnames(-1)
+	require.NoError(t, err)
+	require.Len(t, names, files+1)
+
+	// the entries are listed in the same order after rewinding
+	_, err = f.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	again, err := f.Readdirnames(-1)
+	require.NoError(t, err)
+	require.Equal(t, names, again)
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	for _, entry := range entries {
+		require.Equalf(t, entry.Name() == "sub", entry.IsDir(), "type of %s wrong", entry.Name())
+	}
+}
+
+func TestReaddirPlusRoundTrips(t *testing.T) {
+	ctx := context.Background()
+
+	testEnv := CreateTestEnvironmentWithOption(ctx, t, &gitfs.Option{CacheTimeout: time.Second})
+	defer testEnv.Cleanup(ctx, t)
+
+	const files = 10000
+	dir := filepath.Join(testEnv.Root(), "dir")
+	require.NoError(t, os.Mkdir(dir, 0755))
+	for i := 0; i < files; i++ {
+		// mknod leave no file to be released by the kernel in the background
+		require.NoError(t, unix.Mknod(filepath.Join(dir, fmt.Sprintf("file-%d", i)), unix.S_IFREG|0644, 0))
+	}
+
+	transactions := metadata.Transactions()
+
+	// ls -l: READDIRPLUS lookup every entry, which should use the attributes
+	// fetched in batch, and the kernel should answer lstat from its cache
+	// instead of asking the metadata for each of them. The entries are read
+	// in batches so that they are stated before the cache expire.
+	d, err := os.Open(dir)
+	require.NoError(t, err)
+	defer d.Close()
+	listed := 0
+	for {
+		entries, err := d.ReadDir(100)
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		for _, entry := range entries {
+			_, err := os.Lstat(filepath.Join(dir, entry.Name()))
+			require.NoError(t, err)
+		}
+		listed += len(entries)
+	}
+	require.Equal(t, files, listed)
+
+	transactions = metadata.Transactions() - transactions
+	require.Lessf(t, transactions, int64(files/10), "%d metadata transactions to list %d entries", transactions, files)
+}
+
+func TestReaddirPlusStaleEntry(t *testing.T) {
+	ctx := context.Background()
+
+	testEnv := CreateTestEnvironment(ctx, t)
+	defer testEnv.Cleanup(ctx, t)
+
+	dir := filepath.Join(testEnv.Root(), "dir")
+	require.NoError(t, os.Mkdir(dir, 0755))
+	for _, name := range []string{"a", "b", "c"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte("test message"), 0644))
+	}
+
+	// the entries read by the listing must not answer the lookups after
+	// the files are changed
+	for _, name := range []string{"a", "b", "c"} {
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		require.Len(t, entries, 3)
+
+		fileName := filepath.Join(dir, name)
+		require.NoError(t, os.Truncate(fileName, 4))
+		info, err := os.Lstat(fileName)
+		require.NoError(t, err)
+		require.Equal(t, int64(4), info.Size())
+
+		entries, err = os.ReadDir(dir)
+		require.NoError(t, err)
+		require.Len(t, entries, 3)
+
+		require.NoError(t, os.WriteFile(fileName, []byte("another test message"), 0644))
+		info, err = os.Lstat(fileName)
+		require.NoError(t, err)
+		require.Equal(t, int64(len("another test message")), info.Size())
+	}
+}
+
+func TestXattr(t *testing.T) {
+	ctx := context.Background()
+
+	testEnv := CreateTestEnvironment(ctx, t)
+	defer testEnv.Cleanup(ctx, t)
+
+	fileName := filepath.Join(testEnv.Root(), "file")
+	require.NoError(t, os.WriteFile(fileName, []byte("test message"), 0644))
+	dirName := filepath.Join(testEnv.Root(), "dir")
+	require.NoError(t, os.Mkdir(dirName, 0755))
+
+	for _, name := range []string{fileName, dirName} {
+		buf := make([]byte, 64)
+		_, err := syscall.Getxattr(name, "user.missing", buf)
+		require.Equal(t, syscall.ENODATA, err)
+
+		value := []byte("hello")
+		require.NoError(t, syscall.Setxattr(name, "user.a", value, 0))
+		require.NoError(t, syscall.Setxattr(name, "user.b", nil, 0))
+		require.Equal(t, syscall.EEXIST, syscall.Setxattr(name, "user.a", value, 1 /* XATTR_CREATE */))
+		require.Equal(t, syscall.ENODATA, syscall.Setxattr(name, "user.c", value, 2 /* XATTR_REPLACE */))
+
+		size, err := syscall.Getxattr(name, "user.a", nil)
+		require.NoError(t, err)
+		require.Equal(t, len(value), size)
+		_, err = syscall.Getxattr(name, "user.a", make([]byte, 1))
+		require.Equal(t, syscall.ERANGE, err)
+		size, err = syscall.Getxattr(name, "user.a", buf)
+		require.NoError(t, err)
+		require.Equal(t, value, buf[:size])
+
+		size, err = syscall.Listxattr(name, buf)
+		require.NoError(t, err)
+		names := strings.Split(strings.TrimSuffix(string(buf[:size]), "\x00"), "\x00")
+		require.ElementsMatch(t, []string{"user.a", "user.b"}, names)
+
+		require.NoError(t, syscall.Removexattr(name, "user.a"))
+		require.Equal(t, syscall.ENODATA, syscall.Removexattr(name, "user.a"))
+		_, err = syscall.Getxattr(name, "user.a", buf)
+		require.Equal(t, syscall.ENODATA, err)
+	}
+
+	require.Equal(t, syscall.E2BIG, syscall.Setxattr(fileName, "user.big", make([]byte, 64<<10+1), 0))
+
+	// security labels and trusted xattrs can only be set by root
+	if os.Getuid() == 0 {
+		for _, name := range []string{"security.label", "trusted.label"} {
+			value := []byte("system_u:object_r:git_t")
+			require.NoError(t, syscall.Setxattr(fileName, name, value, 0))
+			buf := make([]byte, 64)
+			size, err := syscall.Getxattr(fileName, name, buf)
+			require.NoError(t, err)
+			require.Equal(t, value, buf[:size])
+			require.NoError(t, syscall.Removexattr(fileName, name))
+		}
+	}
+}
+
 func TestGitInit(t *testing.T) {
 	ctx := context.Background()
 
@@ -310,3 +694,853 @@ func checkBareRepoExists(t *testing.T, repoPath string) {
 	require.FileExists(t, fmt.Sprintf("%s/HEAD", repoPath))
 	require.FileExists(t, fmt.Sprintf("%s/config", repoPath))
 }
+
+func TestGitRoutes(t *testing.T) {
+	ctx := context.Background()
+
+	localDir := t.TempDir()
+	testEnv := CreateTestEnvironmentWithOption(ctx, t, &gitfs.Option{
+		Routes:   []string{"index=local", "logs/**=local", "MERGE_HEAD=kv"},
+		LocalDir: localDir,
+	})
+	defer testEnv.Cleanup(ctx, t)
+
+	repoPath := filepath.Join(testEnv.Root(), "test-repo")
+	gitInit(ctx, t, repoPath)
+	gitAdd(ctx, t, repoPath, "test-file", []byte("test-message"))
+	gitCommit(ctx, t, repoPath, "hello world\n")
+
+	gitDir := filepath.Join(repoPath, ".git")
+	require.Equal(t, "hello world", gitOutput(ctx, t, cmd.NewGitCommand("log").WithGitDir(gitDir).
+		WithOptions("--pretty=%s", "--max-count=1").WithArgs("HEAD")))
+
+	// the index and the reflogs are stored in the local directory
+	localFiles, err := os.ReadDir(localDir)
+	require.NoError(t, err)
+	require.NotEmpty(t, localFiles)
+
+	reflog, err := os.ReadFile(filepath.Join(gitDir, "logs", "HEAD"))
+	require.NoError(t, err)
+	require.Contains(t, string(reflog), "hello world")
+
+	index, err := os.Stat(filepath.Join(gitDir, "index"))
+	require.NoError(t, err)
+	require.NotZero(t, index.Size())
+
+	require.NoError(t, os.WriteFile(filepath.Join(gitDir, "MERGE_HEAD"), []byte("merge"), 0644))
+	mergeHead, err := os.ReadFile(filepath.Join(gitDir, "MERGE_HEAD"))
+	require.NoError(t, err)
+	require.Equal(t, "merge", string(mergeHead))
+
+	// rename does not move a file to another backend, and it is moved by a
+	// rename from its lock file, which is in the same backend
+	require.ErrorIs(t, os.Rename(filepath.Join(repoPath, "test-file"), filepath.Join(gitDir, "MERGE_HEAD")), syscall.EXDEV)
+	require.NoError(t, os.WriteFile(filepath.Join(gitDir, "MERGE_HEAD.lock"), []byte("merge again"), 0644))
+	require.NoError(t, os.Rename(filepath.Join(gitDir, "MERGE_HEAD.lock"), filepath.Join(gitDir, "MERGE_HEAD")))
+	mergeHead, err = os.ReadFile(filepath.Join(gitDir, "MERGE_HEAD"))
+	require.NoError(t, err)
+	require.Equal(t, "merge again", string(mergeHead))
+}
+
+func TestRoutesOfVolume(t *testing.T) {
+	if metaEngine() == "bolt" {
+		t.Skip("bolt database can only be opened by one gitfs instance")
+	}
+	ctx := context.Background()
+
+	testEnv := CreateTestEnvironmentWithOption(ctx, t, &gitfs.Option{
+		Routes:   []string{"MERGE_HEAD=kv", "refs/notes/**=object"},
+		LocalDir: t.TempDir(),
+	})
+	defer testEnv.Cleanup(ctx, t)
+
+	// a mount with other routes is rejected
+	tempMntDir := t.TempDir()
+	_, err := gitfs.Mount(ctx, tempMntDir, false, testEnv.testStorage.GetMetadataURL(), testEnv.testStorage.GetDataOption(), &gitfs.Option{
+		Routes:   []string{"MERGE_HEAD=local"},
+		LocalDir: t.TempDir(),
+	})
+	require.ErrorContains(t, err, "mismatch the routes")
+
+	// a mount without routes use the routes of the volume
+	mntDir, server := mountTestStorage(ctx, t, testEnv.testStorage, &gitfs.Option{})
+	defer func() {
+		require.NoError(t, server.Unmount())
+		require.NoError(t, os.RemoveAll(mntDir))
+	}()
+	gitDir := filepath.Join(testEnv.Root(), "test-repo", ".git")
+	gitInit(ctx, t, filepath.Join(testEnv.Root(), "test-repo"))
+	require.NoError(t, os.WriteFile(filepath.Join(gitDir, "MERGE_HEAD"), []byte("merge"), 0644))
+	mergeHead, err := os.ReadFile(filepath.Join(mntDir, "test-repo", ".git", "MERGE_HEAD"))
+	require.NoError(t, err)
+	require.Equal(t, "merge", string(mergeHead))
+
+	meta, err := metadata.NewMeta(testEnv.testStorage.GetMetadataURL())
+	require.NoError(t, err)
+	routes, err := meta.GetSetting(ctx, "routes")
+	require.NoError(t, err)
+	require.Contains(t, string(routes), "MERGE_HEAD=kv")
+
+	// update-refs only update the refs stored as ref records
+	err = gitfs.UpdateRefs(ctx, meta, "test-repo", []*metadata.RefUpdate{
+		{Ref: "refs/notes/commits", New: strings.Repeat("1", 40)},
+	})
+	require.ErrorContains(t, err, "routed to object")
+}
+
+func TestGitPackRefs(t *testing.T) {
+	ctx := context.Background()
+
+	testEnv := CreateTestEnvironment(ctx, t)
+	defer testEnv.Cleanup(ctx, t)
+
+	repoPath := filepath.Join(testEnv.Root(), "test-repo")
+	gitInit(ctx, t, repoPath)
+	gitAdd(ctx, t, repoPath, "test-file", []byte("test-message"))
+	gitCommit(ctx, t, repoPath, "hello world\n")
+
+	gitDir := filepath.Join(repoPath, ".git")
+	head := gitOutput(ctx, t, cmd.NewGitCommand("rev-parse").WithGitDir(gitDir).WithArgs("HEAD"))
+	for _, args := range [][]string{
+		{"branch", "feature"},
+		{"tag", "-a", "-m", "tag message", "v1"},
+		{"pack-refs", "--all"},
+	} {
+		gitOutput(ctx, t, cmd.NewGitCommand(args[0]).WithGitDir(gitDir).WithArgs(args[1:]...))
+	}
+
+	// the refs are rendered from the records in the metadata
+	packedRefs, err := os.ReadFile(filepath.Join(gitDir, "packed-refs"))
+	require.NoError(t, err)
+	require.Contains(t, string(packedRefs), head+" refs/heads/feature\n")
+	require.Contains(t, string(packedRefs), "\n^"+head+"\n")
+	require.NoFileExists(t, filepath.Join(gitDir, "refs", "heads", "feature"))
+
+	require.Equal(t, head, gitOutput(ctx, t, cmd.NewGitCommand("rev-parse").WithGitDir(gitDir).WithArgs("feature")))
+	tags := gitOutput(ctx, t, cmd.NewGitCommand("for-each-ref").WithGitDir(gitDir).
+		WithOptions("--format=%(refname) %(*objectname)").WithArgs("refs/tags"))
+	require.Equal(t, "refs/tags/v1 "+head, tags)
+
+	// deleting a packed ref rewrite packed-refs
+	gitOutput(ctx, t, cmd.NewGitCommand("branch").WithGitDir(gitDir).WithArgs("-D", "feature"))
+	packedRefs, err = os.ReadFile(filepath.Join(gitDir, "packed-refs"))
+	require.NoError(t, err)
+	require.NotContains(t, string(packedRefs), "refs/heads/feature")
+}
+
+func TestWatchRefs(t *testing.T) {
+	if metaEngine() == "bolt" {
+		t.Skip("bolt database can only be opened by one gitfs instance")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	testEnv := CreateTestEnvironment(ctx, t)
+	defer testEnv.Cleanup(ctx, t)
+
+	meta, err := metadata.NewMeta(testEnv.testStorage.GetMetadataURL())
+	require.NoError(t, err)
+	events, err := meta.WatchRefEvents(ctx)
+	require.NoError(t, err)
+
+	repoPath := filepath.Join(testEnv.Root(), "test-repo")
+	gitInit(ctx, t, repoPath)
+	gitAdd(ctx, t, repoPath, "test-file", []byte("test-message"))
+	gitCommit(ctx, t, repoPath, "hello world\n")
+
+	gitDir := filepath.Join(repoPath, ".git")
+	oid := gitOutput(ctx, t, cmd.NewGitCommand("rev-parse").WithGitDir(gitDir).WithArgs("HEAD"))
+	tree := gitOutput(ctx, t, cmd.NewGitCommand("write-tree").WithGitDir(gitDir))
+	newOid := gitOutput(ctx, t, cmd.NewGitCommand("commit-tree").WithGitDir(gitDir).
+		WithOptions("-m", "another commit").WithArgs(tree))
+
+	expected := []metadata.RefEvent{
+		{Repo: "test-repo", Ref: "refs/heads/ci", Old: "", New: oid},
+		{Repo: "test-repo", Ref: "refs/heads/ci", Old: oid, New: newOid},
+		{Repo: "test-repo", Ref: "refs/heads/ci", Old: newOid, New: ""},
+	}
+	gitOutput(ctx, t, cmd.NewGitCommand("update-ref").WithGitDir(gitDir).WithArgs("refs/heads/ci", oid))
+	gitOutput(ctx, t, cmd.NewGitCommand("update-ref").WithGitDir(gitDir).WithArgs("refs/heads/ci", newOid, oid))
+	gitOutput(ctx, t, cmd.NewGitCommand("update-ref").WithGitDir(gitDir).WithArgs("-d", "refs/heads/ci"))
+
+	// the events of the other refs changed by the commit are skipped
+	for len(expected) > 0 {
+		select {
+		case event := <-events:
+			if event.Ref == "refs/heads/ci" {
+				require.Equal(t, expected[0], *event)
+				expected = expected[1:]
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("missing ref events %v", expected)
+		}
+	}
+}
+
+func TestUpdateRefs(t *testing.T) {
+	if metaEngine() == "bolt" {
+		t.Skip("bolt database can only be opened by one gitfs instance")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	testEnv := CreateTestEnvironment(ctx, t)
+	defer testEnv.Cleanup(ctx, t)
+
+	meta, err := metadata.NewMeta(testEnv.testStorage.GetMetadataURL())
+	require.NoError(t, err)
+
+	repoPath := filepath.Join(testEnv.Root(), "test-repo")
+	gitInit(ctx, t, repoPath)
+	gitAdd(ctx, t, repoPath, "test-file", []byte("test-message"))
+	gitCommit(ctx, t, repoPath, "hello world\n")
+
+	gitDir := filepath.Join(repoPath, ".git")
+	oid := gitOutput(ctx, t, cmd.NewGitCommand("rev-parse").WithGitDir(gitDir).WithArgs("HEAD"))
+	tree := gitOutput(ctx, t, cmd.NewGitCommand("write-tree").WithGitDir(gitDir))
+	newOid := gitOutput(ctx, t, cmd.NewGitCommand("commit-tree").WithGitDir(gitDir).
+		WithOptions("-m", "another commit").WithArgs(tree))
+	zeroOid := strings.Repeat("0", len(oid))
+
+	err = gitfs.UpdateRefs(ctx, meta, "test-repo", []*metadata.RefUpdate{
+		{Ref: "refs/heads/master", Old: oid, New: newOid},
+		{Ref: "refs/heads/topic/a", Old: zeroOid, New: newOid},
+		{Ref: "refs/tags/v1", New: oid},
+	})
+	require.NoError(t, err)
+	require.Equal(t, newOid, gitOutput(ctx, t, cmd.NewGitCommand("rev-parse").WithGitDir(gitDir).WithArgs("master")))
+	require.Equal(t, newOid, gitOutput(ctx, t, cmd.NewGitCommand("rev-parse").WithGitDir(gitDir).WithArgs("topic/a")))
+	require.Equal(t, oid, gitOutput(ctx, t, cmd.NewGitCommand("rev-parse").WithGitDir(gitDir).WithArgs("v1")))
+
+	// nothing is applied if any ref has changed
+	err = gitfs.UpdateRefs(ctx, meta, "test-repo", []*metadata.RefUpdate{
+		{Ref: "refs/heads/other", Old: zeroOid, New: oid},
+		{Ref: "refs/heads/master", Old: oid, New: oid},
+	})
+	var conflict *metadata.RefConflictError
+	require.ErrorAs(t, err, &conflict)
+	require.Equal(t, "refs/heads/master", conflict.Ref)
+	require.Equal(t, newOid, conflict.Actual)
+	require.NotContains(t, gitOutput(ctx, t, cmd.NewGitCommand("show-ref").WithGitDir(gitDir)), "refs/heads/other")
+
+	err = gitfs.UpdateRefs(ctx, meta, "test-repo", []*metadata.RefUpdate{
+		{Ref: "refs/heads/topic/a", Old: newOid, New: zeroOid},
+	})
+	require.NoError(t, err)
+	require.NotContains(t, gitOutput(ctx, t, cmd.NewGitCommand("show-ref").WithGitDir(gitDir)), "refs/heads/topic/a")
+
+	// the reflog of a ref is deleted with it
+	gitOutput(ctx, t, cmd.NewGitCommand("branch").WithGitDir(gitDir).WithArgs("doomed"))
+	require.FileExists(t, filepath.Join(gitDir, "logs", "refs", "heads", "doomed"))
+	err = gitfs.UpdateRefs(ctx, meta, "test-repo", []*metadata.RefUpdate{
+		{Ref: "refs/heads/doomed", Old: newOid, New: zeroOid},
+	})
+	require.NoError(t, err)
+	require.NoFileExists(t, filepath.Join(gitDir, "logs", "refs", "heads", "doomed"))
+}
+
+func TestGitReflog(t *testing.T) {
+	ctx := context.Background()
+
+	testEnv := CreateTestEnvironment(ctx, t)
+	defer testEnv.Cleanup(ctx, t)
+
+	repoPath := filepath.Join(testEnv.Root(), "test-repo")
+	gitInit(ctx, t, repoPath)
+	gitAdd(ctx, t, repoPath, "test-file", []byte("test-message"))
+	gitCommit(ctx, t, repoPath, "hello world\n")
+	gitAdd(ctx, t, repoPath, "test-file2", []byte("test-message2"))
+	gitCommit(ctx, t, repoPath, "hello world again\n")
+
+	gitDir := filepath.Join(repoPath, ".git")
+	reflog := gitOutput(ctx, t, cmd.NewGitCommand("reflog").WithGitDir(gitDir).
+		WithArgs("show", "--pretty=%gs", "master"))
+	require.Equal(t, "commit: hello world again\ncommit (initial): hello world", reflog)
+
+	fileInfo, err := os.Stat(filepath.Join(gitDir, "logs", "refs", "heads", "master"))
+	require.NoError(t, err)
+	content, err := os.ReadFile(filepath.Join(gitDir, "logs", "refs", "heads", "master"))
+	require.NoError(t, err)
+	require.Equal(t, int64(len(content)), fileInfo.Size())
+	require.Equal(t, 2, strings.Count(string(content), "\n"))
+
+	// expire rewrite the reflog by renaming its lock file
+	gitOutput(ctx, t, cmd.NewGitCommand("reflog").WithGitDir(gitDir).
+		WithArgs("expire", "--expire=all", "--all"))
+	reflog = gitOutput(ctx, t, cmd.NewGitCommand("reflog").WithGitDir(gitDir).WithArgs("show", "master"))
+	require.Empty(t, reflog)
+}
+
+func TestGitLooseObjects(t *testing.T) {
+	ctx := context.Background()
+
+	testEnv := CreateTestEnvironment(ctx, t)
+	defer testEnv.Cleanup(ctx, t)
+
+	var oids []string
+	var objectFiles [][]byte
+	for _, repo := range []string{"test-repo", "test-repo2", "test-repo3"} {
+		repoPath := filepath.Join(testEnv.Root(), repo)
+		gitDir := filepath.Join(repoPath, ".git")
+		gitInit(ctx, t, repoPath)
+		if repo == "test-repo3" {
+			gitOutput(ctx, t, cmd.NewGitCommand("config").WithGitDir(gitDir).WithArgs("core.looseCompression", "9"))
+		}
+		gitAdd(ctx, t, repoPath, "test-file", []byte("test-message"))
+
+		oid := gitOutput(ctx, t, cmd.NewGitCommand("rev-parse").WithGitDir(gitDir).WithArgs(":test-file"))
+		content := gitOutput(ctx, t, cmd.NewGitCommand("cat-file").WithGitDir(gitDir).WithArgs("-p", oid))
+		require.Equal(t, "test-message", content)
+		gitOutput(ctx, t, cmd.NewGitCommand("fsck").WithGitDir(gitDir))
+		oids = append(oids, oid)
+
+		objectFile, err := os.ReadFile(filepath.Join(gitDir, "objects", oid[:2], oid[2:]))
+		require.NoError(t, err)
+		objectFiles = append(objectFiles, objectFile)
+	}
+	require.Equal(t, oids[0], oids[1])
+	require.Equal(t, oids[0], oids[2])
+
+	// the blob of the first two repositories is stored once by its oid, and
+	// the one compressed with another level keep its own bytes
+	require.Equal(t, objectFiles[0], objectFiles[1])
+	require.NotEqual(t, objectFiles[0], objectFiles[2])
+	objectStorage, err := data.NewObjectStorage(testEnv.testStorage.GetDataOption())
+	require.NoError(t, err)
+	objects, err := objectStorage.List("objects/"+oids[0]+"/", "", 10)
+	require.NoError(t, err)
+	require.Len(t, objects, 2)
+}
+
+// writeBaselineFile create the file name in parent with content stored in a
+// chunk by the page pool, which is how all the files in .git but the refs are
+// stored by the baseline layout
+func writeBaselineFile(ctx context.Context, t *testing.T, source *datasource.DataSource, parent metadata.Ino, name string, content []byte) {
+	attr, ino, eno := source.Meta.MkNod(ctx, parent, metadata.TypeFile, name, 0644, 0)
+	require.Equal(t, syscall.F_OK, eno)
+	storagePath := page.StoragePath(content)
+	require.NoError(t, source.Data.Put(storagePath, bytes.NewReader(content)))
+	require.NoError(t, source.Meta.SetChunkMeta(ctx, ino, 0, 0, len(content), storagePath))
+	attr.Length = uint64(len(content))
+	require.NoError(t, source.Meta.SetattrDirectly(ctx, ino, attr))
+}
+
+func TestMountBaselineLayout(t *testing.T) {
+	if metaEngine() == "bolt" {
+		t.Skip("bolt database can only be opened by one gitfs instance")
+	}
+	ctx := context.Background()
+
+	testStorage := CreateTestStorage(ctx, t)
+	defer testStorage.Cleanup(ctx, t)
+
+	meta, err := metadata.NewMeta(testStorage.GetMetadataURL())
+	require.NoError(t, err)
+	require.NoError(t, meta.Init(ctx))
+	objectStorage, err := data.NewObjectStorage(testStorage.GetDataOption())
+	require.NoError(t, err)
+	require.NoError(t, objectStorage.Init())
+	source := &datasource.DataSource{Meta: meta, Data: objectStorage}
+
+	mkdir := func(parent metadata.Ino, name string) metadata.Ino {
+		_, ino, eno := meta.MkNod(ctx, parent, metadata.TypeDirectory, name, 0755, 0)
+		require.Equal(t, syscall.F_OK, eno)
+		return ino
+	}
+	gitDirIno := mkdir(mkdir(1, "test-repo"), ".git")
+	packedRefs := []byte("# pack-refs with: peeled fully-peeled sorted \n" + strings.Repeat("1", 40) + " refs/heads/master\n")
+	writeBaselineFile(ctx, t, source, gitDirIno, "packed-refs", packedRefs)
+	reflog := []byte("old entry\n")
+	writeBaselineFile(ctx, t, source, mkdir(gitDirIno, "logs"), "HEAD", reflog)
+	object := []byte("legacy loose object")
+	objectName := strings.Repeat("2", 38)
+	writeBaselineFile(ctx, t, source, mkdir(mkdir(gitDirIno, "objects"), "ab"), objectName, object)
+
+	mntDir, server := mountTestStorage(ctx, t, testStorage, nil)
+	defer func() {
+		require.NoError(t, server.Unmount())
+		require.NoError(t, os.RemoveAll(mntDir))
+	}()
+	gitDir := filepath.Join(mntDir, "test-repo", ".git")
+
+	// the files are read from their chunks
+	for file, content := range map[string][]byte{
+		"packed-refs":                              packedRefs,
+		filepath.Join("logs", "HEAD"):              reflog,
+		filepath.Join("objects", "ab", objectName): object,
+	} {
+		got, err := os.ReadFile(filepath.Join(gitDir, file))
+		require.NoError(t, err)
+		require.Equal(t, content, got)
+		fileInfo, err := os.Stat(filepath.Join(gitDir, file))
+		require.NoError(t, err)
+		require.Equal(t, int64(len(content)), fileInfo.Size())
+	}
+
+	// and they are stored in the metadata when they are written
+	f, err := os.OpenFile(filepath.Join(gitDir, "logs", "HEAD"), os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteString("new entry\n")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	got, err := os.ReadFile(filepath.Join(gitDir, "logs", "HEAD"))
+	require.NoError(t, err)
+	require.Equal(t, "old entry\nnew entry\n", string(got))
+
+	packedRefs = []byte("# pack-refs with: peeled fully-peeled sorted \n" + strings.Repeat("3", 40) + " refs/heads/master\n")
+	require.NoError(t, os.WriteFile(filepath.Join(gitDir, "packed-refs"), packedRefs, 0644))
+	got, err = os.ReadFile(filepath.Join(gitDir, "packed-refs"))
+	require.NoError(t, err)
+	require.Equal(t, packedRefs, got)
+
+	packedRefsEntry, ok, err := meta.GetDentry(ctx, gitDirIno, "packed-refs")
+	require.NoError(t, err)
+	require.True(t, ok)
+	stored, ok, err := meta.PackedRefGet(ctx, packedRefsEntry.Ino, "refs/heads/master")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, strings.Repeat("3", 40), stored.Oid)
+	_, ok, err = meta.GetChunkMeta(ctx, packedRefsEntry.Ino, 0)
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func TestDedupeChunks(t *testing.T) {
+	if metaEngine() == "bolt" {
+		t.Skip("bolt database can only be opened by one gitfs instance")
+	}
+	ctx := context.Background()
+
+	testEnv := CreateTestEnvironment(ctx, t)
+	defer testEnv.Cleanup(ctx, t)
+
+	meta, err := metadata.NewMeta(testEnv.testStorage.GetMetadataURL())
+	require.NoError(t, err)
+
+	// two pages of different content
+	content := append(bytes.Repeat([]byte("a"), 1<<20), bytes.Repeat([]byte("b"), 1<<20)...)
+	for _, fork := range []string{"fork1", "fork2"} {
+		require.NoError(t, os.WriteFile(filepath.Join(testEnv.Root(), fork), content, 0644))
+	}
+
+	stats, err := meta.DedupeStats(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), stats.Objects)
+	require.Equal(t, int64(4), stats.Chunks)
+	require.Equal(t, int64(2*len(content)), stats.LogicalBytes)
+	require.Equal(t, int64(len(content)), stats.StoredBytes)
+	require.Equal(t, 2.0, stats.Ratio())
+
+	got, err := os.ReadFile(filepath.Join(testEnv.Root(), "fork2"))
+	require.NoError(t, err)
+	require.Equal(t, content, got)
+
+	require.NoError(t, os.Remove(filepath.Join(testEnv.Root(), "fork1")))
+	stats, err = meta.DedupeStats(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), stats.Objects)
+	require.Equal(t, int64(2), stats.Chunks)
+	require.Equal(t, 1.0, stats.Ratio())
+}
+
+func TestFileDataChecksum(t *testing.T) {
+	if dataEngine() != "file" {
+		t.Skip("only the file object storage keep the objects in a local directory")
+	}
+	ctx := context.Background()
+
+	testEnv := CreateTestEnvironment(ctx, t)
+	defer testEnv.Cleanup(ctx, t)
+
+	content := bytes.Repeat([]byte("checksum"), 1<<10)
+	require.NoError(t, os.WriteFile(filepath.Join(testEnv.Root(), "file"), content, 0644))
+
+	var objects []string
+	err := filepath.WalkDir(testEnv.testStorage.dataDir, func(p string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		require.False(t, strings.HasPrefix(d.Name(), "."), "temporary file %s is left", p)
+		checksum := make([]byte, 16)
+		_, err = unix.Getxattr(p, "user.tinygitfs.Crc32c", checksum)
+		require.NoError(t, err)
+		objects = append(objects, p)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, objects, 1)
+
+	got, err := os.ReadFile(filepath.Join(testEnv.Root(), "file"))
+	require.NoError(t, err)
+	require.Equal(t, content, got)
+
+	// flip a byte of the object, which is found when the object is read
+	// whole by the range of its chunk
+	f, err := os.OpenFile(objects[0], os.O_RDWR, 0)
+	require.NoError(t, err)
+	b := make([]byte, 1)
+	_, err = f.ReadAt(b, 10)
+	require.NoError(t, err)
+	b[0] ^= 0xff
+	_, err = f.WriteAt(b, 10)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	rel, err := filepath.Rel(testEnv.testStorage.dataDir, objects[0])
+	require.NoError(t, err)
+	objectStorage, err := data.NewObjectStorage(testEnv.testStorage.GetDataOption())
+	require.NoError(t, err)
+	reader, err := objectStorage.Get(filepath.ToSlash(rel), 0, int64(len(content)))
+	require.NoError(t, err)
+	_, err = io.ReadAll(reader)
+	reader.Close()
+	require.Error(t, err)
+}
+
+func TestFileDataList(t *testing.T) {
+	storage := data.NewFileData(t.TempDir())
+	require.NoError(t, storage.Init())
+	// a key sorts before the keys of the directory with the same name
+	keys := []string{"a-b", "a.txt", "a/b", "a/c/d", "b/x", "objects/ab/cd", "objects/ab/ce", "objects/ac/00"}
+	for _, key := range keys {
+		require.NoError(t, storage.Put(key, strings.NewReader(key)))
+	}
+
+	for _, prefix := range []string{"", "a", "objects/a", "objects/ab/"} {
+		var want []string
+		for _, key := range keys {
+			if strings.HasPrefix(key, prefix) {
+				want = append(want, key)
+			}
+		}
+		for limit := int64(1); limit <= 3; limit++ {
+			var got []string
+			marker := ""
+			for {
+				objs, err := storage.List(prefix, marker, limit)
+				require.NoError(t, err)
+				for _, obj := range objs {
+					got = append(got, obj.Key())
+				}
+				if int64(len(objs)) < limit {
+					break
+				}
+				marker = objs[len(objs)-1].Key()
+			}
+			require.Equal(t, want, got, "prefix %q, limit %d", prefix, limit)
+		}
+	}
+}
+
+func TestGarbageCollect(t *testing.T) {
+	if metaEngine() == "bolt" {
+		t.Skip("bolt database can only be opened by one gitfs instance")
+	}
+	ctx := context.Background()
+
+	testEnv := CreateTestEnvironment(ctx, t)
+	defer testEnv.Cleanup(ctx, t)
+
+	meta, err := metadata.NewMeta(testEnv.testStorage.GetMetadataURL())
+	require.NoError(t, err)
+	objectStorage, err := data.NewObjectStorage(testEnv.testStorage.GetDataOption())
+	require.NoError(t, err)
+	source := &datasource.DataSource{Meta: meta, Data: objectStorage}
+
+	filePath := filepath.Join(testEnv.Root(), "file")
+	require.NoError(t, os.WriteFile(filePath, []byte("old content"), 0644))
+	// the object of the old content is referred by no chunk after it is overwritten
+	require.NoError(t, os.WriteFile(filePath, []byte("new content"), 0644))
+	// an object left by a failed write
+	require.NoError(t, objectStorage.Put("chunks/sha256/orphan", strings.NewReader("orphan")))
+
+	report, err := gc.Collect(ctx, source, &gc.Option{Grace: time.Hour})
+	require.NoError(t, err)
+	require.Equal(t, int64(3), report.Objects)
+	require.Equal(t, int64(3), report.Young)
+	require.Equal(t, int64(0), report.Deleted)
+
+	report, err = gc.Collect(ctx, source, &gc.Option{DryRun: true})
+	require.NoError(t, err)
+	require.Equal(t, int64(3), report.Objects)
+	require.Equal(t, int64(1), report.Live)
+	require.Equal(t, int64(2), report.Orphans)
+	require.Equal(t, int64(len("old content")+len("orphan")), report.OrphanBytes)
+	require.Equal(t, int64(0), report.Deleted)
+
+	report, err = gc.Collect(ctx, source, &gc.Option{})
+	require.NoError(t, err)
+	require.Equal(t, int64(2), report.Deleted)
+
+	report, err = gc.Collect(ctx, source, &gc.Option{})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), report.Objects)
+	require.Equal(t, int64(1), report.Live)
+	require.Equal(t, int64(0), report.Orphans)
+
+	got, err := os.ReadFile(filePath)
+	require.NoError(t, err)
+	require.Equal(t, []byte("new content"), got)
+}
+
+// blockingDelete is an object storage whose deletions wait until unblock is closed
+type blockingDelete struct {
+	data.ObjectStorage
+	deleting chan string
+	unblock  chan struct{}
+}
+
+func (s *blockingDelete) Delete(key string) error {
+	s.deleting <- key
+	<-s.unblock
+	return s.ObjectStorage.Delete(key)
+}
+
+func TestGarbageCollectWhileWriting(t *testing.T) {
+	if metaEngine() == "bolt" {
+		t.Skip("bolt database can only be opened by one gitfs instance")
+	}
+	ctx := context.Background()
+
+	testEnv := CreateTestEnvironment(ctx, t)
+	defer testEnv.Cleanup(ctx, t)
+
+	meta, err := metadata.NewMeta(testEnv.testStorage.GetMetadataURL())
+	require.NoError(t, err)
+	objectStorage, err := data.NewObjectStorage(testEnv.testStorage.GetDataOption())
+	require.NoError(t, err)
+	blocking := &blockingDelete{
+		ObjectStorage: objectStorage,
+		deleting:      make(chan string),
+		unblock:       make(chan struct{}),
+	}
+	source := &datasource.DataSource{Meta: meta, Data: blocking}
+
+	content := []byte("content written while gc is running")
+	key := page.StoragePath(content)
+	require.NoError(t, os.WriteFile(filepath.Join(testEnv.Root(), "old"), content, 0644))
+	require.NoError(t, os.Remove(filepath.Join(testEnv.Root(), "old")))
+	require.Eventually(t, func() bool {
+		_, ok, err := meta.GetChunkRef(ctx, key)
+		return err == nil && !ok
+	}, 5*time.Second, 10*time.Millisecond, "the chunk of the removed file is still referred")
+
+	gcErr := make(chan error)
+	go func() {
+		_, err := gc.Collect(ctx, source, &gc.Option{})
+		gcErr <- err
+	}()
+	require.Equal(t, key, <-blocking.deleting)
+
+	// the same content is written while gc is deleting the orphaned object of
+	// it, which is stored again after the object is deleted
+	written := make(chan error)
+	go func() {
+		written <- os.WriteFile(filepath.Join(testEnv.Root(), "new"), content, 0644)
+	}()
+	select {
+	case err := <-written:
+		t.Fatalf("write is done before the object is deleted: %v", err)
+	case <-time.After(300 * time.Millisecond):
+	}
+	close(blocking.unblock)
+	require.NoError(t, <-gcErr)
+	require.NoError(t, <-written)
+
+	object, err := objectStorage.Head(key)
+	require.NoError(t, err)
+	require.NotNil(t, object, "object of the new file is deleted by gc")
+	ref, ok, err := meta.GetChunkRef(ctx, key)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, int64(1), ref.Refs)
+}
+
+func TestGarbageCollectReusedObject(t *testing.T) {
+	if metaEngine() == "bolt" {
+		t.Skip("bolt database can only be opened by one gitfs instance")
+	}
+	ctx := context.Background()
+
+	testEnv := CreateTestEnvironment(ctx, t)
+	defer testEnv.Cleanup(ctx, t)
+
+	meta, err := metadata.NewMeta(testEnv.testStorage.GetMetadataURL())
+	require.NoError(t, err)
+	objectStorage, err := data.NewObjectStorage(testEnv.testStorage.GetDataOption())
+	require.NoError(t, err)
+	source := &datasource.DataSource{Meta: meta, Data: objectStorage}
+
+	content := []byte("content reused while gc is running")
+	key := page.StoragePath(content)
+	require.NoError(t, os.WriteFile(filepath.Join(testEnv.Root(), "old"), content, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(testEnv.Root(), "new"), nil, 0644))
+	info, err := os.Stat(filepath.Join(testEnv.Root(), "new"))
+	require.NoError(t, err)
+	inode := metadata.Ino(info.Sys().(*syscall.Stat_t).Ino)
+
+	// a writer find the object referred and skip the upload of it
+	_, ok, err := meta.GetChunkRef(ctx, key)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	// the last chunk refer to the object is dropped and gc delete it before
+	// the writer set its chunk
+	require.NoError(t, os.Remove(filepath.Join(testEnv.Root(), "old")))
+	require.Eventually(t, func() bool {
+		_, ok, err := meta.GetChunkRef(ctx, key)
+		return err == nil && !ok
+	}, 5*time.Second, 10*time.Millisecond, "the chunk of the removed file is still referred")
+	report, err := gc.Collect(ctx, source, &gc.Option{})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), report.Deleted)
+
+	err = meta.SetChunkAttr(ctx, inode, 0, &metadata.ChunkAttr{
+		Length:      len(content),
+		StoragePath: key,
+		Reused:      true,
+	})
+	require.ErrorIs(t, err, metadata.ErrChunkFenced)
+	_, ok, err = meta.GetChunkRef(ctx, key)
+	require.NoError(t, err)
+	require.False(t, ok, "chunk ref is created for the deleted object")
+
+	// the page is uploaded again once the reused object is gone
+	p := page.NewPage(0)
+	p.Write(0, content)
+	require.NoError(t, p.Fsync(ctx, source, inode))
+	object, err := objectStorage.Head(key)
+	require.NoError(t, err)
+	require.NotNil(t, object, "object of the page is not uploaded again")
+	ref, ok, err := meta.GetChunkRef(ctx, key)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, int64(1), ref.Refs)
+}
+
+// blockingPut is an object storage whose uploads wait until unblock is closed
+type blockingPut struct {
+	data.ObjectStorage
+	putting chan string
+	unblock chan struct{}
+}
+
+func (s *blockingPut) Put(key string, in io.Reader) error {
+	s.putting <- key
+	<-s.unblock
+	return s.ObjectStorage.Put(key, in)
+}
+
+func TestGarbageCollectWhileUploading(t *testing.T) {
+	if metaEngine() == "bolt" {
+		t.Skip("bolt database can only be opened by one gitfs instance")
+	}
+	ctx := context.Background()
+
+	testEnv := CreateTestEnvironment(ctx, t)
+	defer testEnv.Cleanup(ctx, t)
+
+	meta, err := metadata.NewMeta(testEnv.testStorage.GetMetadataURL())
+	require.NoError(t, err)
+	objectStorage, err := data.NewObjectStorage(testEnv.testStorage.GetDataOption())
+	require.NoError(t, err)
+	source := &datasource.DataSource{Meta: meta, Data: objectStorage}
+	blocking := &blockingPut{
+		ObjectStorage: objectStorage,
+		putting:       make(chan string),
+		unblock:       make(chan struct{}),
+	}
+	writerSource := &datasource.DataSource{Meta: meta, Data: blocking}
+
+	content := []byte("content uploaded again while gc is running")
+	key := page.StoragePath(content)
+	require.NoError(t, os.WriteFile(filepath.Join(testEnv.Root(), "old"), content, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(testEnv.Root(), "new"), nil, 0644))
+	info, err := os.Stat(filepath.Join(testEnv.Root(), "new"))
+	require.NoError(t, err)
+	inode := metadata.Ino(info.Sys().(*syscall.Stat_t).Ino)
+	require.NoError(t, os.Remove(filepath.Join(testEnv.Root(), "old")))
+	require.Eventually(t, func() bool {
+		_, ok, err := meta.GetChunkRef(ctx, key)
+		return err == nil && !ok
+	}, 5*time.Second, 10*time.Millisecond, "the chunk of the removed file is still referred")
+
+	// the writer overwrite the orphaned object in place, which keep its old
+	// mtime until the upload is done, while gc is collecting it
+	fsynced := make(chan error)
+	go func() {
+		p := page.NewPage(0)
+		p.Write(0, content)
+		fsynced <- p.Fsync(ctx, writerSource, inode)
+	}()
+	require.Equal(t, key, <-blocking.putting)
+	report, err := gc.Collect(ctx, source, &gc.Option{})
+	require.NoError(t, err)
+	require.Equal(t, int64(0), report.Deleted, "object being uploaded is deleted by gc")
+	close(blocking.unblock)
+	require.NoError(t, <-fsynced)
+
+	object, err := objectStorage.Head(key)
+	require.NoError(t, err)
+	require.NotNil(t, object, "object of the page is deleted by gc")
+	ref, ok, err := meta.GetChunkRef(ctx, key)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, int64(1), ref.Refs)
+}
+
+func TestCompressChunks(t *testing.T) {
+	if metaEngine() == "bolt" {
+		t.Skip("bolt database can only be opened by one gitfs instance")
+	}
+	ctx := context.Background()
+
+	testEnv := CreateTestEnvironmentWithOption(ctx, t, &gitfs.Option{Compress: "zstd"})
+	defer testEnv.Cleanup(ctx, t)
+
+	meta, err := metadata.NewMeta(testEnv.testStorage.GetMetadataURL())
+	require.NoError(t, err)
+	chunkOf := func(filePath string, pageNum int64) *metadata.ChunkAttr {
+		info, err := os.Stat(filePath)
+		require.NoError(t, err)
+		chunkAttr, ok, err := meta.GetChunkMeta(ctx, metadata.Ino(info.Sys().(*syscall.Stat_t).Ino), pageNum)
+		require.NoError(t, err)
+		require.True(t, ok)
+		return chunkAttr
+	}
+
+	compressible := bytes.Repeat([]byte("tinygitfs "), 150000)
+	require.NoError(t, os.WriteFile(filepath.Join(testEnv.Root(), "zstd"), compressible, 0644))
+	for _, pageNum := range []int64{0, 1} {
+		chunkAttr := chunkOf(filepath.Join(testEnv.Root(), "zstd"), pageNum)
+		require.Equal(t, "zstd", chunkAttr.Compression)
+		require.Less(t, chunkAttr.StoredLength, chunkAttr.Length)
+	}
+	// the content which is not smaller compressed is stored as it is
+	random := make([]byte, 4096)
+	_, err = rand.Read(random)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(testEnv.Root(), "random"), random, 0644))
+	require.Equal(t, "", chunkOf(filepath.Join(testEnv.Root(), "random"), 0).Compression)
+
+	// the chunks written with any compression can be read by another mount
+	anotherRoot, server := mountTestStorage(ctx, t, testEnv.testStorage, &gitfs.Option{Compress: "lz4"})
+	defer func() {
+		require.NoError(t, server.Unmount())
+		require.NoError(t, os.RemoveAll(anotherRoot))
+	}()
+	require.NoError(t, os.WriteFile(filepath.Join(anotherRoot, "lz4"), compressible, 0644))
+	require.Equal(t, "lz4", chunkOf(filepath.Join(anotherRoot, "lz4"), 0).Compression)
+
+	for _, root := range []string{testEnv.Root(), anotherRoot} {
+		for name, content := range map[string][]byte{"zstd": compressible, "lz4": compressible, "random": random} {
+			got, err := os.ReadFile(filepath.Join(root, name))
+			require.NoError(t, err)
+			require.Equal(t, content, got, "%s in %s", name, root)
+		}
+	}
+
+	stats, err := meta.DedupeStats(ctx)
+	require.NoError(t, err)
+	require.Less(t, stats.StoredBytes, stats.LogicalBytes)
+}
@@ -0,0 +1,271 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/adlternative/tinygitfs/pkg/cmd"
+	"github.com/adlternative/tinygitfs/pkg/metadata"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConcurrentCreateRename(t *testing.T) {
+	if metaEngine() == "bolt" {
+		t.Skip("bolt database can only be opened by one gitfs instance")
+	}
+	ctx := context.Background()
+
+	testEnv := CreateTestEnvironment(ctx, t)
+	defer testEnv.Cleanup(ctx, t)
+
+	anotherRoot, unmount := testEnv.MountAnother(ctx, t)
+	defer unmount()
+
+	require.NoError(t, os.Mkdir(filepath.Join(testEnv.Root(), "dir"), 0755))
+
+	const workers = 4
+	const files = 50
+	const targets = 5
+
+	var wg sync.WaitGroup
+	errCh := make(chan error, workers*files*2)
+	for w := 0; w < workers; w++ {
+		root := testEnv.Root()
+		if w%2 == 1 {
+			root = anotherRoot
+		}
+		wg.Add(1)
+		go func(w int, dir string) {
+			defer wg.Done()
+			for i := 0; i < files; i++ {
+				name := filepath.Join(dir, fmt.Sprintf("file-%d-%d", w, i))
+				file, err := os.Create(name)
+				if err != nil {
+					errCh <- err
+					continue
+				}
+				if err := file.Close(); err != nil {
+					errCh <- err
+				}
+				// all the workers race to replace the same targets
+				if err := os.Rename(name, filepath.Join(dir, fmt.Sprintf("target-%d", i%targets))); err != nil {
+					errCh <- err
+				}
+			}
+		}(w, filepath.Join(root, "dir"))
+	}
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		require.NoError(t, err)
+	}
+
+	var names [][]string
+	for _, root := range []string{testEnv.Root(), anotherRoot} {
+		dir := filepath.Join(root, "dir")
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+
+		var entryNames []string
+		for _, entry := range entries {
+			entryNames = append(entryNames, entry.Name())
+
+			fileInfo, err := os.Stat(filepath.Join(dir, entry.Name()))
+			require.NoError(t, err)
+			require.Equal(t, uint64(1), uint64(fileInfo.Sys().(*syscall.Stat_t).Nlink), "file nlink wrong")
+		}
+		sort.Strings(entryNames)
+		names = append(names, entryNames)
+
+		// a directory without sub-directories is linked by its parent and itself
+		dirInfo, err := os.Stat(dir)
+		require.NoError(t, err)
+		require.Equal(t, uint64(2), uint64(dirInfo.Sys().(*syscall.Stat_t).Nlink), "directory nlink wrong")
+	}
+	require.Len(t, names[0], targets)
+	require.Equal(t, names[0], names[1])
+}
+
+func TestLockAcrossMounts(t *testing.T) {
+	if metaEngine() == "bolt" {
+		t.Skip("bolt database can only be opened by one gitfs instance")
+	}
+	ctx := context.Background()
+
+	testEnv := CreateTestEnvironment(ctx, t)
+	defer testEnv.Cleanup(ctx, t)
+
+	anotherRoot, unmount := testEnv.MountAnother(ctx, t)
+	defer unmount()
+
+	require.NoError(t, os.WriteFile(filepath.Join(testEnv.Root(), "index.lock"), []byte("lock"), 0644))
+
+	f1, err := os.OpenFile(filepath.Join(testEnv.Root(), "index.lock"), os.O_RDWR, 0)
+	require.NoError(t, err)
+	defer f1.Close()
+	f2, err := os.OpenFile(filepath.Join(anotherRoot, "index.lock"), os.O_RDWR, 0)
+	require.NoError(t, err)
+	defer f2.Close()
+
+	t.Run("flock", func(t *testing.T) {
+		require.NoError(t, syscall.Flock(int(f1.Fd()), syscall.LOCK_EX|syscall.LOCK_NB))
+		require.Equal(t, syscall.EWOULDBLOCK, syscall.Flock(int(f2.Fd()), syscall.LOCK_SH|syscall.LOCK_NB))
+		require.NoError(t, syscall.Flock(int(f1.Fd()), syscall.LOCK_UN))
+
+		require.NoError(t, syscall.Flock(int(f1.Fd()), syscall.LOCK_SH|syscall.LOCK_NB))
+		require.NoError(t, syscall.Flock(int(f2.Fd()), syscall.LOCK_SH|syscall.LOCK_NB))
+		require.Equal(t, syscall.EWOULDBLOCK, syscall.Flock(int(f2.Fd()), syscall.LOCK_EX|syscall.LOCK_NB))
+		require.NoError(t, syscall.Flock(int(f1.Fd()), syscall.LOCK_UN))
+		require.NoError(t, syscall.Flock(int(f2.Fd()), syscall.LOCK_EX|syscall.LOCK_NB))
+		require.NoError(t, syscall.Flock(int(f2.Fd()), syscall.LOCK_UN))
+	})
+
+	t.Run("posix", func(t *testing.T) {
+		lk := &syscall.Flock_t{Type: syscall.F_WRLCK, Whence: 0, Start: 0, Len: 10}
+		require.NoError(t, syscall.FcntlFlock(f1.Fd(), syscall.F_SETLK, lk))
+
+		lk = &syscall.Flock_t{Type: syscall.F_RDLCK, Whence: 0, Start: 5, Len: 10}
+		require.Equal(t, syscall.EAGAIN, syscall.FcntlFlock(f2.Fd(), syscall.F_SETLK, lk))
+		require.NoError(t, syscall.FcntlFlock(f2.Fd(), syscall.F_GETLK, lk))
+		require.Equal(t, int16(syscall.F_WRLCK), lk.Type)
+		require.Equal(t, int64(0), lk.Start)
+		require.Equal(t, int64(10), lk.Len)
+
+		lk = &syscall.Flock_t{Type: syscall.F_WRLCK, Whence: 0, Start: 10, Len: 10}
+		require.NoError(t, syscall.FcntlFlock(f2.Fd(), syscall.F_SETLK, lk))
+
+		// closing the file release the posix locks of the owner
+		require.NoError(t, f1.Close())
+		lk = &syscall.Flock_t{Type: syscall.F_WRLCK, Whence: 0, Start: 0, Len: 10}
+		require.NoError(t, syscall.FcntlFlock(f2.Fd(), syscall.F_SETLK, lk))
+	})
+}
+
+func TestUnlinkOpenFileAcrossMounts(t *testing.T) {
+	if metaEngine() == "bolt" {
+		t.Skip("bolt database can only be opened by one gitfs instance")
+	}
+	ctx := context.Background()
+
+	testEnv := CreateTestEnvironment(ctx, t)
+	defer testEnv.Cleanup(ctx, t)
+
+	anotherRoot, unmount := testEnv.MountAnother(ctx, t)
+	defer unmount()
+
+	f, err := os.Create(filepath.Join(testEnv.Root(), "file"))
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = f.Write([]byte("before unlink "))
+	require.NoError(t, err)
+	require.NoError(t, f.Sync())
+	info, err := f.Stat()
+	require.NoError(t, err)
+	inode := metadata.Ino(info.Sys().(*syscall.Stat_t).Ino)
+
+	// the file is unlinked by another mount while it is open here
+	require.NoError(t, os.Remove(filepath.Join(anotherRoot, "file")))
+
+	_, err = f.Write([]byte("after unlink"))
+	require.NoError(t, err)
+	require.NoError(t, f.Sync())
+	got := make([]byte, len("before unlink after unlink"))
+	_, err = f.ReadAt(got, 0)
+	require.NoError(t, err)
+	require.Equal(t, "before unlink after unlink", string(got))
+
+	meta, err := metadata.NewMeta(testEnv.testStorage.GetMetadataURL())
+	require.NoError(t, err)
+	attr, eno := meta.Getattr(ctx, inode)
+	require.Equal(t, syscall.Errno(0), eno)
+	require.Equal(t, uint32(0), attr.Nlink)
+
+	require.NoError(t, f.Close())
+	require.Eventually(t, func() bool {
+		_, eno := meta.Getattr(ctx, inode)
+		return eno == syscall.ENOENT
+	}, 5*time.Second, 100*time.Millisecond)
+}
+
+func TestConcurrentUpdateRef(t *testing.T) {
+	if metaEngine() == "bolt" {
+		t.Skip("bolt database can only be opened by one gitfs instance")
+	}
+	ctx := context.Background()
+
+	testEnv := CreateTestEnvironment(ctx, t)
+	defer testEnv.Cleanup(ctx, t)
+
+	anotherRoot, unmount := testEnv.MountAnother(ctx, t)
+	defer unmount()
+
+	repoPath := filepath.Join(testEnv.Root(), "test-repo")
+	gitInit(ctx, t, repoPath)
+	gitDirs := []string{
+		filepath.Join(repoPath, ".git"),
+		filepath.Join(anotherRoot, "test-repo", ".git"),
+	}
+
+	const workers = 6
+	const rounds = 10
+
+	tree := gitOutput(ctx, t, cmd.NewGitCommand("write-tree").WithGitDir(gitDirs[0]))
+	oids := make([]string, workers+1)
+	for i := range oids {
+		oids[i] = gitOutput(ctx, t, cmd.NewGitCommand("commit-tree").WithGitDir(gitDirs[0]).
+			WithOptions("-m", fmt.Sprintf("commit %d", i)).WithArgs(tree))
+	}
+
+	for round := 0; round < rounds; round++ {
+		updateRef := cmd.NewGitCommand("update-ref").WithGitDir(gitDirs[0]).WithArgs("refs/heads/race", oids[0])
+		require.NoError(t, updateRef.Start(ctx))
+		require.NoError(t, updateRef.Wait())
+
+		// every worker try to move the ref from oids[0], only one of them can take refs/heads/race.lock
+		var wg sync.WaitGroup
+		var wins int32
+		var winner int32
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				updateRef := cmd.NewGitCommand("update-ref").WithGitDir(gitDirs[w%2]).
+					WithArgs("refs/heads/race", oids[w+1], oids[0])
+				if err := updateRef.Start(ctx); err != nil {
+					return
+				}
+				if err := updateRef.Wait(); err == nil {
+					atomic.AddInt32(&wins, 1)
+					atomic.StoreInt32(&winner, int32(w))
+				}
+			}(w)
+		}
+		wg.Wait()
+
+		require.Equalf(t, int32(1), wins, "round %d", round)
+		for _, gitDir := range gitDirs {
+			value := gitOutput(ctx, t, cmd.NewGitCommand("rev-parse").WithGitDir(gitDir).WithArgs("refs/heads/race"))
+			require.Equalf(t, oids[winner+1], value, "round %d", round)
+			require.NoFileExists(t, filepath.Join(gitDir, "refs", "heads", "race.lock"))
+		}
+	}
+}
+
+// gitOutput run the git command and return its stdout without the trailing newline
+func gitOutput(ctx context.Context, t *testing.T, gitCmd *cmd.Command) string {
+	var out strings.Builder
+	gitCmd.WithStdout(&out)
+
+	require.NoError(t, gitCmd.Start(ctx))
+	require.NoError(t, gitCmd.Wait())
+	return strings.TrimRight(out.String(), "\n")
+}
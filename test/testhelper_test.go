@@ -6,6 +6,7 @@ import (
 	"github.com/adlternative/tinygitfs/pkg/gitfs"
 	"github.com/hanwen/go-fuse/v2/fuse"
 	"os"
+	"path/filepath"
 	"strings"
 
 	tcminio "github.com/romnn/testcontainers/minio"
@@ -14,9 +15,29 @@ import (
 	"testing"
 )
 
+// metaEngine return the metadata engine the tests run with,
+// which can be selected by env TINYGITFS_TEST_META, e.g. redis, bolt, sqlite3
+func metaEngine() string {
+	if engine := os.Getenv("TINYGITFS_TEST_META"); engine != "" {
+		return engine
+	}
+	return "redis"
+}
+
+// dataEngine return the object storage the tests run with,
+// which can be selected by env TINYGITFS_TEST_DATA, e.g. s3, file, mem
+func dataEngine() string {
+	if engine := os.Getenv("TINYGITFS_TEST_DATA"); engine != "" {
+		return engine
+	}
+	return "s3"
+}
+
 type TestStorage struct {
-	minioC tcminio.Container
-	redisC tcredis.Container
+	minioC  tcminio.Container
+	redisC  tcredis.Container
+	metaDir string
+	dataDir string
 }
 
 func (ts *TestStorage) GetMinioURI() string {
@@ -27,32 +48,75 @@ func (ts *TestStorage) GetRedisURI() string {
 	return strings.ReplaceAll(ts.redisC.ConnectionURI(), "localhost", "127.0.0.1")
 }
 
+func (ts *TestStorage) GetMetadataURL() string {
+	switch metaEngine() {
+	case "bolt":
+		return "bolt://" + filepath.Join(ts.metaDir, "meta.db")
+	case "sqlite3":
+		return "sqlite3://" + filepath.Join(ts.metaDir, "meta.db")
+	default:
+		return "redis://" + ts.GetRedisURI()
+	}
+}
+
+func (ts *TestStorage) GetDataOption() *data.Option {
+	switch dataEngine() {
+	case "file":
+		return &data.Option{URL: "file://" + ts.dataDir}
+	case "mem":
+		return &data.Option{URL: "mem://" + filepath.Base(ts.dataDir)}
+	default:
+		return &data.Option{
+			URL:       "s3://gitfs",
+			EndPoint:  "http://" + ts.GetMinioURI(),
+			Accesskey: "minioadmin",
+			SecretKey: "minioadmin",
+		}
+	}
+}
+
 func (ts *TestStorage) Cleanup(ctx context.Context, t *testing.T) {
 	ts.redisC.Terminate(ctx)
 	ts.minioC.Terminate(ctx)
+	require.NoError(t, os.RemoveAll(ts.metaDir))
+	require.NoError(t, os.RemoveAll(ts.dataDir))
 }
 
 func CreateTestStorage(ctx context.Context, t *testing.T) *TestStorage {
-	minioC, err := tcminio.Start(ctx, tcminio.Options{
-		ImageTag:     "latest",
-		RootUser:     "minioadmin",
-		RootPassword: "minioadmin",
-	})
-	require.NoError(t, err)
-
-	redisC, err := tcredis.Start(ctx, tcredis.Options{
-		ImageTag: "latest",
-	})
-	require.NoError(t, err)
+	var err error
+	testStorage := &TestStorage{}
+
+	switch dataEngine() {
+	case "s3":
+		testStorage.minioC, err = tcminio.Start(ctx, tcminio.Options{
+			ImageTag:     "latest",
+			RootUser:     "minioadmin",
+			RootPassword: "minioadmin",
+		})
+		require.NoError(t, err)
+	default:
+		// the directory of file, and the unique name of mem
+		testStorage.dataDir, err = os.MkdirTemp("/tmp", "tinygitfs-data-*")
+		require.NoError(t, err)
+	}
 
-	return &TestStorage{
-		minioC: minioC,
-		redisC: redisC,
+	switch metaEngine() {
+	case "redis":
+		testStorage.redisC, err = tcredis.Start(ctx, tcredis.Options{
+			ImageTag: "latest",
+		})
+		require.NoError(t, err)
+	default:
+		testStorage.metaDir, err = os.MkdirTemp("/tmp", "tinygitfs-meta-*")
+		require.NoError(t, err)
 	}
+
+	return testStorage
 }
 
 type TestEnv struct {
 	testStorage *TestStorage
+	option      *gitfs.Option
 	mntDir      string
 	testServer  *fuse.Server
 }
@@ -68,22 +132,40 @@ func (te *TestEnv) Cleanup(ctx context.Context, t *testing.T) {
 }
 
 func CreateTestEnvironment(ctx context.Context, t *testing.T) *TestEnv {
+	return CreateTestEnvironmentWithOption(ctx, t, nil)
+}
+
+// CreateTestEnvironmentWithOption mount gitfs with the option, e.g. the routes
+func CreateTestEnvironmentWithOption(ctx context.Context, t *testing.T, option *gitfs.Option) *TestEnv {
 	testStorage := CreateTestStorage(ctx, t)
 
-	tempMntDir, err := os.MkdirTemp("/tmp", "tinygitfs-*")
-	require.NoError(t, err)
-
-	server, err := gitfs.Mount(ctx, tempMntDir, false, "redis://"+testStorage.GetRedisURI(), &data.Option{
-		EndPoint:  "http://" + testStorage.GetMinioURI(),
-		Bucket:    "gitfs",
-		Accesskey: "minioadmin",
-		SecretKey: "minioadmin",
-	})
-	require.NoError(t, err)
+	tempMntDir, server := mountTestStorage(ctx, t, testStorage, option)
 
 	return &TestEnv{
 		testStorage: testStorage,
+		option:      option,
 		mntDir:      tempMntDir,
 		testServer:  server,
 	}
 }
+
+// MountAnother mount another gitfs instance on the same storage,
+// returns its mount directory and a function to unmount it.
+func (te *TestEnv) MountAnother(ctx context.Context, t *testing.T) (string, func()) {
+	tempMntDir, server := mountTestStorage(ctx, t, te.testStorage, te.option)
+
+	return tempMntDir, func() {
+		require.NoError(t, server.Unmount())
+		require.NoError(t, os.RemoveAll(tempMntDir))
+	}
+}
+
+func mountTestStorage(ctx context.Context, t *testing.T, testStorage *TestStorage, option *gitfs.Option) (string, *fuse.Server) {
+	tempMntDir, err := os.MkdirTemp("/tmp", "tinygitfs-*")
+	require.NoError(t, err)
+
+	server, err := gitfs.Mount(ctx, tempMntDir, false, testStorage.GetMetadataURL(), testStorage.GetDataOption(), option)
+	require.NoError(t, err)
+
+	return tempMntDir, server
+}